@@ -0,0 +1,187 @@
+package access
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Role is permission level of user in chat, higher role includes lower ones.
+// Viewer watches pipelines, reads info and subscribes chat, operator also retries, cancels and runs pipelines,
+// plays manual jobs and approves deployments, admin also resumes paused jobs of chat
+type Role int
+
+const (
+	RoleNone Role = iota
+	RoleViewer
+	RoleOperator
+	RoleAdmin
+)
+
+func (r Role) String() string {
+	switch r {
+	case RoleViewer:
+		return "viewer"
+	case RoleOperator:
+		return "operator"
+	case RoleAdmin:
+		return "admin"
+	}
+
+	return "none"
+}
+
+// ParseRole parses role name
+func ParseRole(name string) (Role, error) {
+	switch name {
+	case "viewer":
+		return RoleViewer, nil
+	case "operator":
+		return RoleOperator, nil
+	case "admin":
+		return RoleAdmin, nil
+	}
+
+	return RoleNone, fmt.Errorf("unknown role %s, it should be viewer, operator or admin", name)
+}
+
+// ParseList parses comma separated ids with optional role, ex. 123,456:viewer,
+// ids without role get defaultRole
+func ParseList(value string, defaultRole Role) (map[int64]Role, error) {
+	roles := map[int64]Role{}
+
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		idValue, roleName, hasRole := strings.Cut(item, ":")
+
+		id, err := strconv.ParseInt(idValue, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("wrong item %s, it should be like 12345 or 12345:viewer", item)
+		}
+
+		role := defaultRole
+		if hasRole {
+			if role, err = ParseRole(roleName); err != nil {
+				return nil, fmt.Errorf("wrong item %s, role should be viewer, operator or admin", item)
+			}
+		}
+
+		roles[id] = role
+	}
+
+	return roles, nil
+}
+
+// Grant gives role to users, if Projects are set role is given only in projects matching them,
+// patterns are globs like group/*
+type Grant struct {
+	Role     Role
+	Users    []int64
+	Projects []string
+}
+
+func (g Grant) hasUser(userID int64) bool {
+	for _, id := range g.Users {
+		if id == userID {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matches reports whether grant applies to project, grants without projects apply everywhere,
+// project scoped grants don't apply to actions without project
+func (g Grant) matches(project string) bool {
+	if len(g.Projects) == 0 {
+		return true
+	}
+
+	for _, pattern := range g.Projects {
+		if matched, _ := path.Match(pattern, project); matched && project != "" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ValidatePattern reports wrong project pattern
+func ValidatePattern(pattern string) error {
+	if _, err := path.Match(pattern, ""); err != nil || pattern == "" {
+		return fmt.Errorf("wrong project pattern %s, it should be like group/project or group/*", pattern)
+	}
+
+	return nil
+}
+
+// Policy decides role of user in chat. IDs are legacy ALLOWED_IDS, they are allowed as users and as chats,
+// users are admins and groups give viewer role to members. Users have own role in every allowed chat, Chats give role to all their members,
+// Grants are roles from config, optionally limited to projects
+type Policy struct {
+	IDs    map[int64]Role
+	Users  map[int64]Role
+	Chats  map[int64]Role
+	Grants []Grant
+}
+
+// Role returns role of user in chat for project, empty project is action without project.
+// In private chat role of user is used, in group chat must be allowed,
+// member gets the highest of chat and own roles
+func (p Policy) Role(chatID, userID int64, private bool, project string) Role {
+	return p.role(chatID, userID, private, func(g Grant) bool { return g.matches(project) })
+}
+
+// MaxRole returns the highest role of user in chat in any project, it tells whether user can use the bot at all
+func (p Policy) MaxRole(chatID, userID int64, private bool) Role {
+	return p.role(chatID, userID, private, func(Grant) bool { return true })
+}
+
+// HasProjectGrants reports whether some roles depend on project
+func (p Policy) HasProjectGrants() bool {
+	for _, grant := range p.Grants {
+		if len(grant.Projects) > 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (p Policy) role(chatID, userID int64, private bool, applies func(Grant) bool) Role {
+	role := max(p.IDs[userID], p.Users[userID])
+
+	for _, grant := range p.Grants {
+		if grant.hasUser(userID) && applies(grant) {
+			role = max(role, grant.Role)
+		}
+	}
+
+	if private {
+		return max(role, p.IDs[chatID])
+	}
+
+	chatRole := max(p.IDs[chatID], p.Chats[chatID])
+	if chatRole == RoleNone {
+		return RoleNone
+	}
+
+	return max(chatRole, role)
+}
+
+// Check reports whether role is enough for action, denials are written to audit log
+func Check(action string, chatID, userID int64, project string, role, required Role) bool {
+	if role >= required {
+		return true
+	}
+
+	log.Printf("audit: denied %s for user %d in chat %d, project %q, role %s, required %s", action, userID, chatID, project, role, required)
+
+	return false
+}
@@ -0,0 +1,144 @@
+package access
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseList(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    map[int64]Role
+		wantErr bool
+	}{
+		{"empty", "", map[int64]Role{}, false},
+		{"default role", "1, -100", map[int64]Role{1: RoleAdmin, -100: RoleAdmin}, false},
+		{"own role", "1:viewer,2:admin,3:operator", map[int64]Role{1: RoleViewer, 2: RoleAdmin, 3: RoleOperator}, false},
+		{"wrong id", "test", nil, true},
+		{"wrong role", "1:owner", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseList(tt.value, RoleAdmin)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseList() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("ParseList() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestPolicy_Role(t *testing.T) {
+	policy := Policy{
+		IDs:   map[int64]Role{1: RoleAdmin, -1: RoleAdmin},
+		Users: map[int64]Role{2: RoleAdmin, 3: RoleViewer},
+		Chats: map[int64]Role{-100: RoleViewer},
+		Grants: []Grant{
+			{Role: RoleOperator, Users: []int64{3}},
+			{Role: RoleAdmin, Users: []int64{4}, Projects: []string{"group/*"}},
+		},
+	}
+
+	tests := []struct {
+		name    string
+		chatID  int64
+		userID  int64
+		private bool
+		project string
+		want    Role
+	}{
+		{"legacy user", 1, 1, true, "", RoleAdmin},
+		{"legacy group", -1, 5, false, "", RoleAdmin},
+		{"user", 2, 2, true, "", RoleAdmin},
+		{"operator grant", 3, 3, true, "", RoleOperator},
+		{"unknown user", 5, 5, true, "", RoleNone},
+		{"group member", -100, 5, false, "", RoleViewer},
+		{"admin in group", -100, 2, false, "", RoleAdmin},
+		{"admin in unknown group", -200, 2, false, "", RoleNone},
+		{"legacy user in group", -100, 1, false, "", RoleAdmin},
+		{"project grant", 4, 4, true, "group/project", RoleAdmin},
+		{"project grant in other group", 4, 4, true, "other/project", RoleNone},
+		{"project grant in subgroup", 4, 4, true, "group/sub/project", RoleNone},
+		{"project grant without project", 4, 4, true, "", RoleNone},
+		{"project grant in group", -100, 4, false, "other/project", RoleViewer},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := policy.Role(tt.chatID, tt.userID, tt.private, tt.project); got != tt.want {
+				t.Errorf("Policy.Role() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPolicy_MaxRole(t *testing.T) {
+	policy := Policy{
+		Chats:  map[int64]Role{-100: RoleViewer},
+		Grants: []Grant{{Role: RoleOperator, Users: []int64{4}, Projects: []string{"group/*"}}},
+	}
+
+	tests := []struct {
+		name    string
+		chatID  int64
+		userID  int64
+		private bool
+		want    Role
+	}{
+		{"project grant", 4, 4, true, RoleOperator},
+		{"project grant in group", -100, 4, false, RoleOperator},
+		{"project grant in unknown group", -200, 4, false, RoleNone},
+		{"unknown user", 5, 5, true, RoleNone},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := policy.MaxRole(tt.chatID, tt.userID, tt.private); got != tt.want {
+				t.Errorf("Policy.MaxRole() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheck(t *testing.T) {
+	tests := []struct {
+		name     string
+		role     Role
+		required Role
+		want     bool
+	}{
+		{"enough", RoleOperator, RoleOperator, true},
+		{"higher", RoleAdmin, RoleViewer, true},
+		{"lower", RoleViewer, RoleOperator, false},
+		{"none", RoleNone, RoleViewer, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Check("retry", 1, 1, "group/project", tt.role, tt.required); got != tt.want {
+				t.Errorf("Check() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidatePattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		wantErr bool
+	}{
+		{"group/project", false},
+		{"group/*", false},
+		{"", true},
+		{"group/[", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pattern, func(t *testing.T) {
+			if err := ValidatePattern(tt.pattern); (err != nil) != tt.wantErr {
+				t.Errorf("ValidatePattern() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -2,30 +2,279 @@ package config
 
 import (
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"io/fs"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
+
+	"github.com/ad/gitlab-pipelines-notifier/access"
+	"github.com/ad/gitlab-pipelines-notifier/filter"
 )
 
 const ConfigFileName = "data/options.json"
 
+const DefaultFailedJobLogLines = 30
+
+// Version of config schema, version 1 is flat legacy config without projects list,
+// its GITLAB_TRACK_PROJECTS, GITLAB_TRACK_REFS and GITLAB_TRACK_SOURCES are migrated to projects
+const Version = 2
+
+// DefaultInterval is polling interval of tracked projects
+const DefaultInterval = "10s"
+
+const minInterval = time.Second
+
+// DefaultWatchTimeout is how long pipeline is watched, time in manual and scheduled states is not counted
+const DefaultWatchTimeout = time.Hour
+
+// Statuses are pipeline statuses which can be notified
+var Statuses = []string{
+	"created",
+	"waiting_for_resource",
+	"preparing",
+	"pending",
+	"running",
+	"success",
+	"failed",
+	"canceled",
+	"skipped",
+	"manual",
+	"scheduled",
+}
+
+// NotifierTypes are services notifications can be sent to
+var NotifierTypes = []string{
+	"telegram",
+	"slack",
+	"mattermost",
+	"teams",
+	"discord",
+	"webhook",
+}
+
+// Notifier is named notification target, projects and subscriptions route notifications to it by name
+type Notifier struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+
+	// URL is incoming webhook url, it is not used by telegram
+	URL string `json:"url,omitempty"`
+
+	// Chat is telegram chat id and Thread is forum topic in it, they are used only by telegram
+	Chat   int64 `json:"chat,omitempty"`
+	Thread int   `json:"thread,omitempty"`
+}
+
+func (n Notifier) validate() error {
+	var problems []string
+
+	if n.Name == "" {
+		problems = append(problems, "name not set")
+	}
+
+	switch n.Type {
+	case "telegram":
+		if n.Chat == 0 {
+			problems = append(problems, "chat not set")
+		}
+	case "slack", "mattermost", "teams", "discord", "webhook":
+		if u, err := url.Parse(n.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problems = append(problems, "wrong url "+n.URL+", it should be like https://host/hooks/id")
+		}
+	default:
+		problems = append(problems, "unknown type "+n.Type+", it should be one of "+strings.Join(NotifierTypes, ", "))
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("notifier %s: %s", n.Name, strings.Join(problems, ", "))
+	}
+
+	return nil
+}
+
+// RoleGrant gives role to telegram users, optionally only in projects matching patterns like group/*
+type RoleGrant struct {
+	Role     string   `json:"role"`
+	Users    []int64  `json:"users"`
+	Projects []string `json:"projects,omitempty"`
+}
+
+func (g RoleGrant) validate() error {
+	var problems []string
+
+	if _, err := access.ParseRole(g.Role); err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	if len(g.Users) == 0 {
+		problems = append(problems, "users not set")
+	}
+
+	for _, pattern := range g.Projects {
+		if err := access.ValidatePattern(pattern); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("role %s: %s", g.Role, strings.Join(problems, ", "))
+	}
+
+	return nil
+}
+
+// TrackProject is tracked project with own rules
+type TrackProject struct {
+	Project string `json:"project"`
+
+	// Chats are notified about pipelines, NOTIFY_TELEGRAM_ID is used if both Chats and Notifiers are empty
+	Chats []int64 `json:"chats,omitempty"`
+
+	// Notifiers are names of notifiers from config notified about pipelines besides Chats
+	Notifiers []string `json:"notifiers,omitempty"`
+
+	Refs    []string `json:"refs,omitempty"`
+	Sources []string `json:"sources,omitempty"`
+
+	// Statuses to notify on, all statuses are notified if empty
+	Statuses []string `json:"statuses,omitempty"`
+
+	// Template is text/template of notification, pipeline fields are available, ex. {{.Status}} {{.Ref}} {{.WebURL}},
+	// also {{.Project}} and {{.Emoji}}
+	Template string `json:"template,omitempty"`
+
+	// Interval is polling interval, ex. 30s or 5m, default 10s
+	Interval string `json:"interval,omitempty"`
+
+	// WatchTimeout is timeout of pipeline watches in project, ex. 4h, WATCH_TIMEOUT is used if empty
+	WatchTimeout string `json:"watch_timeout,omitempty"`
+}
+
+// Filter returns ref and source filter of project
+func (p TrackProject) Filter() filter.Filter {
+	return filter.Filter{Refs: p.Refs, Sources: p.Sources}
+}
+
+func (p TrackProject) validate() error {
+	var problems []string
+
+	if p.Project == "" {
+		problems = append(problems, "project not set")
+	}
+
+	if err := p.Filter().Validate(); err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	for _, status := range p.Statuses {
+		if !isKnownStatus(status) {
+			problems = append(problems, "unknown pipeline status "+status)
+		}
+	}
+
+	if p.Template != "" {
+		if _, err := template.New(p.Project).Parse(p.Template); err != nil {
+			problems = append(problems, "wrong template: "+err.Error())
+		}
+	}
+
+	if p.Interval != "" {
+		if interval, err := time.ParseDuration(p.Interval); err != nil || interval < minInterval {
+			problems = append(problems, "wrong interval "+p.Interval+", it should be like 30s or 5m")
+		}
+	}
+
+	if p.WatchTimeout != "" {
+		if _, err := parseTimeout(p.WatchTimeout); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("project %s: %s", p.Project, strings.Join(problems, ", "))
+	}
+
+	return nil
+}
+
+func parseTimeout(value string) (time.Duration, error) {
+	timeout, err := time.ParseDuration(value)
+	if err != nil || timeout < time.Minute {
+		return 0, fmt.Errorf("wrong watch timeout %s, it should be like 90m or 4h", value)
+	}
+
+	return timeout, nil
+}
+
+func isKnownStatus(status string) bool {
+	for _, s := range Statuses {
+		if s == status {
+			return true
+		}
+	}
+
+	return false
+}
+
 // Config ...
 type Config struct {
+	Version int `json:"version,omitempty"`
+
 	TelegramToken    string `json:"TELEGRAM_TOKEN"`
 	AllowedIDs       string `json:"ALLOWED_IDS"`
 	NotifyTelegramID string `json:"NOTIFY_TELEGRAM_ID"`
 
+	// AllowedUsers and AllowedChats are comma separated ids with optional role, ex. 123,456:viewer,
+	// users are admins and chat members are viewers by default
+	AllowedUsers string `json:"ALLOWED_USERS"`
+	AllowedChats string `json:"ALLOWED_CHATS"`
+
 	GitlabToken         string `json:"GITLAB_TOKEN"`
 	GitlabURL           string `json:"GITLAB_URL"`
 	GitlabUsername      string `json:"GITLAB_USERNAME"`
 	GitlabTrackProjects string `json:"GITLAB_TRACK_PROJECTS"`
 	GitlabTrackOnlySelf bool   `json:"GITLAB_TRACK_ONLY_SELF"`
+	GitlabTrackRefs     string `json:"GITLAB_TRACK_REFS"`
+	GitlabTrackSources  string `json:"GITLAB_TRACK_SOURCES"`
+
+	FailedJobLogLines  int  `json:"FAILED_JOB_LOG_LINES"`
+	FailedJobLogAsFile bool `json:"FAILED_JOB_LOG_AS_FILE"`
+
+	WatchTimeout string `json:"WATCH_TIMEOUT"`
+
+	WebhookSecret string `json:"WEBHOOK_SECRET"`
+	WebhookListen string `json:"WEBHOOK_LISTEN"`
+
+	// IdentitySecret encrypts gitlab tokens linked with /login, /login is disabled if empty
+	IdentitySecret string `json:"IDENTITY_SECRET"`
+
+	// Projects are tracked projects with own rules, legacy GITLAB_TRACK_PROJECTS are added here on migration
+	Projects []TrackProject `json:"projects,omitempty"`
+
+	// Notifiers are notification targets besides chats of projects and subscriptions
+	Notifiers []Notifier `json:"notifiers,omitempty"`
+
+	// Roles give roles to users besides ALLOWED_USERS, they can be limited to projects
+	Roles []RoleGrant `json:"roles,omitempty"`
 
 	GitlabTrackProjectsList []string
 	AllowedIDsList          []string
+
+	// FilePath is path of loaded config file in root file system, empty if there was no file
+	FilePath string `json:"-"`
+
+	// GitlabTrackFilter selects pipelines of tracked projects by ref and source
+	GitlabTrackFilter filter.Filter
 }
 
 func lookupEnvOrString(key, defaultVal string) string {
@@ -36,67 +285,409 @@ func lookupEnvOrString(key, defaultVal string) string {
 	return defaultVal
 }
 
+func lookupEnvOrInt(key string, defaultVal int) int {
+	if val, ok := os.LookupEnv(key); ok {
+		if v, err := strconv.Atoi(val); err == nil {
+			return v
+		}
+	}
+
+	return defaultVal
+}
+
+func lookupEnvOrBool(key string, defaultVal bool) bool {
+	if val, ok := os.LookupEnv(key); ok {
+		if v, err := strconv.ParseBool(val); err == nil {
+			return v
+		}
+	}
+
+	return defaultVal
+}
+
+// defaults are the lowest layer of config, values from file, env vars and flags override them
+func defaults() *Config {
+	return &Config{
+		FailedJobLogLines: DefaultFailedJobLogLines,
+	}
+}
+
+// configPathFromArgs finds -config flag before flags are parsed, config file is loaded before
+// env vars and flags, so they can override it
+func configPathFromArgs(args []string) string {
+	path := ""
+
+	for i := 0; i < len(args); i++ {
+		name, value, hasValue := strings.Cut(strings.TrimLeft(args[i], "-"), "=")
+		if !strings.HasPrefix(args[i], "-") || name != "config" {
+			continue
+		}
+
+		if !hasValue && i+1 < len(args) {
+			i++
+			value = args[i]
+		}
+
+		path = value
+	}
+
+	return path
+}
+
+// InitConfig builds config from layers with precedence defaults < file < env vars < flags.
+// Config file is filename in fileSystem, it can be changed with -config flag or CONFIG_PATH env var,
+// missing default file is skipped, missing user file is error.
+// All invalid or missing fields are reported at once
 func InitConfig(args []string, fileSystem fs.FS, filename string) (*Config, error) {
-	config := &Config{}
+	config := defaults()
 
-	var initFromFile = false
+	userPath := lookupEnvOrString("CONFIG_PATH", "")
+	if path := configPathFromArgs(args[1:]); path != "" {
+		userPath = path
+	}
 
-	if fileSystem != nil {
-		// TODO: add read config from user path
+	if userPath != "" {
+		filename = fsPath(userPath)
+	}
 
-		if jsonFile, err := fileSystem.Open(filename); err == nil {
+	if fileSystem != nil && filename != "" {
+		jsonFile, err := fileSystem.Open(filename)
+
+		switch {
+		case err == nil:
 			defer jsonFile.Close()
 
 			byteValue, _ := io.ReadAll(jsonFile)
 			if err = json.Unmarshal(byteValue, &config); err != nil {
 				return nil, fmt.Errorf("error on unmarshal config from file %s", err.Error())
-			} else {
-				initFromFile = true
 			}
-		} else {
+
+			config.FilePath = filename
+		case userPath != "" || !errors.Is(err, fs.ErrNotExist):
 			return nil, fmt.Errorf("can't read file, %s", err.Error())
 		}
 	}
 
-	if !initFromFile {
-		flags := flag.NewFlagSet(args[0], flag.ContinueOnError)
-		flags.StringVar(&config.TelegramToken, "TELEGRAM_TOKEN", lookupEnvOrString("TELEGRAM_TOKEN", config.TelegramToken), "telegram bot token")
-		flags.StringVar(&config.GitlabToken, "GITLAB_TOKEN", lookupEnvOrString("GITLAB_TOKEN", config.GitlabToken), "gitlab token")
-		flags.StringVar(&config.GitlabURL, "GITLAB_URL", lookupEnvOrString("GITLAB_URL", config.GitlabURL), "gitlab url, ex. https://git.mydomain.com/api/v4")
-		flags.StringVar(&config.AllowedIDs, "ALLOWED_IDS", lookupEnvOrString("ALLOWED_IDS", config.AllowedIDs), "allowed telegram ids, ex. 123456,123457")
-		flags.StringVar(&config.NotifyTelegramID, "NOTIFY_TELEGRAM_ID", lookupEnvOrString("NOTIFY_TELEGRAM_ID", config.NotifyTelegramID), "notify telegram id, ex. 123456")
-		flags.StringVar(&config.GitlabUsername, "GITLAB_USERNAME", lookupEnvOrString("GITLAB_USERNAME", config.GitlabUsername), "gitlab username, ex. user")
-		flags.StringVar(&config.GitlabTrackProjects, "GITLAB_TRACK_PROJECTS", lookupEnvOrString("GITLAB_TRACK_PROJECTS", config.GitlabTrackProjects), "gitlab track projects, ex. project1,project2")
-		flags.BoolVar(&config.GitlabTrackOnlySelf, "GITLAB_TRACK_ONLY_SELF", true, "track only own gitlab projects, ex. true or false")
+	// only own pipelines are tracked by default without config file, config file tracks all of them unless it is set
+	if config.FilePath == "" {
+		config.GitlabTrackOnlySelf = true
+	}
 
-		if err := flags.Parse(args[1:]); err != nil {
-			return nil, err
-		}
+	if config.Version > Version {
+		return nil, fmt.Errorf("config version %d is not supported, update the bot", config.Version)
+	}
+
+	flags := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	flags.String("config", userPath, "config file path, ex. /data/options.json, CONFIG_PATH env var can be used too")
+	flags.StringVar(&config.TelegramToken, "TELEGRAM_TOKEN", lookupEnvOrString("TELEGRAM_TOKEN", config.TelegramToken), "telegram bot token")
+	flags.StringVar(&config.GitlabToken, "GITLAB_TOKEN", lookupEnvOrString("GITLAB_TOKEN", config.GitlabToken), "gitlab token")
+	flags.StringVar(&config.GitlabURL, "GITLAB_URL", lookupEnvOrString("GITLAB_URL", config.GitlabURL), "gitlab url, ex. https://git.mydomain.com/api/v4")
+	flags.StringVar(&config.AllowedIDs, "ALLOWED_IDS", lookupEnvOrString("ALLOWED_IDS", config.AllowedIDs), "allowed telegram ids, ex. 123456,123457")
+	flags.StringVar(&config.AllowedUsers, "ALLOWED_USERS", lookupEnvOrString("ALLOWED_USERS", config.AllowedUsers), "allowed telegram users with optional role, ex. 123456,123457:viewer")
+	flags.StringVar(&config.AllowedChats, "ALLOWED_CHATS", lookupEnvOrString("ALLOWED_CHATS", config.AllowedChats), "allowed telegram chats with optional role of members, ex. -100123456,-100123457:admin")
+	flags.StringVar(&config.NotifyTelegramID, "NOTIFY_TELEGRAM_ID", lookupEnvOrString("NOTIFY_TELEGRAM_ID", config.NotifyTelegramID), "notify telegram id, ex. 123456")
+	flags.StringVar(&config.GitlabUsername, "GITLAB_USERNAME", lookupEnvOrString("GITLAB_USERNAME", config.GitlabUsername), "gitlab username, ex. user")
+	flags.StringVar(&config.GitlabTrackProjects, "GITLAB_TRACK_PROJECTS", lookupEnvOrString("GITLAB_TRACK_PROJECTS", config.GitlabTrackProjects), "gitlab track projects, ex. project1,project2")
+	flags.BoolVar(&config.GitlabTrackOnlySelf, "GITLAB_TRACK_ONLY_SELF", lookupEnvOrBool("GITLAB_TRACK_ONLY_SELF", config.GitlabTrackOnlySelf), "track only own gitlab projects, ex. true or false")
+	flags.StringVar(&config.GitlabTrackRefs, "GITLAB_TRACK_REFS", lookupEnvOrString("GITLAB_TRACK_REFS", config.GitlabTrackRefs), "refs of tracked projects pipelines, globs or /regexps/, ! excludes, ex. main,release/*,!renovate/*")
+	flags.StringVar(&config.GitlabTrackSources, "GITLAB_TRACK_SOURCES", lookupEnvOrString("GITLAB_TRACK_SOURCES", config.GitlabTrackSources), "sources of tracked projects pipelines, ex. push,merge_request_event,schedule,trigger")
+	flags.IntVar(&config.FailedJobLogLines, "FAILED_JOB_LOG_LINES", lookupEnvOrInt("FAILED_JOB_LOG_LINES", config.FailedJobLogLines), "lines of failed job log to send, 0 for default 30, -1 to disable")
+	flags.BoolVar(&config.FailedJobLogAsFile, "FAILED_JOB_LOG_AS_FILE", lookupEnvOrBool("FAILED_JOB_LOG_AS_FILE", config.FailedJobLogAsFile), "send failed job log as file instead of message")
+	flags.StringVar(&config.WatchTimeout, "WATCH_TIMEOUT", lookupEnvOrString("WATCH_TIMEOUT", config.WatchTimeout), "how long pipeline is watched, ex. 90m or 4h, default 1h")
+	flags.StringVar(&config.WebhookSecret, "WEBHOOK_SECRET", lookupEnvOrString("WEBHOOK_SECRET", config.WebhookSecret), "gitlab webhook secret token, webhook receiver is disabled if empty")
+	flags.StringVar(&config.IdentitySecret, "IDENTITY_SECRET", lookupEnvOrString("IDENTITY_SECRET", config.IdentitySecret), "secret to encrypt gitlab tokens of users, /login is disabled if empty")
+	flags.StringVar(&config.WebhookListen, "WEBHOOK_LISTEN", lookupEnvOrString("WEBHOOK_LISTEN", config.WebhookListen), "listen address of webhook, health checks and metrics, ex. :18000")
+
+	if err := flags.Parse(args[1:]); err != nil {
+		return nil, err
 	}
 
+	if config.AllowedIDs != "" {
+		config.AllowedIDsList = strings.Split(config.AllowedIDs, ",")
+	}
+
+	if config.GitlabTrackProjects != "" {
+		config.GitlabTrackProjectsList = strings.Split(config.GitlabTrackProjects, ",")
+	}
+
+	config.GitlabTrackFilter = filter.Filter{
+		Refs:    filter.Split(config.GitlabTrackRefs),
+		Sources: filter.Split(config.GitlabTrackSources),
+	}
+
+	if config.FailedJobLogLines == 0 {
+		config.FailedJobLogLines = DefaultFailedJobLogLines
+	}
+
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+
+	config.migrate()
+
+	return config, nil
+}
+
+// validate reports every missing or invalid field
+func (config *Config) validate() error {
+	var errs []error
+
 	if config.TelegramToken == "" {
-		return nil, fmt.Errorf("%s", "TELEGRAM_TOKEN env var not set")
+		errs = append(errs, fmt.Errorf("%s", "TELEGRAM_TOKEN env var not set"))
 	}
 
 	if config.GitlabToken == "" {
-		return nil, fmt.Errorf("%s", "GITLAB_TOKEN env var not set")
+		errs = append(errs, fmt.Errorf("%s", "GITLAB_TOKEN env var not set"))
 	}
 
 	if config.GitlabURL == "" {
-		return nil, fmt.Errorf("%s", "GITLAB_URL env var not set")
+		errs = append(errs, fmt.Errorf("%s", "GITLAB_URL env var not set"))
 	}
 
-	if config.AllowedIDs == "" {
-		return nil, fmt.Errorf("%s", "ALLOWED_IDS env var not set")
+	if config.AllowedIDs == "" && config.AllowedUsers == "" && config.AllowedChats == "" && len(config.Roles) == 0 {
+		errs = append(errs, fmt.Errorf("%s", "ALLOWED_IDS, ALLOWED_USERS or ALLOWED_CHATS env var not set"))
 	}
 
-	if config.AllowedIDs != "" {
-		config.AllowedIDsList = strings.Split(config.AllowedIDs, ",")
+	for _, grant := range config.Roles {
+		if err := grant.validate(); err != nil {
+			errs = append(errs, err)
+		}
 	}
 
-	if config.GitlabTrackProjects != "" {
-		config.GitlabTrackProjectsList = strings.Split(config.GitlabTrackProjects, ",")
+	for _, id := range config.AllowedIDsList {
+		if _, err := strconv.ParseInt(id, 10, 64); err != nil {
+			errs = append(errs, fmt.Errorf("wrong ALLOWED_IDS item %s, it should be a number", id))
+		}
 	}
 
-	return config, nil
+	if _, err := access.ParseList(config.AllowedUsers, access.RoleAdmin); err != nil {
+		errs = append(errs, fmt.Errorf("wrong ALLOWED_USERS: %s", err))
+	}
+
+	if _, err := access.ParseList(config.AllowedChats, access.RoleViewer); err != nil {
+		errs = append(errs, fmt.Errorf("wrong ALLOWED_CHATS: %s", err))
+	}
+
+	if config.NotifyTelegramID != "" {
+		if _, err := strconv.ParseInt(config.NotifyTelegramID, 10, 64); err != nil {
+			errs = append(errs, fmt.Errorf("wrong NOTIFY_TELEGRAM_ID %s, it should be a number", config.NotifyTelegramID))
+		}
+	}
+
+	if config.WatchTimeout != "" {
+		if _, err := parseTimeout(config.WatchTimeout); err != nil {
+			errs = append(errs, fmt.Errorf("wrong WATCH_TIMEOUT: %s", err))
+		}
+	}
+
+	if err := config.GitlabTrackFilter.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("wrong GITLAB_TRACK_REFS or GITLAB_TRACK_SOURCES: %s", err))
+	}
+
+	names := map[string]bool{}
+
+	for _, notifier := range config.Notifiers {
+		if err := notifier.validate(); err != nil {
+			errs = append(errs, err)
+		}
+
+		if names[notifier.Name] {
+			errs = append(errs, fmt.Errorf("notifier %s is defined twice", notifier.Name))
+		}
+
+		names[notifier.Name] = true
+	}
+
+	for _, project := range config.Projects {
+		if err := project.validate(); err != nil {
+			errs = append(errs, err)
+		}
+
+		for _, name := range project.Notifiers {
+			if !names[name] {
+				errs = append(errs, fmt.Errorf("project %s: unknown notifier %s", project.Project, name))
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// fsPath converts path from flag or env var to path in root file system,
+// relative paths are resolved from working directory
+func fsPath(path string) string {
+	if !filepath.IsAbs(path) {
+		if abs, err := filepath.Abs(path); err == nil {
+			path = abs
+		}
+	}
+
+	return strings.TrimPrefix(filepath.ToSlash(path), "/")
+}
+
+// PipelineWatchTimeout returns timeout of pipeline watches in project,
+// timeout of project from config overrides WATCH_TIMEOUT
+func (config *Config) PipelineWatchTimeout(project string) time.Duration {
+	if config == nil {
+		return DefaultWatchTimeout
+	}
+
+	if p := config.trackProject(project); p != nil && p.WatchTimeout != "" {
+		if timeout, err := parseTimeout(p.WatchTimeout); err == nil {
+			return timeout
+		}
+	}
+
+	if timeout, err := parseTimeout(config.WatchTimeout); err == nil {
+		return timeout
+	}
+
+	return DefaultWatchTimeout
+}
+
+// Shared is config used by several goroutines, reloaded config is published as a whole,
+// readers take snapshot with Load and don't see partially applied config
+type Shared struct {
+	mu     sync.Mutex
+	config atomic.Pointer[Config]
+}
+
+func NewShared(conf *Config) *Shared {
+	s := &Shared{}
+	s.config.Store(conf)
+
+	return s
+}
+
+// Load returns current config, it must not be changed by caller
+func (s *Shared) Load() *Config {
+	if s == nil {
+		return nil
+	}
+
+	return s.config.Load()
+}
+
+// Update publishes reloaded config, values which can't be changed without restart are kept,
+// names of such changed values are returned
+func (s *Shared) Update(next *Config) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var restartRequired []string
+
+	if current := s.config.Load(); current != nil {
+		restartRequired = current.keepRestartRequired(next)
+	}
+
+	s.config.Store(next)
+
+	return restartRequired
+}
+
+// keepRestartRequired copies values which can't be changed without restart to next config,
+// names of changed values are returned
+func (config *Config) keepRestartRequired(next *Config) []string {
+	var restartRequired []string
+
+	keep := func(name string, current string, changed *string) {
+		if *changed != current {
+			restartRequired = append(restartRequired, name)
+			*changed = current
+		}
+	}
+
+	keep("TELEGRAM_TOKEN", config.TelegramToken, &next.TelegramToken)
+	keep("GITLAB_TOKEN", config.GitlabToken, &next.GitlabToken)
+	keep("GITLAB_URL", config.GitlabURL, &next.GitlabURL)
+	keep("WEBHOOK_LISTEN", config.WebhookListen, &next.WebhookListen)
+
+	// linked tokens can't be decrypted with another secret
+	keep("IDENTITY_SECRET", config.IdentitySecret, &next.IdentitySecret)
+
+	// secret is checked on every request, but receiver is started only if it is set
+	if (config.WebhookSecret == "") != (next.WebhookSecret == "") {
+		keep("WEBHOOK_SECRET", config.WebhookSecret, &next.WebhookSecret)
+	}
+
+	return restartRequired
+}
+
+// migrate moves legacy tracked projects to projects list, GitlabTrackProjectsList
+// is filled with all tracked projects after migration
+func (config *Config) migrate() {
+	for _, project := range config.GitlabTrackProjectsList {
+		if config.trackProject(project) != nil {
+			continue
+		}
+
+		config.Projects = append(config.Projects, TrackProject{
+			Project: project,
+			Refs:    config.GitlabTrackFilter.Refs,
+			Sources: config.GitlabTrackFilter.Sources,
+		})
+	}
+
+	config.GitlabTrackProjectsList = nil
+
+	for _, project := range config.Projects {
+		config.GitlabTrackProjectsList = append(config.GitlabTrackProjectsList, project.Project)
+	}
+
+	config.Version = Version
+}
+
+// AccessPolicy returns roles of users and chats, lists are validated on load, so errors are ignored
+func (config *Config) AccessPolicy() access.Policy {
+	policy := access.Policy{IDs: map[int64]access.Role{}}
+
+	if config == nil {
+		return policy
+	}
+
+	// legacy users are admins, members of legacy groups are viewers, other roles need ALLOWED_USERS or roles
+	for _, id := range config.AllowedIDsList {
+		if allowedID, err := strconv.ParseInt(strings.TrimSpace(id), 10, 64); err == nil {
+			policy.IDs[allowedID] = access.RoleAdmin
+			if allowedID < 0 {
+				policy.IDs[allowedID] = access.RoleViewer
+			}
+		}
+	}
+
+	policy.Users, _ = access.ParseList(config.AllowedUsers, access.RoleAdmin)
+	policy.Chats, _ = access.ParseList(config.AllowedChats, access.RoleViewer)
+
+	for _, grant := range config.Roles {
+		role, _ := access.ParseRole(grant.Role)
+
+		policy.Grants = append(policy.Grants, access.Grant{Role: role, Users: grant.Users, Projects: grant.Projects})
+	}
+
+	return policy
+}
+
+// FindNotifier returns notifier by name or nil
+func (config *Config) FindNotifier(name string) *Notifier {
+	if config == nil {
+		return nil
+	}
+
+	for i := range config.Notifiers {
+		if config.Notifiers[i].Name == name {
+			return &config.Notifiers[i]
+		}
+	}
+
+	return nil
+}
+
+func (config *Config) trackProject(project string) *TrackProject {
+	for i := range config.Projects {
+		if config.Projects[i].Project == project {
+			return &config.Projects[i]
+		}
+	}
+
+	return nil
 }
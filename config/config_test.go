@@ -5,6 +5,10 @@ import (
 	"os"
 	"testing"
 	"testing/fstest"
+	"time"
+
+	"github.com/ad/gitlab-pipelines-notifier/access"
+	"github.com/ad/gitlab-pipelines-notifier/filter"
 
 	"github.com/google/go-cmp/cmp"
 )
@@ -23,6 +27,108 @@ func TestInitConfig(t *testing.T) {
 	"TRACK_ONLY_SELF": true
 }`),
 		},
+		"data/legacy": {
+			Data: []byte(`{
+	"TELEGRAM_TOKEN": "test",
+	"ALLOWED_IDS": "12345",
+	"NOTIFY_TELEGRAM_ID": "12345",
+	"GITLAB_TOKEN": "bla_blabla",
+	"GITLAB_URL": "https://git.mydomain.com/api/v4",
+	"GITLAB_TRACK_PROJECTS": "group/project",
+	"GITLAB_TRACK_REFS": "main"
+}`),
+		},
+		"data/notifiers": {
+			Data: []byte(`{
+	"version": 2,
+	"TELEGRAM_TOKEN": "test",
+	"ALLOWED_IDS": "12345",
+	"GITLAB_TOKEN": "bla_blabla",
+	"GITLAB_URL": "https://git.mydomain.com/api/v4",
+	"notifiers": [
+		{"name": "team", "type": "mattermost", "url": "https://mattermost.mydomain.com/hooks/xxx"},
+		{"name": "ops", "type": "telegram", "chat": -100123}
+	],
+	"projects": [
+		{"project": "group/project", "notifiers": ["team", "ops"]}
+	]
+}`),
+		},
+		"data/wrong-notifiers": {
+			Data: []byte(`{
+	"version": 2,
+	"TELEGRAM_TOKEN": "test",
+	"ALLOWED_IDS": "12345",
+	"GITLAB_TOKEN": "bla_blabla",
+	"GITLAB_URL": "https://git.mydomain.com/api/v4",
+	"notifiers": [
+		{"name": "team", "type": "mattermost", "url": "mattermost"},
+		{"name": "team", "type": "telegram"},
+		{"name": "icq", "type": "icq"}
+	],
+	"projects": [
+		{"project": "group/project", "notifiers": ["ops"]}
+	]
+}`),
+		},
+		"data/roles": {
+			Data: []byte(`{
+	"version": 2,
+	"TELEGRAM_TOKEN": "test",
+	"GITLAB_TOKEN": "bla_blabla",
+	"GITLAB_URL": "https://git.mydomain.com/api/v4",
+	"roles": [
+		{"role": "operator", "users": [1, 2], "projects": ["group/*"]},
+		{"role": "viewer", "users": [3]}
+	]
+}`),
+		},
+		"data/wrong-roles": {
+			Data: []byte(`{
+	"version": 2,
+	"TELEGRAM_TOKEN": "test",
+	"GITLAB_TOKEN": "bla_blabla",
+	"GITLAB_URL": "https://git.mydomain.com/api/v4",
+	"roles": [
+		{"role": "owner", "users": [1]},
+		{"role": "admin", "projects": ["group/["]}
+	]
+}`),
+		},
+		"data/projects": {
+			Data: []byte(`{
+	"version": 2,
+	"TELEGRAM_TOKEN": "test",
+	"ALLOWED_IDS": "12345",
+	"GITLAB_TOKEN": "bla_blabla",
+	"GITLAB_URL": "https://git.mydomain.com/api/v4",
+	"GITLAB_TRACK_PROJECTS": "group/legacy",
+	"projects": [
+		{
+			"project": "group/project",
+			"chats": [1, -100123],
+			"refs": ["main", "release/*"],
+			"sources": ["push"],
+			"statuses": ["failed", "success"],
+			"template": "{{.Emoji}} {{.Project}} {{.Ref}}",
+			"interval": "1m"
+		}
+	]
+}`),
+		},
+		"data/wrong-project": {
+			Data: []byte(`{
+	"version": 2,
+	"TELEGRAM_TOKEN": "test",
+	"ALLOWED_IDS": "12345",
+	"GITLAB_TOKEN": "bla_blabla",
+	"GITLAB_URL": "https://git.mydomain.com/api/v4",
+	"projects": [{"project": "group/project", "statuses": ["test"], "template": "{{.Ref", "interval": "1ms"}]
+}`),
+		},
+		"data/future": {
+			Data: []byte(`{"version": 3}`),
+		},
 		"data/bad": {
 			Data: []byte(`test`),
 		},
@@ -30,6 +136,7 @@ func TestInitConfig(t *testing.T) {
 
 	tests := map[string]struct {
 		args        []string
+		env         map[string]string
 		isError     bool
 		want        *Config
 		configError string
@@ -40,6 +147,7 @@ func TestInitConfig(t *testing.T) {
 			args:    []string{""},
 			isError: false,
 			want: &Config{
+				Version:             Version,
 				TelegramToken:       "test",
 				GitlabToken:         "bla_blabla",
 				GitlabURL:           "https://git.mydomain.com/api/v4",
@@ -48,10 +156,132 @@ func TestInitConfig(t *testing.T) {
 				NotifyTelegramID:    "12345",
 				AllowedIDs:          "12345",
 				AllowedIDsList:      []string{"12345"},
+				FailedJobLogLines:   DefaultFailedJobLogLines,
+				FilePath:            "data/good",
 			},
 			fsconfig: m,
 			filename: "data/good",
 		},
+		"migrate legacy config": {
+			args:    []string{""},
+			isError: false,
+			want: &Config{
+				Version:                 Version,
+				TelegramToken:           "test",
+				GitlabToken:             "bla_blabla",
+				GitlabURL:               "https://git.mydomain.com/api/v4",
+				GitlabTrackProjects:     "group/project",
+				GitlabTrackRefs:         "main",
+				NotifyTelegramID:        "12345",
+				AllowedIDs:              "12345",
+				AllowedIDsList:          []string{"12345"},
+				GitlabTrackProjectsList: []string{"group/project"},
+				GitlabTrackFilter:       filter.Filter{Refs: []string{"main"}},
+				Projects:                []TrackProject{{Project: "group/project", Refs: []string{"main"}}},
+				FailedJobLogLines:       DefaultFailedJobLogLines,
+				FilePath:                "data/legacy",
+			},
+			fsconfig: m,
+			filename: "data/legacy",
+		},
+		"read projects config": {
+			args:    []string{""},
+			isError: false,
+			want: &Config{
+				Version:                 Version,
+				TelegramToken:           "test",
+				GitlabToken:             "bla_blabla",
+				GitlabURL:               "https://git.mydomain.com/api/v4",
+				GitlabTrackProjects:     "group/legacy",
+				AllowedIDs:              "12345",
+				AllowedIDsList:          []string{"12345"},
+				GitlabTrackProjectsList: []string{"group/project", "group/legacy"},
+				Projects: []TrackProject{
+					{
+						Project:  "group/project",
+						Chats:    []int64{1, -100123},
+						Refs:     []string{"main", "release/*"},
+						Sources:  []string{"push"},
+						Statuses: []string{"failed", "success"},
+						Template: "{{.Emoji}} {{.Project}} {{.Ref}}",
+						Interval: "1m",
+					},
+					{Project: "group/legacy"},
+				},
+				FailedJobLogLines: DefaultFailedJobLogLines,
+				FilePath:          "data/projects",
+			},
+			fsconfig: m,
+			filename: "data/projects",
+		},
+		"read notifiers config": {
+			args:    []string{""},
+			isError: false,
+			want: &Config{
+				Version:                 Version,
+				TelegramToken:           "test",
+				GitlabToken:             "bla_blabla",
+				GitlabURL:               "https://git.mydomain.com/api/v4",
+				AllowedIDs:              "12345",
+				AllowedIDsList:          []string{"12345"},
+				GitlabTrackProjectsList: []string{"group/project"},
+				Projects:                []TrackProject{{Project: "group/project", Notifiers: []string{"team", "ops"}}},
+				Notifiers: []Notifier{
+					{Name: "team", Type: "mattermost", URL: "https://mattermost.mydomain.com/hooks/xxx"},
+					{Name: "ops", Type: "telegram", Chat: -100123},
+				},
+				FailedJobLogLines: DefaultFailedJobLogLines,
+				FilePath:          "data/notifiers",
+			},
+			fsconfig: m,
+			filename: "data/notifiers",
+		},
+		"wrong notifiers": {
+			args:        []string{""},
+			isError:     true,
+			configError: "notifier team: wrong url mattermost, it should be like https://host/hooks/id\nnotifier team: chat not set\nnotifier team is defined twice\nnotifier icq: unknown type icq, it should be one of telegram, slack, mattermost, teams, discord, webhook\nproject group/project: unknown notifier ops",
+			fsconfig:    m,
+			filename:    "data/wrong-notifiers",
+		},
+		"read roles": {
+			args:    []string{""},
+			isError: false,
+			want: &Config{
+				Version:       Version,
+				TelegramToken: "test",
+				GitlabToken:   "bla_blabla",
+				GitlabURL:     "https://git.mydomain.com/api/v4",
+				Roles: []RoleGrant{
+					{Role: "operator", Users: []int64{1, 2}, Projects: []string{"group/*"}},
+					{Role: "viewer", Users: []int64{3}},
+				},
+				FailedJobLogLines: DefaultFailedJobLogLines,
+				FilePath:          "data/roles",
+			},
+			fsconfig: m,
+			filename: "data/roles",
+		},
+		"wrong roles": {
+			args:        []string{""},
+			isError:     true,
+			configError: "role owner: unknown role owner, it should be viewer, operator or admin\nrole admin: users not set, wrong project pattern group/[, it should be like group/project or group/*",
+			fsconfig:    m,
+			filename:    "data/wrong-roles",
+		},
+		"wrong project": {
+			args:        []string{""},
+			isError:     true,
+			configError: "project group/project: unknown pipeline status test, wrong template: template: group/project:1: unclosed action, wrong interval 1ms, it should be like 30s or 5m",
+			fsconfig:    m,
+			filename:    "data/wrong-project",
+		},
+		"unsupported version": {
+			args:        []string{""},
+			isError:     true,
+			configError: "config version 3 is not supported, update the bot",
+			fsconfig:    m,
+			filename:    "data/future",
+		},
 		"read bad config": {
 			args:        []string{""},
 			isError:     true,
@@ -60,49 +290,131 @@ func TestInitConfig(t *testing.T) {
 			filename:    "data/bad",
 		},
 		"config file not found": {
+			args:        []string{"", "-config", "/data/nofile"},
+			isError:     true,
+			configError: "can't read file, open data/nofile: file does not exist",
+			fsconfig:    m,
+		},
+		"default config file not found": {
+			args:     []string{"", "--TELEGRAM_TOKEN=1:2", "--GITLAB_TOKEN=1", "--GITLAB_URL=1", "--ALLOWED_IDS=123"},
+			isError:  false,
+			fsconfig: m,
+			filename: "data/nofile",
+			want: &Config{
+				Version:             Version,
+				TelegramToken:       "1:2",
+				GitlabToken:         "1",
+				GitlabURL:           "1",
+				GitlabTrackOnlySelf: true,
+				AllowedIDs:          "123",
+				AllowedIDsList:      []string{"123"},
+				FailedJobLogLines:   DefaultFailedJobLogLines,
+			},
+		},
+		"file < env < flags": {
+			args:     []string{"", "--config=/data/legacy", "--GITLAB_TOKEN=flag"},
+			env:      map[string]string{"GITLAB_TOKEN": "env", "GITLAB_USERNAME": "env", "GITLAB_TRACK_ONLY_SELF": "false"},
+			fsconfig: m,
+			want: &Config{
+				Version:                 Version,
+				TelegramToken:           "test",
+				GitlabToken:             "flag",
+				GitlabURL:               "https://git.mydomain.com/api/v4",
+				GitlabUsername:          "env",
+				GitlabTrackProjects:     "group/project",
+				GitlabTrackRefs:         "main",
+				NotifyTelegramID:        "12345",
+				AllowedIDs:              "12345",
+				AllowedIDsList:          []string{"12345"},
+				GitlabTrackProjectsList: []string{"group/project"},
+				GitlabTrackFilter:       filter.Filter{Refs: []string{"main"}},
+				Projects:                []TrackProject{{Project: "group/project", Refs: []string{"main"}}},
+				FailedJobLogLines:       DefaultFailedJobLogLines,
+				FilePath:                "data/legacy",
+			},
+		},
+		"CONFIG_PATH env var": {
 			args:        []string{""},
+			env:         map[string]string{"CONFIG_PATH": "/data/nofile"},
 			isError:     true,
 			configError: "can't read file, open data/nofile: file does not exist",
 			fsconfig:    m,
-			filename:    "data/nofile",
+			filename:    "data/good",
+		},
+		"allowed users and chats": {
+			args:        []string{"", "--TELEGRAM_TOKEN=1:2", "--GITLAB_TOKEN=1", "--GITLAB_URL=1", "--ALLOWED_USERS=123,456:owner", "--ALLOWED_CHATS=chat"},
+			isError:     true,
+			configError: "wrong ALLOWED_USERS: wrong item 456:owner, role should be viewer, operator or admin\nwrong ALLOWED_CHATS: wrong item chat, it should be like 12345 or 12345:viewer",
+		},
+		"all problems at once": {
+			args:        []string{"", "--TELEGRAM_TOKEN=1:2", "--ALLOWED_IDS=123,test", "--NOTIFY_TELEGRAM_ID=test", "--WATCH_TIMEOUT=1s", "--GITLAB_TRACK_SOURCES=test"},
+			isError:     true,
+			configError: "GITLAB_TOKEN env var not set\nGITLAB_URL env var not set\nwrong ALLOWED_IDS item test, it should be a number\nwrong NOTIFY_TELEGRAM_ID test, it should be a number\nwrong WATCH_TIMEOUT: wrong watch timeout 1s, it should be like 90m or 4h\nwrong GITLAB_TRACK_REFS or GITLAB_TRACK_SOURCES: unknown pipeline source test",
 		},
 		"empty args values": {
 			args:        []string{""},
 			isError:     true,
-			configError: "TELEGRAM_TOKEN env var not set",
+			configError: "TELEGRAM_TOKEN env var not set\nGITLAB_TOKEN env var not set\nGITLAB_URL env var not set\nALLOWED_IDS, ALLOWED_USERS or ALLOWED_CHATS env var not set",
 		},
 		"no TELEGRAM_TOKEN": {
 			args:        []string{"", "--TELEGRAM_TOKEN=", "--GITLAB_TOKEN=", "--GITLAB_URL=", "--ALLOWED_IDS="},
 			isError:     true,
-			configError: "TELEGRAM_TOKEN env var not set",
+			configError: "TELEGRAM_TOKEN env var not set\nGITLAB_TOKEN env var not set\nGITLAB_URL env var not set\nALLOWED_IDS, ALLOWED_USERS or ALLOWED_CHATS env var not set",
 		},
 		"no GITLAB_TOKEN": {
 			args:        []string{"", "--TELEGRAM_TOKEN=1:2", "--GITLAB_TOKEN=", "--GITLAB_URL=", "--ALLOWED_IDS="},
 			isError:     true,
-			configError: "GITLAB_TOKEN env var not set",
+			configError: "GITLAB_TOKEN env var not set\nGITLAB_URL env var not set\nALLOWED_IDS, ALLOWED_USERS or ALLOWED_CHATS env var not set",
 		},
 		"no GITLAB_URL": {
 			args:        []string{"", "--TELEGRAM_TOKEN=1:2", "--GITLAB_TOKEN=123456789012345678901234567890123456", "--GITLAB_URL=", "--ALLOWED_IDS="},
 			isError:     true,
-			configError: "GITLAB_URL env var not set",
+			configError: "GITLAB_URL env var not set\nALLOWED_IDS, ALLOWED_USERS or ALLOWED_CHATS env var not set",
 		},
 		"no ALLOWED_IDS": {
 			args:        []string{"", "--TELEGRAM_TOKEN=1:2", "--GITLAB_TOKEN=123456789012345678901234567890123456", "--GITLAB_URL=123456789012345678901234567890123456", "--ALLOWED_IDS="},
 			isError:     true,
-			configError: "ALLOWED_IDS env var not set",
+			configError: "ALLOWED_IDS, ALLOWED_USERS or ALLOWED_CHATS env var not set",
 		},
 		"set ALLOWED_IDS": {
 			args:    []string{"", "--TELEGRAM_TOKEN=1:2", "--GITLAB_TOKEN=123456789012345678901234567890123456", "--GITLAB_URL=123456789012345678901234567890123456", "--ALLOWED_IDS=123,123"},
 			isError: false,
 			want: &Config{
+				Version:             Version,
 				TelegramToken:       "1:2",
 				GitlabToken:         "123456789012345678901234567890123456",
 				GitlabURL:           "123456789012345678901234567890123456",
 				GitlabTrackOnlySelf: true,
 				AllowedIDs:          "123,123",
 				AllowedIDsList:      []string{"123", "123"},
+				FailedJobLogLines:   DefaultFailedJobLogLines,
 			},
 		},
+		"set GITLAB_TRACK_REFS and GITLAB_TRACK_SOURCES": {
+			args:    []string{"", "--TELEGRAM_TOKEN=1:2", "--GITLAB_TOKEN=1", "--GITLAB_URL=1", "--ALLOWED_IDS=123", "--GITLAB_TRACK_REFS=main, release/*,!renovate/*", "--GITLAB_TRACK_SOURCES=push,schedule"},
+			isError: false,
+			want: &Config{
+				Version:             Version,
+				TelegramToken:       "1:2",
+				GitlabToken:         "1",
+				GitlabURL:           "1",
+				GitlabTrackOnlySelf: true,
+				GitlabTrackRefs:     "main, release/*,!renovate/*",
+				GitlabTrackSources:  "push,schedule",
+				AllowedIDs:          "123",
+				AllowedIDsList:      []string{"123"},
+				FailedJobLogLines:   DefaultFailedJobLogLines,
+				GitlabTrackFilter: filter.Filter{
+					Refs:    []string{"main", "release/*", "!renovate/*"},
+					Sources: []string{"push", "schedule"},
+				},
+			},
+		},
+		"wrong GITLAB_TRACK_SOURCES": {
+			args:        []string{"", "--TELEGRAM_TOKEN=1:2", "--GITLAB_TOKEN=1", "--GITLAB_URL=1", "--ALLOWED_IDS=123", "--GITLAB_TRACK_SOURCES=test"},
+			isError:     true,
+			configError: "wrong GITLAB_TRACK_REFS or GITLAB_TRACK_SOURCES: unknown pipeline source test",
+		},
 		"bad args": {
 			args:        []string{"", "--test=true"},
 			isError:     true,
@@ -112,6 +424,10 @@ func TestInitConfig(t *testing.T) {
 
 	for name, tc := range tests {
 		t.Run(name, func(t *testing.T) {
+			for key, value := range tc.env {
+				t.Setenv(key, value)
+			}
+
 			out, got := InitConfig(tc.args, tc.fsconfig, tc.filename)
 
 			diff := ""
@@ -170,3 +486,127 @@ func Test_lookupEnvOrString(t *testing.T) {
 		})
 	}
 }
+
+func TestShared_Update(t *testing.T) {
+	current := NewShared(&Config{
+		TelegramToken:  "1:2",
+		GitlabToken:    "token",
+		GitlabURL:      "https://git.mydomain.com/api/v4",
+		WebhookSecret:  "secret",
+		IdentitySecret: "key",
+		AllowedIDs:     "1",
+	})
+
+	previous := current.Load()
+
+	restartRequired := current.Update(&Config{
+		TelegramToken:  "3:4",
+		GitlabToken:    "token",
+		GitlabURL:      "https://git.mydomain.com/api/v4",
+		WebhookSecret:  "new secret",
+		IdentitySecret: "new key",
+		AllowedIDs:     "1,2",
+	})
+
+	if diff := cmp.Diff([]string{"TELEGRAM_TOKEN", "IDENTITY_SECRET"}, restartRequired); diff != "" {
+		t.Error(diff)
+	}
+
+	want := &Config{
+		TelegramToken:  "1:2",
+		GitlabToken:    "token",
+		GitlabURL:      "https://git.mydomain.com/api/v4",
+		WebhookSecret:  "new secret",
+		IdentitySecret: "key",
+		AllowedIDs:     "1,2",
+	}
+
+	if diff := cmp.Diff(want, current.Load()); diff != "" {
+		t.Error(diff)
+	}
+
+	if previous.AllowedIDs != "1" {
+		t.Errorf("Update() changed previous config, AllowedIDs = %s", previous.AllowedIDs)
+	}
+
+	restartRequired = current.Update(&Config{TelegramToken: "1:2", GitlabToken: "token", GitlabURL: "https://git.mydomain.com/api/v4"})
+
+	if diff := cmp.Diff([]string{"IDENTITY_SECRET", "WEBHOOK_SECRET"}, restartRequired); diff != "" {
+		t.Error(diff)
+	}
+
+	if current.Load().WebhookSecret != "new secret" {
+		t.Errorf("Update() WebhookSecret = %s, want kept", current.Load().WebhookSecret)
+	}
+
+	var none *Shared
+	if none.Load() != nil {
+		t.Error("Load() of nil shared config should be nil")
+	}
+}
+
+func TestConfig_AccessPolicy(t *testing.T) {
+	config := &Config{
+		AllowedIDsList: []string{"1", "-300"},
+		AllowedUsers:   "2,3:viewer",
+		AllowedChats:   "-100,-200:admin",
+		Roles:          []RoleGrant{{Role: "operator", Users: []int64{4}, Projects: []string{"group/*"}}},
+	}
+
+	want := access.Policy{
+		IDs:   map[int64]access.Role{1: access.RoleAdmin, -300: access.RoleViewer},
+		Users: map[int64]access.Role{2: access.RoleAdmin, 3: access.RoleViewer},
+		Chats: map[int64]access.Role{-100: access.RoleViewer, -200: access.RoleAdmin},
+		Grants: []access.Grant{
+			{Role: access.RoleOperator, Users: []int64{4}, Projects: []string{"group/*"}},
+		},
+	}
+
+	if diff := cmp.Diff(want, config.AccessPolicy()); diff != "" {
+		t.Errorf("AccessPolicy() mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestConfig_PipelineWatchTimeout(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  *Config
+		project string
+		want    time.Duration
+	}{
+		{
+			name: "nil config",
+			want: DefaultWatchTimeout,
+		},
+		{
+			name:   "default",
+			config: &Config{},
+			want:   DefaultWatchTimeout,
+		},
+		{
+			name:    "global",
+			config:  &Config{WatchTimeout: "2h"},
+			project: "group/project",
+			want:    2 * time.Hour,
+		},
+		{
+			name:    "project",
+			config:  &Config{WatchTimeout: "2h", Projects: []TrackProject{{Project: "group/project", WatchTimeout: "4h"}}},
+			project: "group/project",
+			want:    4 * time.Hour,
+		},
+		{
+			name:    "other project",
+			config:  &Config{Projects: []TrackProject{{Project: "group/project", WatchTimeout: "4h"}}},
+			project: "group/other",
+			want:    DefaultWatchTimeout,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.config.PipelineWatchTimeout(tt.project); got != tt.want {
+				t.Errorf("PipelineWatchTimeout() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,17 +1,29 @@
 package cron
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"net/http"
+	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/ad/gitlab-pipelines-notifier/config"
+	"github.com/ad/gitlab-pipelines-notifier/dedup"
+	"github.com/ad/gitlab-pipelines-notifier/filter"
 	"github.com/ad/gitlab-pipelines-notifier/gitlab"
+	"github.com/ad/gitlab-pipelines-notifier/keyboard"
+	"github.com/ad/gitlab-pipelines-notifier/metrics"
+	"github.com/ad/gitlab-pipelines-notifier/notify"
 	"github.com/ad/gitlab-pipelines-notifier/recovery"
+	"github.com/ad/gitlab-pipelines-notifier/store"
 
 	"github.com/go-telegram/bot"
 	"github.com/go-telegram/bot/models"
@@ -19,178 +31,1417 @@ import (
 	gl "github.com/xanzy/go-gitlab"
 )
 
-const shouldBeEscaped = "[]()>#+-=|{}.!"
+const trackPipelinesPrefix = "TrackPipelines/"
 
-func escapeMarkdown(s string) string {
-	var result []rune
-	for _, r := range s {
-		if strings.ContainsRune(shouldBeEscaped, r) {
-			result = append(result, '\\')
+// telegram message limit is 4096 characters, longer logs are sent as file
+const maxLogMessageSize = 3500
+
+// cursorOverlap makes pipelines list overlap previous poll, so pipelines updated in the same second are not missed
+const cursorOverlap = time.Second
+
+// polling backoff, delay doubles after every error in a row, job is paused after maxFailures errors
+const (
+	minBackoff  = 10 * time.Second
+	maxBackoff  = 10 * time.Minute
+	maxFailures = 10
+)
+
+// maxWarnBefore limits how long before watch timeout user is warned
+const maxWarnBefore = 15 * time.Minute
+
+// maxIdle limits time of pipeline watch in manual and scheduled states, it is not counted to watch timeout,
+// so pipeline left waiting for user would be watched forever
+const maxIdle = 24 * time.Hour
+
+// polling intervals of pipelines which wait for runner or user action
+const (
+	waitingInterval = 30 * time.Second
+	idleInterval    = time.Minute
+)
+
+// notification types counted in metrics.Notifications
+const (
+	notificationPipeline     = "pipeline"
+	notificationProject      = "project"
+	notificationLiveStatus   = "live_status"
+	notificationJobLog       = "job_log"
+	notificationMergeRequest = "merge_request"
+	notificationPaused       = "paused"
+	notificationStopped      = "stopped"
+	notificationWatchWarning = "watch_warning"
+	notificationWatchTimeout = "watch_timeout"
+	notificationManual       = "manual"
+)
+
+// watch modes, ModeFinal notifies only about finished pipeline, ModeTransitions about every status change
+const (
+	ModeFinal       = "final"
+	ModeTransitions = "all"
+)
+
+type Cron struct {
+	Bot           *bot.Bot
+	Cron          *robfigcron.Cron
+	Conf          *config.Shared
+	Store         store.Store
+	JobsContainer JobsContainer
+
+	// Dedup keeps last notified status of tracked projects pipelines
+	Dedup *dedup.Cache
+
+	// Poller batches polling of watched pipelines by project
+	Poller *Poller
+
+	locks sync.Map
+}
+
+type Job struct {
+	Cron        *Cron      `json:"-"`
+	Bot         *bot.Bot   `json:"-"`
+	Gitlab      *gl.Client `json:"-"`
+	Key         string     `json:"key"`
+	ToID        int64      `json:"to_id"`
+	Status      string     `json:"status"`
+	Project     string     `json:"project"`
+	Count       int        `json:"count"`
+	PipelineID  int        `json:"pipeline_id"`
+	LastUpdated time.Time  `json:"last_updated"`
+	LastID      int        `json:"last_id"`
+	Mode        string     `json:"mode,omitempty"`
+
+	// ThreadID is forum topic of chat the job was started from, notifications are sent back to it
+	ThreadID int `json:"thread_id,omitempty"`
+
+	// MessageID is live status message, it is edited in place on every pipeline update
+	MessageID         int       `json:"message_id,omitempty"`
+	PipelineUpdatedAt time.Time `json:"pipeline_updated_at,omitempty"`
+
+	MergeRequestIID    int    `json:"merge_request_iid,omitempty"`
+	Approvals          int    `json:"approvals,omitempty"`
+	Notes              int    `json:"notes,omitempty"`
+	HeadPipelineID     int    `json:"head_pipeline_id,omitempty"`
+	HeadPipelineStatus string `json:"head_pipeline_status,omitempty"`
+
+	// Subscription is project tracking created from chat, unlike tracking from config it has own filters
+	Subscription bool   `json:"subscription,omitempty"`
+	Branch       string `json:"branch,omitempty"`
+	OnlyFailures bool   `json:"only_failures,omitempty"`
+
+	// Username limits subscription to pipelines of gitlab user linked with /login
+	Username string `json:"username,omitempty"`
+
+	// Notifiers are names of notifiers from config which get pipeline notifications besides chat,
+	// tracking job from config with zero ToID only routes to them
+	Notifiers []string `json:"notifiers,omitempty"`
+
+	// Refs and Sources select pipelines of tracked project, see filter.Filter
+	Refs    []string `json:"refs,omitempty"`
+	Sources []string `json:"sources,omitempty"`
+
+	// Statuses, Template and Interval are rules of tracked project from config, see config.TrackProject
+	Statuses []string `json:"statuses,omitempty"`
+	Template string   `json:"template,omitempty"`
+	Interval string   `json:"interval,omitempty"`
+
+	// Failures is count of polling errors in a row, job is Paused after too many of them
+	Failures int       `json:"failures,omitempty"`
+	Paused   bool      `json:"paused,omitempty"`
+	NextRun  time.Time `json:"-"`
+
+	// Timeout of pipeline watch set by user, timeout from config is used if it is zero.
+	// Elapsed is watched time, time in manual and scheduled states is not counted, it is Idle and limited by maxIdle
+	Timeout  time.Duration `json:"timeout,omitempty"`
+	Elapsed  time.Duration `json:"elapsed,omitempty"`
+	Idle     time.Duration `json:"idle,omitempty"`
+	Warned   bool          `json:"warned,omitempty"`
+	LastTick time.Time     `json:"-"`
+}
+
+// IsPipelineWatch reports whether job watches single pipeline
+func (job *Job) IsPipelineWatch() bool {
+	return job.PipelineID > 0
+}
+
+// IsMergeRequestWatch reports whether job watches merge request
+func (job *Job) IsMergeRequestWatch() bool {
+	return job.MergeRequestIID > 0
+}
+
+// IsProjectTrack reports whether job tracks all pipelines of project
+func (job *Job) IsProjectTrack() bool {
+	return !job.IsPipelineWatch() && !job.IsMergeRequestWatch()
+}
+
+// JobsContainer ...
+type JobsContainer struct {
+	mu   sync.RWMutex
+	jobs map[string]robfigcron.EntryID
+}
+
+func InitCron(b *bot.Bot, conf *config.Shared) *Cron {
+	c := &Cron{
+		Bot:   b,
+		Conf:  conf,
+		Dedup: dedup.New(dedup.DefaultSize),
+	}
+
+	c.Cron = robfigcron.New(
+		robfigcron.WithChain(
+			robfigcron.SkipIfStillRunning(robfigcron.DefaultLogger),
+			robfigcron.Recover(robfigcron.DefaultLogger),
+		),
+	)
+	c.JobsContainer.jobs = make(map[string]robfigcron.EntryID)
+
+	c.Poller = NewPoller(DefaultPollerConcurrency)
+
+	if _, err := c.Cron.AddFunc("@every "+config.DefaultInterval, c.Poller.Flush); err != nil {
+		log.Printf("error adding poller: %s", err)
+	}
+
+	c.Cron.Start()
+
+	return c
+}
+
+func (c *Cron) SetStore(s store.Store) {
+	c.Store = s
+}
+
+// RestoreJobs loads saved jobs from store and registers them again,
+// tracking jobs for projects removed from config are dropped
+func (c *Cron) RestoreJobs(gitlabClient *gl.Client) {
+	if c.Store == nil {
+		return
+	}
+
+	records, errLoad := c.Store.Load()
+	if errLoad != nil {
+		log.Printf("error loading jobs: %s", errLoad)
+
+		return
+	}
+
+	for key, record := range records {
+		job := Job{}
+		if err := json.Unmarshal(record, &job); err != nil {
+			log.Printf("error restoring job %s: %s", key, err)
+
+			_ = c.Store.Delete(key)
+
+			continue
+		}
+
+		if job.IsProjectTrack() && !job.Subscription && !c.isTrackKey(job.Key) {
+			_ = c.Store.Delete(key)
+
+			continue
+		}
+
+		job.Cron = c
+		job.Bot = c.Bot
+		job.Gitlab = gitlabClient
+
+		AddJob(job)
+
+		log.Printf("job %s restored", job.Key)
+	}
+}
+
+// isTrackKey reports whether key belongs to tracking job of project and chat from config
+func (c *Cron) isTrackKey(key string) bool {
+	conf := c.Conf.Load()
+	if conf == nil {
+		return false
+	}
+
+	for _, project := range conf.Projects {
+		for _, toID := range projectChats(conf, project) {
+			if trackKey(toID, project.Project) == key {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// projectChats returns chats notified about tracked project, NOTIFY_TELEGRAM_ID by default,
+// zero chat is added for notifiers of project
+func projectChats(conf *config.Config, project config.TrackProject) []int64 {
+	if len(project.Notifiers) > 0 {
+		return append(append([]int64{}, project.Chats...), 0)
+	}
+
+	if len(project.Chats) > 0 {
+		return project.Chats
+	}
+
+	toID, errToID := strconv.ParseInt(conf.NotifyTelegramID, 10, 64)
+	if errToID != nil {
+		return nil
+	}
+
+	return []int64{toID}
+}
+
+func trackKey(toID int64, project string) string {
+	return trackPipelinesPrefix + strconv.FormatInt(toID, 10) + "/" + project
+}
+
+// GetJob returns registered job by key or nil
+func (c *Cron) GetJob(key string) *Job {
+	c.JobsContainer.mu.RLock()
+	entryID, ok := c.JobsContainer.jobs[key]
+	c.JobsContainer.mu.RUnlock()
+
+	if !ok {
+		return nil
+	}
+
+	if job, ok := c.Cron.Entry(entryID).Job.(*Job); ok {
+		return job
+	}
+
+	return nil
+}
+
+// Jobs returns all registered jobs
+func (c *Cron) Jobs() []*Job {
+	c.JobsContainer.mu.RLock()
+	entryIDs := make([]robfigcron.EntryID, 0, len(c.JobsContainer.jobs))
+	for _, entryID := range c.JobsContainer.jobs {
+		entryIDs = append(entryIDs, entryID)
+	}
+	c.JobsContainer.mu.RUnlock()
+
+	jobs := make([]*Job, 0, len(entryIDs))
+	for _, entryID := range entryIDs {
+		if job, ok := c.Cron.Entry(entryID).Job.(*Job); ok {
+			jobs = append(jobs, job)
+		}
+	}
+
+	return jobs
+}
+
+// JobCounts returns count of jobs by kind, paused jobs are counted separately
+func (c *Cron) JobCounts() map[string]float64 {
+	counts := map[string]float64{
+		"pipeline":      0,
+		"merge_request": 0,
+		"subscription":  0,
+		"project":       0,
+		"paused":        0,
+	}
+
+	for _, job := range c.Jobs() {
+		switch {
+		case job.Paused:
+			counts["paused"]++
+		case job.IsPipelineWatch():
+			counts["pipeline"]++
+		case job.IsMergeRequestWatch():
+			counts["merge_request"]++
+		case job.Subscription:
+			counts["subscription"]++
+		default:
+			counts["project"]++
+		}
+	}
+
+	return counts
+}
+
+// RemovePipelineJobs removes watches of pipeline for chat, returns count of removed jobs
+func (c *Cron) RemovePipelineJobs(toID int64, pipelineID int) int {
+	removed := 0
+
+	for _, job := range c.Jobs() {
+		if job.PipelineID == pipelineID && job.ToID == toID {
+			RemoveJob(job)
+
+			removed++
+		}
+	}
+
+	return removed
+}
+
+// Subscriptions returns project subscriptions of chat
+func (c *Cron) Subscriptions(toID int64) []*Job {
+	var subscriptions []*Job
+
+	for _, job := range c.Jobs() {
+		if job.Subscription && job.ToID == toID {
+			subscriptions = append(subscriptions, job)
+		}
+	}
+
+	sort.Slice(subscriptions, func(i, j int) bool {
+		return subscriptions[i].Key < subscriptions[j].Key
+	})
+
+	return subscriptions
+}
+
+func (c *Cron) lockJob(key string) func() {
+	mu, _ := c.locks.LoadOrStore(key, &sync.Mutex{})
+	mu.(*sync.Mutex).Lock()
+
+	return mu.(*sync.Mutex).Unlock
+}
+
+// HandlePipelineEvent processes pipeline update received from webhook,
+// watched pipeline jobs and tracked project jobs are notified immediately
+func (c *Cron) HandlePipelineEvent(project string, projectID, pipelineID int) {
+	for _, job := range c.Jobs() {
+		if job.IsPipelineWatch() {
+			if job.PipelineID != pipelineID {
+				continue
+			}
+
+			if err := ProcessPipelineUpdate(job); err != nil {
+				log.Println(err)
+			}
+
+			continue
+		}
+
+		if job.IsProjectTrack() && project != "" && (job.Project == project || job.Project == strconv.Itoa(projectID)) {
+			if err := ProcessProjectPipeline(job, pipelineID); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+}
+
+// HandleJobEvent processes job or merge request update received from webhook,
+// only watched pipeline jobs are notified
+func (c *Cron) HandleJobEvent(pipelineID int) {
+	for _, job := range c.Jobs() {
+		if !job.IsPipelineWatch() || job.PipelineID != pipelineID {
+			continue
+		}
+
+		if err := ProcessPipelineUpdate(job); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// HandleMergeRequestEvent processes merge request update received from webhook
+func (c *Cron) HandleMergeRequestEvent(project string, projectID, mergeRequestIID int) {
+	for _, job := range c.Jobs() {
+		if !job.IsMergeRequestWatch() || job.MergeRequestIID != mergeRequestIID {
+			continue
+		}
+
+		if job.Project != project && job.Project != strconv.Itoa(projectID) {
+			continue
+		}
+
+		if err := ProcessMergeRequestUpdate(job); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// Exec ...
+func (job *Job) Exec() {
+	// job without cron is not scheduled
+	if job.Cron == nil {
+		return
+	}
+
+	// webhook and poller change the same job, time accounting and save are done under its lock
+	unlock := job.Cron.lockJob(job.Key)
+
+	// backoff after errors, slow polling of waiting pipelines and rate limit skip ticks
+	if job.Cron.GetJob(job.Key) != job || job.Paused || time.Now().Before(job.NextRun) || gitlab.Limits.Wait() > 0 {
+		unlock()
+
+		return
+	}
+
+	job.Count = job.Count + 1
+
+	warned := job.Warned
+
+	if job.IsPipelineWatch() && job.tick(time.Now()) {
+		log.Printf("job %s is deleted", job.Key)
+
+		text := fmt.Sprintf("**pipeline %d monitored too long**\nwatch stopped after %s, you can retry it", job.PipelineID, job.timeout())
+		if job.Idle >= maxIdle {
+			text = fmt.Sprintf("**pipeline %d waits in %s status too long**\nwatch stopped after %s, you can retry it", job.PipelineID, job.Status, maxIdle)
+		}
+
+		RemoveJob(job)
+
+		unlock()
+
+		err := job.SendMessage(context.Background(), job.ToID, text)
+
+		countNotification(notificationWatchTimeout, err)
+
+		return
+	}
+
+	// store is rewritten only on changes, watched time is saved along with them
+	if job.Warned != warned {
+		job.save()
+	}
+
+	// polling takes the lock again
+	unlock()
+
+	// watched pipelines of the same project are polled together
+	if job.IsPipelineWatch() && job.Cron.Poller != nil {
+		job.Cron.Poller.Request(job)
+
+		return
+	}
+
+	// check pipeline in gitlab and send message to telegram user if status changes
+	go func(j *Job) {
+		defer recovery.Recovery()
+
+		j.afterPoll(j.poll(), time.Now())
+	}(job)
+
+}
+
+// tick counts watched time of pipeline, reports whether watch timeout or maxIdle is reached,
+// user is warned once before timeout with button to extend the watch
+func (j *Job) tick(now time.Time) bool {
+	if !j.LastTick.IsZero() {
+		if isIdleStatus(j.Status) {
+			j.Idle += now.Sub(j.LastTick)
+		} else {
+			j.Elapsed += now.Sub(j.LastTick)
+		}
+	}
+
+	j.LastTick = now
+
+	timeout := j.timeout()
+
+	if j.Elapsed >= timeout || j.Idle >= maxIdle {
+		return true
+	}
+
+	if left := timeout - j.Elapsed; !j.Warned && left <= warnBefore(timeout) {
+		j.Warned = true
+
+		_, err := j.SendMessageWithKeyboard(
+			context.Background(),
+			j.ToID,
+			fmt.Sprintf("**pipeline %d is still not finished**\nwatch stops in %s", j.PipelineID, left.Round(time.Minute)),
+			keyboard.Extend(j.PipelineID),
+		)
+
+		countNotification(notificationWatchWarning, err)
+	}
+
+	return false
+}
+
+// timeout returns timeout of pipeline watch set by user or from config
+func (j *Job) timeout() time.Duration {
+	if j.Timeout > 0 {
+		return j.Timeout
+	}
+
+	if j.Cron == nil {
+		return config.DefaultWatchTimeout
+	}
+
+	return j.Cron.Conf.Load().PipelineWatchTimeout(j.Project)
+}
+
+// warnBefore returns how long before timeout user is warned
+func warnBefore(timeout time.Duration) time.Duration {
+	if before := timeout / 4; before < maxWarnBefore {
+		return before
+	}
+
+	return maxWarnBefore
+}
+
+// isIdleStatus reports whether pipeline waits for user or schedule, such time is not counted to watch timeout
+func isIdleStatus(status string) bool {
+	return status == "manual" || status == "scheduled"
+}
+
+// ExtendPipelineJobs restarts timeout of pipeline watches of chat, returns count of extended jobs
+func (c *Cron) ExtendPipelineJobs(toID int64, pipelineID int) int {
+	extended := 0
+
+	for _, job := range c.Jobs() {
+		if job.PipelineID != pipelineID || job.ToID != toID {
+			continue
+		}
+
+		unlock := c.lockJob(job.Key)
+
+		// job could be removed while waiting for lock
+		if c.GetJob(job.Key) == job {
+			job.Elapsed = 0
+			job.Idle = 0
+			job.Warned = false
+
+			job.save()
+
+			extended++
+		}
+
+		unlock()
+	}
+
+	return extended
+}
+
+func (j *Job) poll() error {
+	switch {
+	case j.IsPipelineWatch():
+		return ProcessPipelineUpdate(j)
+	case j.IsMergeRequestWatch():
+		return ProcessMergeRequestUpdate(j)
+	default:
+		return j.pollProjectPipelines()
+	}
+}
+
+// afterPoll schedules next poll, errors in a row increase delay exponentially,
+// after maxFailures errors job is paused until user resumes it, gitlab refusing request
+// is not retried, watch of deleted pipeline or merge request is stopped, other jobs are paused at once
+func (j *Job) afterPoll(err error, now time.Time) {
+	if j.Cron == nil {
+		return
+	}
+
+	unlock := j.Cron.lockJob(j.Key)
+	defer unlock()
+
+	// job could be removed while polling, it must not be saved again
+	if j.Cron.GetJob(j.Key) != j {
+		return
+	}
+
+	if err == nil {
+		if j.Failures > 0 {
+			j.Failures = 0
+
+			j.save()
+		}
+
+		j.NextRun = now.Add(j.stateDelay())
+
+		return
+	}
+
+	j.Failures++
+
+	log.Printf("error polling job %s, %d in a row: %s", j.Key, j.Failures, err)
+
+	status, refused := refusedStatus(err)
+
+	if status == http.StatusNotFound && !j.IsProjectTrack() {
+		RemoveJob(j)
+
+		log.Printf("job %s stopped", j.Key)
+
+		j.notifyFailure(notificationStopped, fmt.Sprintf("**%s is stopped**\nit is not found in gitlab: %s", j.title(), err), "")
+
+		return
+	}
+
+	if refused {
+		j.pause(fmt.Sprintf("gitlab refused request: %s", err))
+
+		return
+	}
+
+	if j.Failures >= maxFailures {
+		j.pause(fmt.Sprintf("%d errors in a row, last one: %s", j.Failures, err))
+
+		return
+	}
+
+	j.NextRun = now.Add(backoff(j.Failures))
+
+	j.save()
+}
+
+// pause stops polling of job until user resumes it
+func (j *Job) pause(reason string) {
+	j.Paused = true
+
+	j.save()
+
+	log.Printf("job %s paused", j.Key)
+
+	j.notifyFailure(notificationPaused, fmt.Sprintf("**%s is paused**\n%s", j.title(), reason), "\nsend /resume to continue")
+}
+
+// notifyFailure sends text to chat of job with hint how to fix it, notifiers get text only
+func (j *Job) notifyFailure(notification, text, hint string) {
+	errSend := j.SendMessage(context.Background(), j.ToID, text+hint)
+
+	countNotification(notification, errSend)
+
+	j.notifyExternal(context.Background(), notify.Message{Type: notification, Project: j.Project, Text: text})
+}
+
+// refusedStatus returns status of gitlab error response, it is refused if retrying won't help,
+// like missing access or object, rate limit and timeout responses are retried
+func refusedStatus(err error) (int, bool) {
+	// go-gitlab returns sentinel error instead of response on 404
+	if errors.Is(err, gl.ErrNotFound) {
+		return http.StatusNotFound, true
+	}
+
+	var errResponse *gl.ErrorResponse
+	if !errors.As(err, &errResponse) || errResponse.Response == nil {
+		return 0, false
+	}
+
+	status := errResponse.Response.StatusCode
+
+	return status, status >= 400 && status < 500 && status != http.StatusTooManyRequests && status != http.StatusRequestTimeout
+}
+
+// backoff returns delay after failures in a row, it doubles on every failure up to maxBackoff
+func backoff(failures int) time.Duration {
+	delay := minBackoff
+
+	for i := 1; i < failures && delay < maxBackoff; i++ {
+		delay *= 2
+	}
+
+	if delay > maxBackoff {
+		return maxBackoff
+	}
+
+	return delay
+}
+
+// stateDelay slows down polling of pipelines which wait for something, running pipelines are polled on every tick
+func (j *Job) stateDelay() time.Duration {
+	if !j.IsPipelineWatch() {
+		return 0
+	}
+
+	switch j.Status {
+	case "created", "waiting_for_resource", "preparing", "pending":
+		return waitingInterval
+	case "manual", "scheduled":
+		return idleInterval
+	}
+
+	return 0
+}
+
+// title describes what job polls
+func (j *Job) title() string {
+	switch {
+	case j.IsPipelineWatch():
+		return fmt.Sprintf("watch of pipeline %d", j.PipelineID)
+	case j.IsMergeRequestWatch():
+		return fmt.Sprintf("watch of merge request %d in %s", j.MergeRequestIID, j.Project)
+	default:
+		return "tracking of " + j.Project
+	}
+}
+
+// ResumeJobs resumes paused jobs of chat, returns count of resumed jobs
+func (c *Cron) ResumeJobs(toID int64) int {
+	resumed := 0
+
+	for _, job := range c.Jobs() {
+		if job.ToID != toID {
+			continue
+		}
+
+		unlock := c.lockJob(job.Key)
+
+		// job could be removed or resumed while waiting for lock
+		if job.Paused && c.GetJob(job.Key) == job {
+			job.Paused = false
+			job.Failures = 0
+			job.NextRun = time.Time{}
+			job.LastTick = time.Time{}
+
+			job.save()
+
+			log.Printf("job %s resumed", job.Key)
+
+			resumed++
+		}
+
+		unlock()
+	}
+
+	return resumed
+}
+
+func (job *Job) Run() {
+	job.Exec()
+}
+
+// pollProjectPipelines notifies about pipelines updated since last poll, LastUpdated cursor is moved
+// to updated_at of the newest processed pipeline, so clock skew between bot and gitlab doesn't matter,
+// pipelines returned again on the cursor boundary are filtered out by status cache
+func (j *Job) pollProjectPipelines() error {
+	// cursor is changed and saved while cron ticks
+	unlock := j.Cron.lockJob(j.Key)
+	defer unlock()
+
+	if j.Cron.GetJob(j.Key) != j {
+		return nil
+	}
+
+	// first poll only remembers current pipelines, old ones are not notified
+	priming := j.LastUpdated.IsZero()
+
+	orderBy, sort := "updated_at", "asc"
+	if priming {
+		sort = "desc"
+	}
+
+	options := &gl.ListProjectPipelinesOptions{
+		OrderBy: &orderBy,
+		Sort:    &sort,
+	}
+
+	if user := j.pipelineUser(); user != "" {
+		options.Username = &user
+	}
+
+	pipelineFilter := j.pipelineFilter()
+
+	// gitlab filters by single exact ref and source only, the rest is filtered here
+	if j.Branch != "" {
+		options.Ref = &j.Branch
+	} else if ref := pipelineFilter.Ref(); ref != "" {
+		options.Ref = &ref
+	}
+
+	if source := pipelineFilter.Source(); source != "" {
+		options.Source = &source
+	}
+
+	if j.OnlyFailures {
+		options.Status = gl.BuildState(gl.Failed)
+	}
+
+	if !priming {
+		updatedAfter := j.LastUpdated.Add(-cursorOverlap)
+		options.UpdatedAfter = &updatedAfter
+	}
+
+	pipelines, _, err := j.Gitlab.Pipelines.ListProjectPipelines(j.Project, options)
+	if err != nil {
+		return fmt.Errorf("error getting pipelines for project %s: %w", j.Project, err)
+	}
+
+	// cursor is saved only when it moves, most polls find nothing new
+	lastUpdated := j.LastUpdated
+
+	defer func() {
+		if !j.LastUpdated.Equal(lastUpdated) {
+			j.save()
+		}
+	}()
+
+	for _, pipeline := range pipelines {
+		if !j.matchPipeline(pipeline.Ref, pipeline.Source, pipeline.Status) {
+			j.moveCursor(pipeline.UpdatedAt)
+
+			continue
+		}
+
+		if priming {
+			j.Cron.Dedup.Changed(j.Key, pipeline.ID, pipeline.Status)
+			j.moveCursor(pipeline.UpdatedAt)
+
+			continue
+		}
+
+		// skip request for pipeline which status was already notified
+		if status, ok := j.Cron.Dedup.Status(j.Key, pipeline.ID); ok && status == pipeline.Status {
+			j.moveCursor(pipeline.UpdatedAt)
+
+			continue
+		}
+
+		if err := ProcessProjectPipeline(j, pipeline.ID); err != nil {
+			return err
+		}
+
+		j.moveCursor(pipeline.UpdatedAt)
+	}
+
+	return nil
+}
+
+func (j *Job) moveCursor(updatedAt *time.Time) {
+	if updatedAt != nil && updatedAt.After(j.LastUpdated) {
+		j.LastUpdated = *updatedAt
+	}
+}
+
+// ProcessProjectPipeline sends pipeline info for tracked project job
+func ProcessProjectPipeline(j *Job, pipelineID int) error {
+	pipelineInfo, _, err := j.Gitlab.Pipelines.GetPipeline(j.Project, pipelineID)
+	if err != nil {
+		return fmt.Errorf("error getting pipeline: %w", err)
+	}
+
+	if !j.matchPipeline(pipelineInfo.Ref, pipelineInfo.Source, pipelineInfo.Status) {
+		return nil
+	}
+
+	if user := j.pipelineUser(); user != "" && (pipelineInfo.User == nil || pipelineInfo.User.Username != user) {
+		return nil
+	}
+
+	// webhook and polling report the same pipeline, only real status change is notified
+	if !j.Cron.Dedup.Changed(j.Key, pipelineInfo.ID, pipelineInfo.Status) {
+		return nil
+	}
+
+	j.notifyPipeline("**Pipeline updated**", pipelineInfo)
+
+	return nil
+}
+
+// pipelineUser returns gitlab username whose pipelines are tracked, empty username means all users.
+// Subscriptions have own user, tracking from config uses GITLAB_USERNAME if GITLAB_TRACK_ONLY_SELF is set
+func (j *Job) pipelineUser() string {
+	if j.Subscription {
+		return j.Username
+	}
+
+	if j.Cron == nil {
+		return ""
+	}
+
+	if conf := j.Cron.Conf.Load(); conf != nil && conf.GitlabTrackOnlySelf {
+		return conf.GitlabUsername
+	}
+
+	return ""
+}
+
+func (j *Job) pipelineFilter() filter.Filter {
+	return filter.Filter{Refs: j.Refs, Sources: j.Sources}
+}
+
+// matchPipeline checks pipeline against ref, source and status filters of tracked project,
+// branch and only failures filters of subscription
+func (j *Job) matchPipeline(ref, source, status string) bool {
+	if !j.pipelineFilter().Match(ref, source) {
+		return false
+	}
+
+	if len(j.Statuses) > 0 && !containsString(j.Statuses, status) {
+		return false
+	}
+
+	if j.Branch != "" && ref != j.Branch {
+		return false
+	}
+
+	if j.OnlyFailures && status != "failed" {
+		return false
+	}
+
+	return true
+}
+
+func containsString(items []string, item string) bool {
+	for _, i := range items {
+		if i == item {
+			return true
+		}
+	}
+
+	return false
+}
+
+// formatPipeline formats pipeline with template of tracked project, default format is used if there is no template
+func (j *Job) formatPipeline(pipeline *gl.Pipeline) string {
+	if j.Template == "" {
+		return gitlab.FormatPipelineInfo(pipeline)
+	}
+
+	text, err := gitlab.FormatPipelineTemplate(j.Template, j.Project, pipeline)
+	if err != nil {
+		log.Printf("error formatting pipeline %d with template of job %s: %s", pipeline.ID, j.Key, err)
+
+		return gitlab.FormatPipelineInfo(pipeline)
+	}
+
+	return text
+}
+
+// notifyPipeline sends pipeline info, failed pipelines get jobs breakdown and failed jobs logs
+func (j *Job) notifyPipeline(title string, pipeline *gl.Pipeline) {
+	ctx := context.Background()
+
+	text := title + "\n" + j.formatPipeline(pipeline)
+	replyMarkup := keyboard.Pipeline(pipeline, j.IsPipelineWatch() && !gitlab.IsFinishedStatus(pipeline.Status))
+
+	notification := notificationPipeline
+	if j.IsProjectTrack() {
+		notification = notificationProject
+	}
+
+	var jobs []*gl.Job
+
+	if pipeline.Status == "failed" {
+		var err error
+
+		jobs, err = gitlab.GetPipelineJobs(j.Gitlab, j.Project, pipeline.ID)
+		if err != nil {
+			log.Printf("error getting jobs for pipeline %d: %s", pipeline.ID, err)
+		} else {
+			text = text + "\n\n" + gitlab.FormatPipelineJobs(jobs)
 		}
-		result = append(result, r)
 	}
-	return string(result)
-}
 
-type Cron struct {
-	Bot           *bot.Bot
-	Cron          *robfigcron.Cron
-	Conf          *config.Config
-	JobsContainer JobsContainer
-}
+	// tracking job without chat only routes to notifiers
+	if j.ToID != 0 {
+		_, err := j.SendMessageWithKeyboard(ctx, j.ToID, text, replyMarkup)
 
-type Job struct {
-	Cron        *Cron
-	Bot         *bot.Bot
-	Gitlab      *gl.Client
-	Key         string
-	ToID        int64
-	Status      string
-	Project     string
-	Count       int
-	PipelineID  int
-	LastUpdated time.Time
-	LastID      int
+		countNotification(notification, err)
+
+		for _, job := range jobs {
+			if job.Status == "failed" && !job.AllowFailure {
+				j.sendJobLog(ctx, job)
+			}
+		}
+	}
+
+	j.notifyExternal(ctx, notify.Message{Type: notification, Project: j.Project, Text: text, Pipeline: pipeline})
 }
 
-// JobsContainer ...
-type JobsContainer struct {
-	mu   sync.RWMutex
-	jobs map[string]robfigcron.EntryID
+// notifyExternal sends message to notifiers of job, notifiers removed from config are skipped
+func (j *Job) notifyExternal(ctx context.Context, message notify.Message) {
+	for _, name := range j.Notifiers {
+		var conf *config.Notifier
+		if j.Cron != nil {
+			conf = j.Cron.Conf.Load().FindNotifier(name)
+		}
+
+		if conf == nil {
+			log.Printf("notifier %s of job %s not found", name, j.Key)
+
+			continue
+		}
+
+		notifier, err := notify.New(*conf, j.Bot)
+		if err == nil {
+			err = notifier.Notify(ctx, message)
+		}
+
+		if err != nil {
+			metrics.NotifierFailures.Inc(name)
+
+			log.Printf("error sending notification of job %s to %s: %s", j.Key, name, err)
+
+			continue
+		}
+
+		countNotification(message.Type, nil)
+	}
 }
 
-func InitCron(b *bot.Bot, conf *config.Config) *Cron {
-	c := &Cron{
-		Bot:  b,
-		Conf: conf,
+// sendJobLog sends tail of job trace as code block, or as file if it is too long or configured so
+func (j *Job) sendJobLog(ctx context.Context, job *gl.Job) {
+	lines := config.DefaultFailedJobLogLines
+	asFile := false
+
+	if j.Cron != nil {
+		if conf := j.Cron.Conf.Load(); conf != nil {
+			lines = conf.FailedJobLogLines
+			asFile = conf.FailedJobLogAsFile
+		}
 	}
 
-	c.Cron = robfigcron.New(
-		robfigcron.WithChain(
-			robfigcron.SkipIfStillRunning(robfigcron.DefaultLogger),
-			robfigcron.Recover(robfigcron.DefaultLogger),
-		),
-	)
-	c.JobsContainer.jobs = make(map[string]robfigcron.EntryID)
+	if lines < 0 {
+		return
+	}
 
-	c.Cron.Start()
+	trace, err := gitlab.GetJobTraceTail(j.Gitlab, j.Project, job.ID, lines)
+	if err != nil {
+		log.Printf("error getting trace of job %d: %s", job.ID, err)
 
-	return c
-}
+		return
+	}
 
-// Exec ...
-func (job *Job) Exec() {
-	job.Count = job.Count + 1
+	if trace == "" {
+		return
+	}
 
-	if job.PipelineID > 0 && job.Count > 360 {
-		log.Printf("job %s is deleted", job.Key)
+	title := fmt.Sprintf("log of job %s (%d)", job.Name, job.ID)
 
-		_ = job.SendMessage(
-			context.Background(),
-			job.ToID,
-			fmt.Sprintf(
-				"**pipeline %d monitored too long**\ntask deleted, you can retry it",
-				job.PipelineID,
-			),
-		)
+	if asFile || len(trace) > maxLogMessageSize {
+		err := j.SendDocument(ctx, j.ToID, fmt.Sprintf("job-%d.log", job.ID), []byte(trace), title)
+		if err != nil {
+			log.Printf("error sending trace of job %d: %s", job.ID, err)
+		}
 
-		RemoveJob(job)
+		countNotification(notificationJobLog, err)
 
 		return
 	}
 
-	// check pipeline in gitlab and send message to telegram user if status changes
-	go func(j *Job) {
-		defer recovery.Recovery()
+	trace = strings.NewReplacer("\\", "\\\\", "`", "\\`").Replace(trace)
+
+	err = j.SendMessage(ctx, j.ToID, "**"+title+"**\n```\n"+trace+"\n```")
+
+	countNotification(notificationJobLog, err)
+}
+
+func ProcessPipelineUpdate(j *Job) error {
+	fmt.Println("job", j.Key, "executed", j.Count, "time(s)")
+
+	if j.Cron.GetJob(j.Key) != j {
+		return nil
+	}
+
+	// get pipeline from gitlab
+	pipelineInfo, _, err := j.Gitlab.Pipelines.GetPipeline(j.Project, j.PipelineID)
+	if err != nil {
+		return fmt.Errorf("error getting pipeline: %w", err)
+	}
+
+	return j.updatePipeline(pipelineInfo)
+}
+
+// updatePipeline notifies about changes of watched pipeline fetched from gitlab
+func (j *Job) updatePipeline(pipelineInfo *gl.Pipeline) error {
+	// webhook and polling can process the same job at the same time
+	unlock := j.Cron.lockJob(j.Key)
+	defer unlock()
+
+	if j.Cron.GetJob(j.Key) != j {
+		return nil
+	}
+
+	statusChanged := pipelineInfo.Status != j.Status
+	progressChanged := pipelineInfo.UpdatedAt != nil && !pipelineInfo.UpdatedAt.Equal(j.PipelineUpdatedAt)
+
+	// check if pipeline status is changed, progress matters only if there is live message to update
+	if !statusChanged && !(progressChanged && j.MessageID != 0) {
+		// poller lists pipelines updated after this time, so it is kept up to date
+		if progressChanged {
+			j.PipelineUpdatedAt = *pipelineInfo.UpdatedAt
+		}
 
-		if j.PipelineID > 0 {
-			errSendPipelineUpdate := ProcessPipelineUpdate(j)
-			if errSendPipelineUpdate != nil {
-				fmt.Println(errSendPipelineUpdate)
+		return nil
+	}
+
+	// update job status
+	j.Status = pipelineInfo.Status
+
+	if pipelineInfo.UpdatedAt != nil {
+		j.PipelineUpdatedAt = *pipelineInfo.UpdatedAt
+	}
+
+	ctx := context.Background()
+
+	if gitlab.IsFinishedStatus(pipelineInfo.Status) {
+		if j.MessageID != 0 {
+			if err := j.editLiveMessage(ctx, pipelineInfo); err != nil {
+				log.Printf("error editing live message of job %s: %s", j.Key, err)
 			}
+		}
+
+		// separate message, so user gets notification sound
+		j.notifyPipeline("**pipeline status changed**", pipelineInfo)
+
+		RemoveJob(j)
+
+		return nil
+	}
+
+	// manual pipeline stays watched, it continues after user plays job or approves deployment
+	if statusChanged && pipelineInfo.Status == "manual" {
+		j.notifyManual(ctx, pipelineInfo)
+	}
+
+	if statusChanged && j.Mode == ModeTransitions {
+		// every transition is a new message with notification, old live message is removed to keep chat clean
+		j.repostLiveMessage(ctx, pipelineInfo)
+	} else if j.MessageID != 0 {
+		j.updateLiveMessage(ctx, pipelineInfo)
+	}
 
+	j.save()
+
+	return nil
+}
+
+// notifyManual tells that pipeline waits for manual job or deployment approval, message has buttons to act
+func (j *Job) notifyManual(ctx context.Context, pipeline *gl.Pipeline) {
+	actions, err := gitlab.GetManualActions(j.Gitlab, j.Project, pipeline.ID)
+	if err != nil {
+		log.Printf("error getting manual jobs for pipeline %d: %s", pipeline.ID, err)
+	}
+
+	text := "**pipeline waits for manual action**\n" + gitlab.FormatPipelineInfo(pipeline)
+	if len(actions) > 0 {
+		text = text + "\n\n" + gitlab.FormatManualActions(actions)
+	}
+
+	_, err = j.SendMessageWithKeyboard(ctx, j.ToID, text, keyboard.Manual(pipeline, actions, true))
+
+	countNotification(notificationManual, err)
+}
+
+// updateLiveMessage edits live status message, new one is sent if there is no message or it can't be edited
+func (j *Job) updateLiveMessage(ctx context.Context, pipeline *gl.Pipeline) {
+	if j.MessageID != 0 {
+		err := j.editLiveMessage(ctx, pipeline)
+		if err == nil {
 			return
 		}
 
-		if j.Cron.Conf.GitlabTrackProjectsList != nil {
-			options := &gl.ListProjectPipelinesOptions{}
+		log.Printf("error editing live message of job %s: %s", j.Key, err)
+	}
 
-			if j.Cron.Conf.GitlabTrackOnlySelf && j.Cron.Conf.GitlabUsername != "" {
-				options.Username = &j.Cron.Conf.GitlabUsername
-			}
+	message, err := j.SendMessageWithKeyboard(ctx, j.ToID, j.liveMessageText(pipeline), j.liveMessageKeyboard(pipeline))
 
-			if j.LastUpdated.IsZero() {
-				now := time.Now()
-				options.UpdatedAfter = &now
-			} else {
-				options.UpdatedAfter = &j.LastUpdated
-				j.LastUpdated = time.Now()
-			}
+	countNotification(notificationLiveStatus, err)
 
-			if pipelineInfo, _, err := j.Gitlab.Pipelines.ListProjectPipelines(
-				j.Project,
-				options,
-			); err != nil {
-				log.Printf("error getting pipelines for project %s: %s\n", j.Project, err.Error())
-			} else {
-				if len(pipelineInfo) > 0 {
-					for _, pipeline := range pipelineInfo {
-						pipelineInfo, _, err := j.Gitlab.Pipelines.GetPipeline(j.Project, pipeline.ID)
-						if err != nil {
-							fmt.Printf("error getting pipeline: %s\n", err)
-
-							return
-						}
-
-						pipelineMessage := gitlab.FormatPipelineInfo(pipelineInfo)
-
-						_ = j.SendMessage(
-							context.Background(),
-							j.ToID,
-							"**Pipeline updated**\n"+pipelineMessage,
-						)
-					}
-				}
-			}
+	if err != nil {
+		log.Printf("error sending live message of job %s: %s", j.Key, err)
+
+		return
+	}
+
+	if message != nil {
+		j.MessageID = message.ID
+	}
+}
+
+func (j *Job) repostLiveMessage(ctx context.Context, pipeline *gl.Pipeline) {
+	if j.MessageID != 0 && j.Bot != nil {
+		if _, err := j.Bot.DeleteMessage(ctx, &bot.DeleteMessageParams{ChatID: j.ToID, MessageID: j.MessageID}); err != nil {
+			log.Printf("error deleting live message of job %s: %s", j.Key, err)
 		}
-	}(job)
+	}
+
+	j.MessageID = 0
 
+	j.updateLiveMessage(ctx, pipeline)
 }
 
-func (job *Job) Run() {
-	job.Exec()
+func (j *Job) editLiveMessage(ctx context.Context, pipeline *gl.Pipeline) error {
+	return j.EditMessage(ctx, j.ToID, j.MessageID, j.liveMessageText(pipeline), j.liveMessageKeyboard(pipeline))
 }
 
-func ProcessPipelineUpdate(j *Job) error {
-	fmt.Println("job", j.Key, "executed", j.Count, "time(s)")
+func (j *Job) liveMessageText(pipeline *gl.Pipeline) string {
+	text := "**pipeline status**\n" + gitlab.FormatPipelineInfo(pipeline)
 
-	// get pipeline from gitlab
-	pipelineInfo, _, err := j.Gitlab.Pipelines.GetPipeline(j.Project, j.PipelineID)
+	if pipeline.Status != "running" {
+		return text
+	}
+
+	jobs, err := gitlab.GetPipelineJobs(j.Gitlab, j.Project, pipeline.ID)
+	if err != nil {
+		log.Printf("error getting jobs for pipeline %d: %s", pipeline.ID, err)
+
+		return text
+	}
+
+	return text + "\n" + gitlab.FormatPipelineProgress(jobs)
+}
+
+func (j *Job) liveMessageKeyboard(pipeline *gl.Pipeline) models.ReplyMarkup {
+	return keyboard.Pipeline(pipeline, !gitlab.IsFinishedStatus(pipeline.Status))
+}
+
+// mergeRequestState is saved state of merge request watch, job is saved only when it changes
+type mergeRequestState struct {
+	status             string
+	approvals          int
+	notes              int
+	headPipelineID     int
+	headPipelineStatus string
+}
+
+func (j *Job) mergeRequestState() mergeRequestState {
+	return mergeRequestState{
+		status:             j.Status,
+		approvals:          j.Approvals,
+		notes:              j.Notes,
+		headPipelineID:     j.HeadPipelineID,
+		headPipelineStatus: j.HeadPipelineStatus,
+	}
+}
+
+// ProcessMergeRequestUpdate notifies about approvals, new comments, head pipeline result, merge or close
+func ProcessMergeRequestUpdate(j *Job) error {
+	unlock := j.Cron.lockJob(j.Key)
+	defer unlock()
+
+	if j.Cron.GetJob(j.Key) != j {
+		return nil
+	}
+
+	mergeRequest, _, err := j.Gitlab.MergeRequests.GetMergeRequest(j.Project, j.MergeRequestIID, nil)
 	if err != nil {
-		return fmt.Errorf("error getting pipeline: %s", err)
+		return fmt.Errorf("error getting merge request: %w", err)
+	}
+
+	approvals, _, errApprovals := j.Gitlab.MergeRequestApprovals.GetConfiguration(j.Project, j.MergeRequestIID)
+	if errApprovals != nil {
+		log.Printf("error getting approvals of merge request %d: %s", j.MergeRequestIID, errApprovals)
+
+		approvals = nil
+	}
+
+	state := j.mergeRequestState()
+
+	var events []string
+
+	if approvals != nil {
+		// approvers without user are skipped, so they are not counted in saved approvals too
+		approvedBy := gitlab.ApprovedBy(approvals)
+
+		if len(approvedBy) > j.Approvals {
+			events = append(events, "👍 approved by "+strings.Join(approvedBy, ", "))
+		} else if len(approvedBy) < j.Approvals {
+			events = append(events, "👎 approval revoked")
+		}
+
+		j.Approvals = len(approvedBy)
+	}
+
+	if mergeRequest.UserNotesCount > j.Notes {
+		events = append(events, j.formatNewNotes(mergeRequest.UserNotesCount-j.Notes))
 	}
 
-	// check if pipeline status is changed
-	if pipelineInfo.Status != j.Status {
-		// update job status
-		// j.Status = pipelineInfo.Status
+	j.Notes = mergeRequest.UserNotesCount
 
-		// format pipeline info
-		pipelineMessage := gitlab.FormatPipelineInfo(pipelineInfo)
+	if mergeRequest.HeadPipeline != nil {
+		headPipeline := mergeRequest.HeadPipeline
 
-		// send message to user
-		_ = j.SendMessage(
+		// manual pipeline waits for someone, it is reported like finished one
+		reported := gitlab.IsFinishedStatus(headPipeline.Status) || headPipeline.Status == "manual"
+
+		if (headPipeline.ID != j.HeadPipelineID || headPipeline.Status != j.HeadPipelineStatus) && reported {
+			events = append(events, fmt.Sprintf("%s pipeline %s", gitlab.StatusEmoji(headPipeline.Status), headPipeline.Status))
+		}
+
+		j.HeadPipelineID = headPipeline.ID
+		j.HeadPipelineStatus = headPipeline.Status
+	}
+
+	if mergeRequest.State != j.Status {
+		switch mergeRequest.State {
+		case "merged":
+			mergedBy := ""
+			if mergeRequest.MergedBy != nil {
+				mergedBy = " by " + mergeRequest.MergedBy.Username
+			}
+
+			events = append(events, "🔀 merged"+mergedBy)
+		case "closed":
+			closedBy := ""
+			if mergeRequest.ClosedBy != nil {
+				closedBy = " by " + mergeRequest.ClosedBy.Username
+			}
+
+			events = append(events, "🚫 closed"+closedBy)
+		case "opened":
+			events = append(events, "🔓 reopened")
+		}
+
+		j.Status = mergeRequest.State
+	}
+
+	if len(events) > 0 {
+		err := j.SendMessage(
 			context.Background(),
 			j.ToID,
-			"**pipeline status changed**\n"+pipelineMessage,
+			"**merge request updated**\n"+strings.Join(events, "\n")+"\n\n"+gitlab.FormatMergeRequestInfo(mergeRequest, approvals),
 		)
 
+		countNotification(notificationMergeRequest, err)
+	}
+
+	if mergeRequest.State == "merged" || mergeRequest.State == "closed" {
 		RemoveJob(j)
+	} else if j.mergeRequestState() != state {
+		j.save()
 	}
 
 	return nil
 }
 
+// maxNoteLength limits comment text in notification
+const maxNoteLength = 300
+
+func (j *Job) formatNewNotes(count int) string {
+	text := fmt.Sprintf("💬 %d new comment(s)", count)
+
+	orderBy, sort := "created_at", "desc"
+
+	notes, _, err := j.Gitlab.Notes.ListMergeRequestNotes(j.Project, j.MergeRequestIID, &gl.ListMergeRequestNotesOptions{
+		ListOptions: gl.ListOptions{PerPage: count + 10},
+		OrderBy:     &orderBy,
+		Sort:        &sort,
+	})
+	if err != nil {
+		log.Printf("error getting notes of merge request %d: %s", j.MergeRequestIID, err)
+
+		return text
+	}
+
+	var lines []string
+
+	for _, note := range notes {
+		if note.System {
+			continue
+		}
+
+		body := []rune(note.Body)
+		if len(body) > maxNoteLength {
+			body = append(body[:maxNoteLength], '…')
+		}
+
+		lines = append([]string{note.Author.Username + ": " + string(body)}, lines...)
+
+		if len(lines) == count {
+			break
+		}
+	}
+
+	if len(lines) == 0 {
+		return text
+	}
+
+	return text + "\n" + strings.Join(lines, "\n")
+}
+
+// interval returns polling interval of job, default one is used for watches and wrong values
+func (job *Job) interval() string {
+	if job.Interval == "" {
+		return config.DefaultInterval
+	}
+
+	if _, err := time.ParseDuration(job.Interval); err != nil {
+		return config.DefaultInterval
+	}
+
+	return job.Interval
+}
+
 func AddJob(job Job) {
 	job.Cron.JobsContainer.mu.Lock()
 	if _, ok := job.Cron.JobsContainer.jobs[job.Key]; ok {
@@ -198,7 +1449,7 @@ func AddJob(job Job) {
 		job.Cron.Cron.Remove(job.Cron.JobsContainer.jobs[job.Key])
 	}
 
-	entryID, errAddJob := job.Cron.Cron.AddJob("@every 10s", &job)
+	entryID, errAddJob := job.Cron.Cron.AddJob("@every "+job.interval(), &job)
 	if errAddJob != nil {
 		log.Printf("error adding job: %#v, %s", job, errAddJob)
 	} else {
@@ -208,6 +1459,10 @@ func AddJob(job Job) {
 	}
 
 	job.Cron.JobsContainer.mu.Unlock()
+
+	if errAddJob == nil {
+		job.save()
+	}
 }
 
 func RemoveJob(job *Job) {
@@ -223,9 +1478,66 @@ func RemoveJob(job *Job) {
 	}
 
 	job.Cron.JobsContainer.mu.Unlock()
+
+	job.Cron.locks.Delete(job.Key)
+
+	if job.Cron.Store != nil {
+		if err := job.Cron.Store.Delete(job.Key); err != nil {
+			log.Printf("error deleting job %s from store: %s", job.Key, err)
+		}
+	}
+}
+
+// save writes job state to store, so Count, Status and LastUpdated survive restarts
+func (job *Job) save() {
+	if job.Cron == nil || job.Cron.Store == nil {
+		return
+	}
+
+	record, err := json.Marshal(job)
+	if err != nil {
+		log.Printf("error marshal job %s: %s", job.Key, err)
+
+		return
+	}
+
+	if err := job.Cron.Store.Save(job.Key, record); err != nil {
+		log.Printf("error saving job %s: %s", job.Key, err)
+	}
 }
 
 func (job *Job) SendMessage(ctx context.Context, toID int64, message string) error {
+	_, err := job.SendMessageWithKeyboard(ctx, toID, message, nil)
+
+	return err
+}
+
+func (job *Job) SendMessageWithKeyboard(ctx context.Context, toID int64, message string, replyMarkup models.ReplyMarkup) (*models.Message, error) {
+	return notify.NewTelegram(job.Bot, toID).InThread(job.threadID(toID)).Send(ctx, message, replyMarkup)
+}
+
+// threadID returns forum topic of job if message is sent to chat of job
+func (job *Job) threadID(toID int64) int {
+	if toID != job.ToID {
+		return 0
+	}
+
+	return job.ThreadID
+}
+
+// countNotification counts notification if it was sent
+func countNotification(notification string, err error) {
+	if err == nil {
+		metrics.Notifications.Inc(notification)
+	}
+}
+
+// EditMessage replaces text and keyboard of already sent message
+func (job *Job) EditMessage(ctx context.Context, toID int64, messageID int, message string, replyMarkup models.ReplyMarkup) error {
+	return notify.NewTelegram(job.Bot, toID).Edit(ctx, messageID, message, replyMarkup)
+}
+
+func (job *Job) SendDocument(ctx context.Context, toID int64, filename string, data []byte, caption string) error {
 	if job.Bot == nil {
 		return fmt.Errorf("%s", "bot not set")
 	}
@@ -234,56 +1546,97 @@ func (job *Job) SendMessage(ctx context.Context, toID int64, message string) err
 		return fmt.Errorf("%s", "empty user id")
 	}
 
-	if message == "" {
-		return fmt.Errorf("%s", "empty message")
+	if len(data) == 0 {
+		return fmt.Errorf("%s", "empty document")
 	}
 
-	_, errSendMarkdownMessage := job.Bot.SendMessage(ctx, &bot.SendMessageParams{
-		ChatID:    toID,
-		Text:      message,
-		ParseMode: models.ParseModeMarkdown,
+	_, errSendDocument := job.Bot.SendDocument(ctx, &bot.SendDocumentParams{
+		ChatID:          toID,
+		MessageThreadID: job.threadID(toID),
+		Document: &models.InputFileUpload{
+			Filename: filename,
+			Data:     bytes.NewReader(data),
+		},
+		Caption: caption,
 	})
 
-	if errSendMarkdownMessage != nil {
-		_, errSendMessage := job.Bot.SendMessage(ctx, &bot.SendMessageParams{
-			ChatID: toID,
-			Text:   escapeMarkdown(message),
-		})
+	metrics.Telegram.Observe(errSendDocument, time.Now())
+
+	if errSendDocument != nil {
+		metrics.TelegramFailures.Inc("send_document")
+	}
+
+	return errSendDocument
+}
+
+// Reload applies reloaded config, tracking jobs of projects and chats removed from config are deleted,
+// new ones are added, watched pipelines, merge requests and subscriptions are kept
+func (c *Cron) Reload(conf *config.Config, gitlabClient *gl.Client) {
+	for _, name := range c.Conf.Update(conf) {
+		log.Printf("%s changed, restart is required to apply it", name)
+	}
 
-		if errSendMessage != nil {
-			return errSendMessage
+	for _, job := range c.Jobs() {
+		if job.IsProjectTrack() && !job.Subscription && !c.isTrackKey(job.Key) {
+			RemoveJob(job)
 		}
 	}
 
-	return nil
+	c.TrackPipelines(gitlabClient)
 }
 
+// TrackPipelines adds tracking jobs for every project and chat from config,
+// restored jobs keep their cursor, rules changed in config are applied to them
 func (c *Cron) TrackPipelines(gitlabClient *gl.Client) {
-	toID, errToID := strconv.ParseInt(c.Conf.NotifyTelegramID, 10, 64)
-	if errToID != nil {
-		return
-	}
+	conf := c.Conf.Load()
 
 	user := "all"
-	if c.Conf.GitlabUsername != "" && c.Conf.GitlabTrackOnlySelf {
-		user = c.Conf.GitlabUsername
+	if conf.GitlabUsername != "" && conf.GitlabTrackOnlySelf {
+		user = conf.GitlabUsername
 	}
 
-	for _, project := range c.Conf.GitlabTrackProjectsList {
-		job := Job{
-			Cron:       c,
-			Bot:        c.Bot,
-			Gitlab:     gitlabClient,
-			Key:        "TrackPipelines/" + project,
-			ToID:       toID,
-			Project:    project,
-			PipelineID: 0,
-		}
+	for _, project := range conf.Projects {
+		for _, toID := range projectChats(conf, project) {
+			job := Job{
+				Cron:     c,
+				Bot:      c.Bot,
+				Gitlab:   gitlabClient,
+				Key:      trackKey(toID, project.Project),
+				ToID:     toID,
+				Project:  project.Project,
+				Refs:     project.Refs,
+				Sources:  project.Sources,
+				Statuses: project.Statuses,
+				Template: project.Template,
+				Interval: project.Interval,
+			}
 
-		AddJob(job)
-		// git.nethouse.ru/api/v4/projects/nethouse/frontend/pipelines
-		// git.nethouse.ru/api/v4/projects/nethouse/frontend/pipelines
+			if toID == 0 {
+				job.Notifiers = project.Notifiers
+			}
+
+			if restored := c.GetJob(job.Key); restored != nil {
+				if restored.sameRules(&job) {
+					log.Println("will track updates for project", project.Project, "for user", user, "to", toID, "(restored)")
 
-		log.Println("will track updates for project", project, "for user", user)
+					continue
+				}
+
+				job.Count = restored.Count
+				job.LastUpdated = restored.LastUpdated
+			}
+
+			AddJob(job)
+
+			log.Println("will track updates for project", project.Project, "for user", user, "to", toID)
+		}
 	}
 }
+
+func (job *Job) sameRules(other *Job) bool {
+	return reflect.DeepEqual(job.pipelineFilter(), other.pipelineFilter()) &&
+		reflect.DeepEqual(job.Statuses, other.Statuses) &&
+		job.Template == other.Template &&
+		job.Interval == other.Interval &&
+		reflect.DeepEqual(job.Notifiers, other.Notifiers)
+}
@@ -2,43 +2,29 @@ package cron
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/ad/gitlab-pipelines-notifier/config"
+	"github.com/ad/gitlab-pipelines-notifier/dedup"
+	"github.com/ad/gitlab-pipelines-notifier/notify"
+	"github.com/ad/gitlab-pipelines-notifier/store"
 
 	"github.com/go-telegram/bot"
+	"github.com/google/go-cmp/cmp"
 	robfigcron "github.com/robfig/cron/v3"
 	gl "github.com/xanzy/go-gitlab"
 )
 
-func Test_escapeMarkdown(t *testing.T) {
-	type args struct {
-		s string
-	}
-	tests := []struct {
-		name string
-		args args
-		want string
-	}{
-		{
-			name: "empty string",
-			want: "",
-		},
-		{
-			name: "escaped string",
-			args: args{
-				s: "[]()>#+-=|{}.!",
-			},
-			want: "\\[\\]\\(\\)\\>\\#\\+\\-\\=\\|\\{\\}\\.\\!",
-		},
-	}
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			if got := escapeMarkdown(tt.args.s); got != tt.want {
-				t.Errorf("escapeMarkdown() = %v, want %v", got, tt.want)
-			}
-		})
-	}
-}
-
 func TestInitCron(t *testing.T) {
 	type args struct {
 		b *bot.Bot
@@ -346,3 +332,1401 @@ func TestJob_Exec(t *testing.T) {
 		})
 	}
 }
+
+func TestJob_pollProjectPipelines(t *testing.T) {
+	// pipelines list is the same on every poll, like gitlab returns it again on cursor boundary
+	updatedAt := "2024-01-01T10:00:00Z"
+	status := "running"
+	getPipelineRequests := 0
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		switch r.URL.Path {
+		case "/api/v4/projects/group/project/pipelines":
+			fmt.Fprintf(w, `[{"id":1,"status":%q,"updated_at":%q}]`, status, updatedAt)
+		case "/api/v4/projects/group/project/pipelines/1":
+			getPipelineRequests++
+
+			fmt.Fprintf(w, `{"id":1,"status":%q,"updated_at":%q}`, status, updatedAt)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	gitlabClient, err := gl.NewClient("test", gl.WithBaseURL(server.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &Cron{
+		Cron:  robfigcron.New(),
+		Dedup: dedup.New(dedup.DefaultSize),
+		JobsContainer: JobsContainer{
+			jobs: map[string]robfigcron.EntryID{},
+		},
+	}
+
+	AddJob(Job{Cron: c, Gitlab: gitlabClient, Key: "TrackPipelines/group/project", Project: "group/project"})
+
+	j := c.GetJob("TrackPipelines/group/project")
+
+	steps := []struct {
+		name         string
+		status       string
+		updatedAt    string
+		wantRequests int
+	}{
+		{name: "priming", status: "running", updatedAt: "2024-01-01T10:00:00Z", wantRequests: 0},
+		{name: "same status", status: "running", updatedAt: "2024-01-01T10:00:00Z", wantRequests: 0},
+		{name: "status changed", status: "success", updatedAt: "2024-01-01T10:05:00Z", wantRequests: 1},
+		{name: "same status again", status: "success", updatedAt: "2024-01-01T10:05:00Z", wantRequests: 1},
+	}
+	for _, step := range steps {
+		status, updatedAt = step.status, step.updatedAt
+
+		if err := j.pollProjectPipelines(); err != nil {
+			t.Fatalf("%s: pollProjectPipelines() error = %v", step.name, err)
+		}
+
+		if getPipelineRequests != step.wantRequests {
+			t.Errorf("%s: pipeline requests = %d, want %d", step.name, getPipelineRequests, step.wantRequests)
+		}
+
+		wantCursor, _ := time.Parse(time.RFC3339, step.updatedAt)
+		if !j.LastUpdated.Equal(wantCursor) {
+			t.Errorf("%s: LastUpdated = %s, want %s", step.name, j.LastUpdated, wantCursor)
+		}
+	}
+}
+
+func TestJob_updatePipeline_manual(t *testing.T) {
+	jobsRequests := 0
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		switch r.URL.Path {
+		case "/api/v4/projects/group/project/pipelines/1/jobs":
+			jobsRequests++
+
+			fmt.Fprint(w, `[{"id":2,"name":"deploy","stage":"deploy","status":"manual"}]`)
+		case "/api/v4/projects/group/project/deployments":
+			fmt.Fprint(w, `[]`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	gitlabClient, err := gl.NewClient("test", gl.WithBaseURL(server.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &Cron{
+		Cron: robfigcron.New(),
+		JobsContainer: JobsContainer{
+			jobs: map[string]robfigcron.EntryID{},
+		},
+	}
+
+	AddJob(Job{Cron: c, Gitlab: gitlabClient, Key: "group/project/1", ToID: 1, Project: "group/project", PipelineID: 1, Status: "running"})
+
+	j := c.GetJob("group/project/1")
+
+	if err := j.updatePipeline(&gl.Pipeline{ID: 1, ProjectID: 1, Status: "manual"}); err != nil {
+		t.Fatalf("updatePipeline() error = %v", err)
+	}
+
+	if c.GetJob("group/project/1") == nil {
+		t.Fatal("updatePipeline() removed watch of manual pipeline")
+	}
+
+	if j.Status != "manual" || jobsRequests != 1 {
+		t.Errorf("updatePipeline() status = %s, jobs requests = %d, want manual and 1", j.Status, jobsRequests)
+	}
+}
+
+func TestJob_updatePipeline(t *testing.T) {
+	tests := []struct {
+		name        string
+		mode        string
+		final       string
+		wantSent    []string
+		wantEdited  int
+		wantDeleted []int
+	}{
+		{
+			name:       "final mode failed",
+			mode:       ModeFinal,
+			final:      "failed",
+			wantSent:   []string{"**pipeline status changed**"},
+			wantEdited: 3,
+		},
+		{
+			name:       "final mode success",
+			mode:       ModeFinal,
+			final:      "success",
+			wantSent:   []string{"**pipeline status changed**"},
+			wantEdited: 3,
+		},
+		{
+			name:        "transitions mode failed",
+			mode:        ModeTransitions,
+			final:       "failed",
+			wantSent:    []string{"**pipeline status**", "**pipeline status**", "**pipeline status changed**"},
+			wantEdited:  1,
+			wantDeleted: []int{100, 1},
+		},
+		{
+			name:        "transitions mode success",
+			mode:        ModeTransitions,
+			final:       "success",
+			wantSent:    []string{"**pipeline status**", "**pipeline status**", "**pipeline status changed**"},
+			wantEdited:  1,
+			wantDeleted: []int{100, 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+
+				switch r.URL.Path {
+				case "/api/v4/projects/group/project/pipelines/1/jobs":
+					fmt.Fprint(w, `[]`)
+				default:
+					http.NotFound(w, r)
+				}
+			}))
+			defer server.Close()
+
+			gitlabClient, err := gl.NewClient("test", gl.WithBaseURL(server.URL))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ts, b := newTelegramServer(t)
+
+			c := &Cron{
+				Cron: robfigcron.New(),
+				Conf: config.NewShared(&config.Config{}),
+				JobsContainer: JobsContainer{
+					jobs: map[string]robfigcron.EntryID{},
+				},
+			}
+
+			// live message is sent by the command which starts the watch
+			AddJob(Job{Cron: c, Bot: b, Gitlab: gitlabClient, Key: "group/project/1", ToID: 1, Project: "group/project", PipelineID: 1, Status: "created", Mode: tt.mode, MessageID: 100})
+
+			j := c.GetJob("group/project/1")
+
+			for _, status := range []string{"pending", "running", tt.final} {
+				if c.GetJob(j.Key) == nil {
+					t.Fatalf("updatePipeline() removed watch before %s", status)
+				}
+
+				if err := j.updatePipeline(&gl.Pipeline{ID: 1, ProjectID: 1, Status: status}); err != nil {
+					t.Fatalf("updatePipeline(%s) error = %v", status, err)
+				}
+
+				if j.Status != status {
+					t.Errorf("updatePipeline(%s) status = %s", status, j.Status)
+				}
+			}
+
+			if c.GetJob(j.Key) != nil {
+				t.Errorf("updatePipeline(%s) kept watch of finished pipeline", tt.final)
+			}
+
+			var sent []string
+			for _, message := range ts.messages() {
+				sent = append(sent, strings.SplitN(message, "\n", 2)[0])
+			}
+
+			if diff := cmp.Diff(tt.wantSent, sent); diff != "" {
+				t.Errorf("updatePipeline() sent messages mismatch (-want +got):\n%s", diff)
+			}
+
+			if diff := cmp.Diff(tt.wantDeleted, ts.deleted); diff != "" {
+				t.Errorf("updatePipeline() deleted messages mismatch (-want +got):\n%s", diff)
+			}
+
+			if len(ts.edited) != tt.wantEdited {
+				t.Errorf("updatePipeline() edited %d messages, want %d", len(ts.edited), tt.wantEdited)
+			}
+		})
+	}
+}
+
+func TestJob_sendJobLog(t *testing.T) {
+	// trace of gitlab runner with collapsible sections, colours and progress rewritten with carriage return
+	trace := "section_start:1700000000:prepare_script\r\x1b[0K\x1b[36;1mPreparing environment\x1b[0;m\n" +
+		"section_end:1700000000:prepare_script\r\x1b[0K\n" +
+		"$ make test\n" +
+		"download 10%\rdownload 100%\n" +
+		"\x1b[31;1m--- FAIL: TestSomething\x1b[0;m\n" +
+		"expected `1`, got `2`\n" +
+		"ERROR: Job failed: exit code 1\n"
+
+	tests := []struct {
+		name          string
+		lines         int
+		asFile        bool
+		trace         string
+		wantRequests  int
+		wantSent      []string
+		wantDocuments []string
+	}{
+		{
+			name:         "tail of trace",
+			lines:        3,
+			trace:        trace,
+			wantRequests: 1,
+			wantSent:     []string{"**log of job test (5)**\n```\n--- FAIL: TestSomething\nexpected \\`1\\`, got \\`2\\`\nERROR: Job failed: exit code 1\n```"},
+		},
+		{
+			name:         "whole trace",
+			lines:        30,
+			trace:        trace,
+			wantRequests: 1,
+			wantSent:     []string{"**log of job test (5)**\n```\nPreparing environment\n\n$ make test\ndownload 100%\n--- FAIL: TestSomething\nexpected \\`1\\`, got \\`2\\`\nERROR: Job failed: exit code 1\n```"},
+		},
+		{
+			name:          "as file",
+			lines:         2,
+			asFile:        true,
+			trace:         trace,
+			wantRequests:  1,
+			wantDocuments: []string{"expected `1`, got `2`\nERROR: Job failed: exit code 1"},
+		},
+		{
+			name:  "disabled",
+			lines: -1,
+			trace: trace,
+		},
+		{
+			name:         "empty trace",
+			lines:        30,
+			wantRequests: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requests := 0
+
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/api/v4/projects/group/project/jobs/5/trace" {
+					http.NotFound(w, r)
+
+					return
+				}
+
+				requests++
+
+				fmt.Fprint(w, tt.trace)
+			}))
+			defer server.Close()
+
+			gitlabClient, err := gl.NewClient("test", gl.WithBaseURL(server.URL))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ts, b := newTelegramServer(t)
+
+			j := &Job{
+				Cron:    &Cron{Conf: config.NewShared(&config.Config{FailedJobLogLines: tt.lines, FailedJobLogAsFile: tt.asFile})},
+				Bot:     b,
+				Gitlab:  gitlabClient,
+				ToID:    1,
+				Project: "group/project",
+			}
+
+			j.sendJobLog(context.Background(), &gl.Job{ID: 5, Name: "test", Status: "failed"})
+
+			if requests != tt.wantRequests {
+				t.Errorf("sendJobLog() trace requests = %d, want %d", requests, tt.wantRequests)
+			}
+
+			if diff := cmp.Diff(tt.wantSent, ts.messages()); diff != "" {
+				t.Errorf("sendJobLog() sent messages mismatch (-want +got):\n%s", diff)
+			}
+
+			if diff := cmp.Diff(tt.wantDocuments, ts.documents); diff != "" {
+				t.Errorf("sendJobLog() sent documents mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestJob_matchPipeline(t *testing.T) {
+	tests := []struct {
+		name     string
+		job      *Job
+		pipeline *gl.Pipeline
+		want     bool
+	}{
+		{
+			name:     "no filters",
+			job:      &Job{},
+			pipeline: &gl.Pipeline{Ref: "main", Status: "success"},
+			want:     true,
+		},
+		{
+			name:     "excluded ref",
+			job:      &Job{Refs: []string{"!renovate/*"}},
+			pipeline: &gl.Pipeline{Ref: "renovate/go", Status: "success"},
+		},
+		{
+			name:     "included ref and source",
+			job:      &Job{Refs: []string{"main", "release/*"}, Sources: []string{"push"}},
+			pipeline: &gl.Pipeline{Ref: "release/1.0", Source: "push", Status: "success"},
+			want:     true,
+		},
+		{
+			name:     "other source",
+			job:      &Job{Sources: []string{"schedule"}},
+			pipeline: &gl.Pipeline{Ref: "main", Source: "push", Status: "success"},
+		},
+		{
+			name:     "subscription branch",
+			job:      &Job{Branch: "main"},
+			pipeline: &gl.Pipeline{Ref: "develop", Status: "success"},
+		},
+		{
+			name:     "status",
+			job:      &Job{Statuses: []string{"failed", "canceled"}},
+			pipeline: &gl.Pipeline{Ref: "main", Status: "canceled"},
+			want:     true,
+		},
+		{
+			name:     "other status",
+			job:      &Job{Statuses: []string{"failed"}},
+			pipeline: &gl.Pipeline{Ref: "main", Status: "running"},
+		},
+		{
+			name:     "only failures",
+			job:      &Job{OnlyFailures: true},
+			pipeline: &gl.Pipeline{Ref: "main", Status: "success"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.job.matchPipeline(tt.pipeline.Ref, tt.pipeline.Source, tt.pipeline.Status); got != tt.want {
+				t.Errorf("matchPipeline() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCron_RestoreJobs(t *testing.T) {
+	s := store.NewMemoryStore()
+	_ = s.Save("group/project/1", json.RawMessage(`{"key":"group/project/1","to_id":1,"status":"running","project":"group/project","count":100,"pipeline_id":1}`))
+	_ = s.Save("TrackPipelines/group/old", json.RawMessage(`{"key":"TrackPipelines/group/old","to_id":1,"project":"group/old"}`))
+	_ = s.Save("broken", json.RawMessage(`test`))
+
+	c := &Cron{
+		Cron:  robfigcron.New(),
+		Conf:  config.NewShared(&config.Config{}),
+		Store: s,
+		JobsContainer: JobsContainer{
+			jobs: map[string]robfigcron.EntryID{},
+		},
+	}
+
+	c.RestoreJobs(nil)
+
+	job := c.GetJob("group/project/1")
+	if job == nil {
+		t.Fatal("RestoreJobs() job not restored")
+	}
+
+	if job.Count != 100 || job.Status != "running" || job.Cron != c {
+		t.Errorf("RestoreJobs() job = %#v", job)
+	}
+
+	if c.GetJob("TrackPipelines/group/old") != nil {
+		t.Error("RestoreJobs() restored job for untracked project")
+	}
+
+	records, _ := s.Load()
+	if len(records) != 1 {
+		t.Errorf("RestoreJobs() store records = %d, want 1", len(records))
+	}
+}
+
+func TestCron_TrackPipelines(t *testing.T) {
+	s := store.NewMemoryStore()
+	_ = s.Save("TrackPipelines/1/group/project", json.RawMessage(`{"key":"TrackPipelines/1/group/project","to_id":1,"project":"group/project","last_updated":"2024-01-01T10:00:00Z","refs":["main"]}`))
+
+	c := &Cron{
+		Cron: robfigcron.New(),
+		Conf: config.NewShared(&config.Config{
+			NotifyTelegramID: "1",
+			Projects: []config.TrackProject{
+				{Project: "group/project", Refs: []string{"main", "release/*"}, Interval: "1m"},
+				{Project: "group/other", Chats: []int64{2, 3}},
+				{Project: "group/team", Notifiers: []string{"team"}},
+			},
+		}),
+		Store: s,
+		JobsContainer: JobsContainer{
+			jobs: map[string]robfigcron.EntryID{},
+		},
+	}
+
+	c.RestoreJobs(nil)
+	c.TrackPipelines(nil)
+
+	keys := []string{"TrackPipelines/1/group/project", "TrackPipelines/2/group/other", "TrackPipelines/3/group/other", "TrackPipelines/0/group/team"}
+	for _, key := range keys {
+		if c.GetJob(key) == nil {
+			t.Errorf("TrackPipelines() job %s not added", key)
+		}
+	}
+
+	if got := len(c.Jobs()); got != len(keys) {
+		t.Errorf("TrackPipelines() jobs = %d, want %d", got, len(keys))
+	}
+
+	job := c.GetJob("TrackPipelines/1/group/project")
+	if job == nil {
+		t.Fatal("TrackPipelines() restored job not found")
+	}
+
+	if len(job.Refs) != 2 || job.Interval != "1m" || job.LastUpdated.IsZero() {
+		t.Errorf("TrackPipelines() restored job = %#v, want new rules and old cursor", job)
+	}
+
+	if job := c.GetJob("TrackPipelines/0/group/team"); job == nil || len(job.Notifiers) != 1 {
+		t.Errorf("TrackPipelines() notifiers job = %#v", job)
+	}
+}
+
+func TestJob_notifyExternal(t *testing.T) {
+	var texts []string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload struct {
+			Text string `json:"text"`
+		}
+
+		_ = json.NewDecoder(r.Body).Decode(&payload)
+
+		texts = append(texts, r.URL.Path+" "+payload.Text)
+	}))
+	defer server.Close()
+
+	c := &Cron{
+		Conf: config.NewShared(&config.Config{
+			Notifiers: []config.Notifier{
+				{Name: "team", Type: "mattermost", URL: server.URL + "/team"},
+				{Name: "hook", Type: "webhook", URL: server.URL + "/hook"},
+			},
+		}),
+	}
+
+	j := &Job{Cron: c, Key: "TrackPipelines/0/group/project", Project: "group/project", Notifiers: []string{"team", "removed", "hook"}}
+	j.notifyExternal(context.Background(), notify.Message{Type: notificationProject, Text: "test"})
+
+	want := []string{"/team test", "/hook test"}
+	if diff := cmp.Diff(want, texts); diff != "" {
+		t.Errorf("notifyExternal() mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestCron_Reload(t *testing.T) {
+	c := &Cron{
+		Cron: robfigcron.New(),
+		Conf: config.NewShared(&config.Config{
+			NotifyTelegramID: "1",
+			AllowedIDsList:   []string{"1"},
+			Projects: []config.TrackProject{
+				{Project: "group/removed"},
+				{Project: "group/kept"},
+			},
+		}),
+		JobsContainer: JobsContainer{
+			jobs: map[string]robfigcron.EntryID{},
+		},
+	}
+
+	conf := c.Conf
+
+	c.TrackPipelines(nil)
+
+	AddJob(Job{Cron: c, Key: "group/project/1", ToID: 1, Project: "group/project", PipelineID: 1})
+	AddJob(Job{Cron: c, Key: "Subscription/1/group/removed/", ToID: 1, Project: "group/removed", Subscription: true})
+
+	c.Reload(&config.Config{
+		NotifyTelegramID: "1",
+		AllowedIDsList:   []string{"1", "2"},
+		Projects: []config.TrackProject{
+			{Project: "group/kept"},
+			{Project: "group/added", Chats: []int64{2}},
+		},
+	}, nil)
+
+	if c.Conf != conf || len(conf.Load().AllowedIDsList) != 2 {
+		t.Errorf("Reload() config not published: %#v", c.Conf.Load())
+	}
+
+	for _, key := range []string{"TrackPipelines/1/group/kept", "TrackPipelines/2/group/added", "group/project/1", "Subscription/1/group/removed/"} {
+		if c.GetJob(key) == nil {
+			t.Errorf("Reload() job %s not found", key)
+		}
+	}
+
+	if c.GetJob("TrackPipelines/1/group/removed") != nil {
+		t.Error("Reload() job of removed project is kept")
+	}
+}
+
+func TestPoller_Flush(t *testing.T) {
+	var requests []string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.URL.Path)
+
+		w.Header().Set("Content-Type", "application/json")
+
+		switch r.URL.Path {
+		case "/api/v4/projects/group/project/pipelines":
+			fmt.Fprint(w, `[{"id":1,"status":"success","updated_at":"2024-01-01T10:05:00Z"},{"id":2,"status":"running","updated_at":"2024-01-01T10:00:00Z"}]`)
+		case "/api/v4/projects/group/project/pipelines/1":
+			fmt.Fprint(w, `{"id":1,"status":"success","updated_at":"2024-01-01T10:05:00Z"}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	gitlabClient, err := gl.NewClient("test", gl.WithBaseURL(server.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &Cron{
+		Cron:   robfigcron.New(),
+		Poller: NewPoller(2),
+		JobsContainer: JobsContainer{
+			jobs: map[string]robfigcron.EntryID{},
+		},
+	}
+
+	updatedAt, _ := time.Parse(time.RFC3339, "2024-01-01T10:00:00Z")
+
+	watches := []Job{
+		{Key: "group/project/1/1", ToID: 1, PipelineID: 1},
+		{Key: "group/project/1/2", ToID: 2, PipelineID: 1},
+		{Key: "group/project/2/1", ToID: 1, PipelineID: 2},
+	}
+	for _, watch := range watches {
+		watch.Cron = c
+		watch.Gitlab = gitlabClient
+		watch.Project = "group/project"
+		watch.Status = "running"
+		watch.PipelineUpdatedAt = updatedAt
+
+		AddJob(watch)
+		c.GetJob(watch.Key).Exec()
+	}
+
+	c.Poller.Flush()
+
+	// one list request for project and one request for updated pipeline watched from two chats
+	if diff := cmp.Diff([]string{"/api/v4/projects/group/project/pipelines", "/api/v4/projects/group/project/pipelines/1"}, requests); diff != "" {
+		t.Error(diff)
+	}
+
+	if stats := c.Poller.Stats(); stats.Polls != 3 || stats.Requests != 2 || stats.Saved() != 1 {
+		t.Errorf("Stats() = %#v", stats)
+	}
+
+	if c.GetJob("group/project/1/1") != nil || c.GetJob("group/project/1/2") != nil {
+		t.Error("Flush() finished pipeline watches are not removed")
+	}
+
+	if c.GetJob("group/project/2/1") == nil {
+		t.Error("Flush() unchanged pipeline watch is removed")
+	}
+}
+
+func TestCron_JobCounts(t *testing.T) {
+	c := &Cron{
+		Cron: robfigcron.New(),
+		Conf: config.NewShared(&config.Config{}),
+		JobsContainer: JobsContainer{
+			jobs: map[string]robfigcron.EntryID{},
+		},
+	}
+
+	AddJob(Job{Cron: c, Key: "group/project/1", ToID: 1, Project: "group/project", PipelineID: 1})
+	AddJob(Job{Cron: c, Key: "group/project/2", ToID: 1, Project: "group/project", PipelineID: 2, Paused: true})
+	AddJob(Job{Cron: c, Key: "MergeRequest/1/group/project/3", ToID: 1, Project: "group/project", MergeRequestIID: 3})
+	AddJob(Job{Cron: c, Key: "Subscription/1/group/project/", ToID: 1, Project: "group/project", Subscription: true})
+	AddJob(Job{Cron: c, Key: "TrackPipelines/1/group/project", ToID: 1, Project: "group/project"})
+
+	want := map[string]float64{
+		"pipeline":      1,
+		"merge_request": 1,
+		"subscription":  1,
+		"project":       1,
+		"paused":        1,
+	}
+
+	if diff := cmp.Diff(want, c.JobCounts()); diff != "" {
+		t.Errorf("JobCounts() mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestJob_threadID(t *testing.T) {
+	j := &Job{ToID: -100, ThreadID: 7}
+
+	if got := j.threadID(-100); got != 7 {
+		t.Errorf("threadID() = %d, want 7", got)
+	}
+
+	if got := j.threadID(1); got != 0 {
+		t.Errorf("threadID() of other chat = %d, want 0", got)
+	}
+}
+
+func TestJob_pipelineUser(t *testing.T) {
+	c := &Cron{Conf: config.NewShared(&config.Config{GitlabUsername: "bot", GitlabTrackOnlySelf: true})}
+
+	tests := []struct {
+		name string
+		job  *Job
+		want string
+	}{
+		{"config track", &Job{Cron: c}, "bot"},
+		{"config track of all users", &Job{Cron: &Cron{Conf: config.NewShared(&config.Config{GitlabUsername: "bot"})}}, ""},
+		{"subscription", &Job{Cron: c, Subscription: true}, ""},
+		{"subscription of user", &Job{Cron: c, Subscription: true, Username: "user"}, "user"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.job.pipelineUser(); got != tt.want {
+				t.Errorf("pipelineUser() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestJob_tick(t *testing.T) {
+	c := &Cron{
+		Cron: robfigcron.New(),
+		Conf: config.NewShared(&config.Config{WatchTimeout: "1h"}),
+		JobsContainer: JobsContainer{
+			jobs: map[string]robfigcron.EntryID{},
+		},
+	}
+
+	AddJob(Job{Cron: c, Key: "group/project/1", ToID: 1, Project: "group/project", PipelineID: 1, Status: "running"})
+
+	j := c.GetJob("group/project/1")
+	now := time.Now()
+
+	if j.tick(now) || j.Elapsed != 0 {
+		t.Fatalf("tick() first tick counted: %s", j.Elapsed)
+	}
+
+	now = now.Add(40 * time.Minute)
+	if j.tick(now) || j.Elapsed != 40*time.Minute || j.Warned {
+		t.Fatalf("tick() job = %#v", j)
+	}
+
+	// manual pipeline waits for user, this time is not counted
+	j.Status = "manual"
+	now = now.Add(3 * time.Hour)
+	if j.tick(now) || j.Elapsed != 40*time.Minute {
+		t.Fatalf("tick() counted manual status: %s", j.Elapsed)
+	}
+
+	j.Status = "running"
+	now = now.Add(10 * time.Minute)
+	if j.tick(now) || !j.Warned {
+		t.Fatalf("tick() not warned before timeout: %#v", j)
+	}
+
+	if extended := c.ExtendPipelineJobs(1, 1); extended != 1 || j.Elapsed != 0 || j.Warned {
+		t.Fatalf("ExtendPipelineJobs() = %d, job = %#v", extended, j)
+	}
+
+	now = now.Add(time.Hour)
+	if !j.tick(now) {
+		t.Error("tick() timeout is not reached")
+	}
+
+	j.Timeout = 4 * time.Hour
+	if j.tick(now) {
+		t.Error("tick() timeout of user is ignored")
+	}
+
+	// manual pipeline is not watched forever
+	j.Status = "manual"
+	now = now.Add(maxIdle)
+	if !j.tick(now) || j.Idle != maxIdle {
+		t.Errorf("tick() idle limit is not reached, idle = %s", j.Idle)
+	}
+
+	if extended := c.ExtendPipelineJobs(1, 1); extended != 1 || j.Idle != 0 {
+		t.Fatalf("ExtendPipelineJobs() = %d, job = %#v", extended, j)
+	}
+}
+
+func TestJob_Exec_concurrentUpdate(t *testing.T) {
+	c := &Cron{
+		Cron:   robfigcron.New(),
+		Conf:   config.NewShared(&config.Config{WatchTimeout: "1h"}),
+		Poller: NewPoller(1),
+		JobsContainer: JobsContainer{
+			jobs: map[string]robfigcron.EntryID{},
+		},
+	}
+
+	AddJob(Job{Cron: c, Key: "group/project/1", ToID: 1, Project: "group/project", PipelineID: 1, Status: "running"})
+
+	j := c.GetJob("group/project/1")
+
+	var wg sync.WaitGroup
+
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+
+		for i := 0; i < 100; i++ {
+			j.Exec()
+		}
+	}()
+
+	// webhook and poller update status while cron ticks
+	go func() {
+		defer wg.Done()
+
+		for i := 0; i < 100; i++ {
+			status := "running"
+			if i%2 == 0 {
+				status = "scheduled"
+			}
+
+			_ = j.updatePipeline(&gl.Pipeline{ID: 1, Status: status})
+		}
+	}()
+
+	wg.Wait()
+
+	if j.Count != 100 {
+		t.Errorf("Exec() Count = %d, want 100", j.Count)
+	}
+}
+
+func TestPoller_Flush_concurrentUpdate(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		switch r.URL.Path {
+		case "/api/v4/projects/group/project/pipelines":
+			fmt.Fprint(w, `[{"id":1,"status":"running","updated_at":"2024-01-01T10:00:00Z"}]`)
+		case "/api/v4/projects/group/project/pipelines/1":
+			fmt.Fprint(w, `{"id":1,"status":"running","updated_at":"2024-01-01T10:00:00Z"}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	gitlabClient, err := gl.NewClient("test", gl.WithBaseURL(server.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := &Cron{
+		Cron:   robfigcron.New(),
+		Conf:   config.NewShared(&config.Config{WatchTimeout: "1h"}),
+		Poller: NewPoller(1),
+		JobsContainer: JobsContainer{
+			jobs: map[string]robfigcron.EntryID{},
+		},
+	}
+
+	updatedAt, _ := time.Parse(time.RFC3339, "2024-01-01T09:00:00Z")
+
+	var jobs []*Job
+
+	for _, toID := range []int64{1, 2} {
+		key := fmt.Sprintf("Pipeline/%d/group/project/1", toID)
+
+		AddJob(Job{Cron: c, Gitlab: gitlabClient, Key: key, ToID: toID, Project: "group/project", PipelineID: 1, Status: "running", PipelineUpdatedAt: updatedAt})
+
+		jobs = append(jobs, c.GetJob(key))
+	}
+
+	done := make(chan struct{})
+
+	var wg sync.WaitGroup
+
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+
+			for _, j := range jobs {
+				j.Exec()
+			}
+		}
+	}()
+
+	// webhook updates the same jobs
+	go func() {
+		defer wg.Done()
+
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+
+			for _, j := range jobs {
+				_ = j.updatePipeline(&gl.Pipeline{ID: 1, Status: "running", UpdatedAt: &updatedAt})
+			}
+		}
+	}()
+
+	for i := 0; i < 5; i++ {
+		for _, j := range jobs {
+			c.Poller.Request(j)
+		}
+
+		c.Poller.Flush()
+	}
+
+	close(done)
+	wg.Wait()
+
+	for _, j := range jobs {
+		if c.GetJob(j.Key) != j || j.Failures != 0 {
+			t.Errorf("Flush() job = %#v", j)
+		}
+	}
+}
+
+// countingStore counts saved records
+type countingStore struct {
+	store.Store
+	saves int
+}
+
+func (s *countingStore) Save(key string, record json.RawMessage) error {
+	s.saves++
+
+	return s.Store.Save(key, record)
+}
+
+func TestJob_Exec_save(t *testing.T) {
+	s := &countingStore{Store: store.NewMemoryStore()}
+
+	c := &Cron{
+		Cron:   robfigcron.New(),
+		Conf:   config.NewShared(&config.Config{WatchTimeout: "1h"}),
+		Store:  s,
+		Poller: NewPoller(1),
+		JobsContainer: JobsContainer{
+			jobs: map[string]robfigcron.EntryID{},
+		},
+	}
+
+	AddJob(Job{Cron: c, Key: "group/project/1", ToID: 1, Project: "group/project", PipelineID: 1, Status: "running"})
+
+	j := c.GetJob("group/project/1")
+	saves := s.saves
+
+	for i := 0; i < 3; i++ {
+		j.Exec()
+	}
+
+	if s.saves != saves {
+		t.Fatalf("Exec() saved job %d times without changes", s.saves-saves)
+	}
+
+	// warning changes state of the watch
+	j.Elapsed = 50 * time.Minute
+	j.Exec()
+
+	if !j.Warned || s.saves != saves+1 {
+		t.Errorf("Exec() saves = %d, warned = %v, want job saved once after warning", s.saves-saves, j.Warned)
+	}
+}
+
+func Test_backoff(t *testing.T) {
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{failures: 1, want: 10 * time.Second},
+		{failures: 2, want: 20 * time.Second},
+		{failures: 4, want: 80 * time.Second},
+		{failures: 100, want: maxBackoff},
+	}
+	for _, tt := range tests {
+		if got := backoff(tt.failures); got != tt.want {
+			t.Errorf("backoff(%d) = %s, want %s", tt.failures, got, tt.want)
+		}
+	}
+}
+
+func TestJob_afterPoll(t *testing.T) {
+	c := &Cron{
+		Cron: robfigcron.New(),
+		JobsContainer: JobsContainer{
+			jobs: map[string]robfigcron.EntryID{},
+		},
+	}
+
+	AddJob(Job{Cron: c, Key: "group/project/1", ToID: 1, Project: "group/project", PipelineID: 1, Status: "pending"})
+
+	j := c.GetJob("group/project/1")
+	now := time.Now()
+
+	j.afterPoll(nil, now)
+
+	if !j.NextRun.Equal(now.Add(waitingInterval)) {
+		t.Errorf("afterPoll() NextRun = %s, want slow polling of pending pipeline", j.NextRun)
+	}
+
+	for i := 1; i < maxFailures; i++ {
+		j.afterPoll(fmt.Errorf("%s", "error"), now)
+	}
+
+	if j.Paused || j.Failures != maxFailures-1 || !j.NextRun.Equal(now.Add(backoff(maxFailures-1))) {
+		t.Errorf("afterPoll() job = %#v, want backoff", j)
+	}
+
+	j.afterPoll(fmt.Errorf("%s", "error"), now)
+
+	if !j.Paused {
+		t.Error("afterPoll() job is not paused")
+	}
+
+	if resumed := c.ResumeJobs(2); resumed != 0 {
+		t.Errorf("ResumeJobs() for other chat = %d, want 0", resumed)
+	}
+
+	if resumed := c.ResumeJobs(1); resumed != 1 || j.Paused || j.Failures != 0 {
+		t.Errorf("ResumeJobs() = %d, job = %#v", resumed, j)
+	}
+
+	RemoveJob(j)
+
+	j.afterPoll(fmt.Errorf("%s", "error"), now)
+
+	if j.Failures != 0 {
+		t.Error("afterPoll() changed removed job")
+	}
+}
+
+func TestJob_afterPoll_refused(t *testing.T) {
+	tests := []struct {
+		name        string
+		job         Job
+		status      int
+		wantRemoved bool
+		wantPaused  bool
+		wantSent    []string
+	}{
+		{
+			name:        "deleted pipeline",
+			job:         Job{Key: "group/project/1", PipelineID: 1},
+			status:      http.StatusNotFound,
+			wantRemoved: true,
+			wantSent:    []string{"**watch of pipeline 1 is stopped**"},
+		},
+		{
+			name:       "pipeline without access",
+			job:        Job{Key: "group/project/1", PipelineID: 1},
+			status:     http.StatusForbidden,
+			wantPaused: true,
+			wantSent:   []string{"**watch of pipeline 1 is paused**"},
+		},
+		{
+			name:       "merge request with revoked token",
+			job:        Job{Key: "MergeRequest/1/group/project/1", MergeRequestIID: 1},
+			status:     http.StatusUnauthorized,
+			wantPaused: true,
+			wantSent:   []string{"**watch of merge request 1 in group/project is paused**"},
+		},
+		{
+			name:       "deleted tracked project",
+			job:        Job{Key: "TrackPipelines/1/group/project"},
+			status:     http.StatusNotFound,
+			wantPaused: true,
+			wantSent:   []string{"**tracking of group/project is paused**"},
+		},
+		{
+			name:   "rate limit",
+			job:    Job{Key: "group/project/1", PipelineID: 1},
+			status: http.StatusTooManyRequests,
+		},
+		{
+			name:   "server error",
+			job:    Job{Key: "group/project/1", PipelineID: 1},
+			status: http.StatusBadGateway,
+		},
+		{
+			name: "network error",
+			job:  Job{Key: "group/project/1", PipelineID: 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+			}))
+			defer server.Close()
+
+			gitlabClient, err := gl.NewClient("test", gl.WithBaseURL(server.URL), gl.WithoutRetries())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.status == 0 {
+				server.Close()
+			}
+
+			ts, b := newTelegramServer(t)
+
+			c := &Cron{
+				Cron: robfigcron.New(),
+				Conf: config.NewShared(&config.Config{}),
+				JobsContainer: JobsContainer{
+					jobs: map[string]robfigcron.EntryID{},
+				},
+			}
+
+			job := tt.job
+			job.Cron, job.Bot, job.Gitlab = c, b, gitlabClient
+			job.ToID, job.Project, job.Status = 1, "group/project", "running"
+
+			AddJob(job)
+
+			j := c.GetJob(job.Key)
+			now := time.Now()
+
+			// refused request is reported once, the job is not polled again
+			for i := 0; i < 2 && c.GetJob(j.Key) != nil && !j.Paused; i++ {
+				j.afterPoll(j.poll(), now)
+			}
+
+			if removed := c.GetJob(j.Key) == nil; removed != tt.wantRemoved || j.Paused != tt.wantPaused {
+				t.Errorf("afterPoll() removed = %v, paused = %v, want %v and %v", removed, j.Paused, tt.wantRemoved, tt.wantPaused)
+			}
+
+			if !tt.wantRemoved && !tt.wantPaused && (j.Failures != 2 || !j.NextRun.Equal(now.Add(backoff(2)))) {
+				t.Errorf("afterPoll() failures = %d, next run = %s, want backoff", j.Failures, j.NextRun)
+			}
+
+			var sent []string
+			for _, message := range ts.messages() {
+				sent = append(sent, strings.SplitN(message, "\n", 2)[0])
+			}
+
+			if diff := cmp.Diff(tt.wantSent, sent); diff != "" {
+				t.Errorf("afterPoll() sent messages mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestJob_SendDocument(t *testing.T) {
+	type args struct {
+		toID int64
+		data []byte
+	}
+	tests := []struct {
+		name    string
+		bot     *bot.Bot
+		args    args
+		wantErr bool
+	}{
+		{
+			name:    "empty bot",
+			wantErr: true,
+		},
+		{
+			name:    "bad toID",
+			bot:     &bot.Bot{},
+			wantErr: true,
+		},
+		{
+			name: "empty document",
+			bot:  &bot.Bot{},
+			args: args{
+				toID: 1,
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			job := &Job{Bot: tt.bot}
+			if err := job.SendDocument(context.Background(), tt.args.toID, "test.log", tt.args.data, "test"); (err != nil) != tt.wantErr {
+				t.Errorf("Job.SendDocument() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestJob_EditMessage(t *testing.T) {
+	type args struct {
+		toID      int64
+		messageID int
+		message   string
+	}
+	tests := []struct {
+		name    string
+		bot     *bot.Bot
+		args    args
+		wantErr bool
+	}{
+		{
+			name:    "empty bot",
+			wantErr: true,
+		},
+		{
+			name: "empty message id",
+			bot:  &bot.Bot{},
+			args: args{
+				toID: 1,
+			},
+			wantErr: true,
+		},
+		{
+			name: "empty message",
+			bot:  &bot.Bot{},
+			args: args{
+				toID:      1,
+				messageID: 1,
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			job := &Job{Bot: tt.bot}
+			if err := job.EditMessage(context.Background(), tt.args.toID, tt.args.messageID, tt.args.message, nil); (err != nil) != tt.wantErr {
+				t.Errorf("Job.EditMessage() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// telegramServer is fake bot api, it records texts of sent and edited messages, ids of deleted ones
+// and contents of sent documents
+type telegramServer struct {
+	mu        sync.Mutex
+	lastID    int
+	sent      []string
+	edited    []string
+	deleted   []int
+	documents []string
+}
+
+func newTelegramServer(t *testing.T) (*telegramServer, *bot.Bot) {
+	t.Helper()
+
+	ts := &telegramServer{}
+
+	server := httptest.NewServer(http.HandlerFunc(ts.handle))
+	t.Cleanup(server.Close)
+
+	b, err := bot.New("test", bot.WithServerURL(server.URL), bot.WithSkipGetMe())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return ts, b
+}
+
+func (ts *telegramServer) handle(w http.ResponseWriter, r *http.Request) {
+	_ = r.ParseMultipartForm(1 << 20)
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+
+	switch path.Base(r.URL.Path) {
+	case "sendMessage":
+		ts.lastID++
+		ts.sent = append(ts.sent, r.FormValue("text"))
+
+		fmt.Fprintf(w, `{"ok":true,"result":{"message_id":%d,"chat":{"id":1}}}`, ts.lastID)
+	case "editMessageText":
+		ts.edited = append(ts.edited, r.FormValue("text"))
+
+		fmt.Fprintf(w, `{"ok":true,"result":{"message_id":%s,"chat":{"id":1}}}`, r.FormValue("message_id"))
+	case "sendDocument":
+		ts.lastID++
+
+		if file, _, err := r.FormFile("document"); err == nil {
+			data, _ := io.ReadAll(file)
+			ts.documents = append(ts.documents, string(data))
+		}
+
+		fmt.Fprintf(w, `{"ok":true,"result":{"message_id":%d,"chat":{"id":1}}}`, ts.lastID)
+	case "deleteMessage":
+		id, _ := strconv.Atoi(r.FormValue("message_id"))
+		ts.deleted = append(ts.deleted, id)
+
+		fmt.Fprint(w, `{"ok":true,"result":true}`)
+	default:
+		fmt.Fprint(w, `{"ok":true,"result":true}`)
+	}
+}
+
+func (ts *telegramServer) messages() []string {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	return append([]string(nil), ts.sent...)
+}
+
+func TestProcessMergeRequestUpdate(t *testing.T) {
+	tests := []struct {
+		name         string
+		mergeRequest string
+		approvals    string
+		want         string
+		wantRemoved  bool
+	}{
+		{
+			name:         "no changes",
+			mergeRequest: `{"iid":1,"state":"opened","user_notes_count":1,"head_pipeline":{"id":5,"status":"running"}}`,
+		},
+		{
+			name:         "approved",
+			mergeRequest: `{"iid":1,"state":"opened","user_notes_count":1,"head_pipeline":{"id":5,"status":"running"}}`,
+			approvals:    `{"approved_by":[{"user":{"username":"alice"}},{"user":null}]}`,
+			want:         "👍 approved by alice\n",
+		},
+		{
+			name:         "new notes",
+			mergeRequest: `{"iid":1,"state":"opened","user_notes_count":3,"head_pipeline":{"id":5,"status":"running"}}`,
+			want:         "💬 2 new comment(s)\nalice: first\nbob: looks good\n",
+		},
+		{
+			name:         "head pipeline failed",
+			mergeRequest: `{"iid":1,"state":"opened","user_notes_count":1,"head_pipeline":{"id":5,"status":"failed"}}`,
+			want:         "❌ pipeline failed\n",
+		},
+		{
+			name:         "running head pipeline is not reported",
+			mergeRequest: `{"iid":1,"state":"opened","user_notes_count":1,"head_pipeline":{"id":6,"status":"running"}}`,
+		},
+		{
+			name:         "merged",
+			mergeRequest: `{"iid":1,"state":"merged","user_notes_count":1,"merged_by":{"username":"carol"},"head_pipeline":{"id":5,"status":"running"}}`,
+			want:         "🔀 merged by carol\n",
+			wantRemoved:  true,
+		},
+		{
+			name:         "closed",
+			mergeRequest: `{"iid":1,"state":"closed","user_notes_count":1,"closed_by":{"username":"dave"},"head_pipeline":{"id":5,"status":"running"}}`,
+			want:         "🚫 closed by dave\n",
+			wantRemoved:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+
+				switch r.URL.Path {
+				case "/api/v4/projects/group/project/merge_requests/1":
+					fmt.Fprint(w, tt.mergeRequest)
+				case "/api/v4/projects/group/project/merge_requests/1/approvals":
+					if tt.approvals == "" {
+						fmt.Fprint(w, `{"approved_by":[]}`)
+					} else {
+						fmt.Fprint(w, tt.approvals)
+					}
+				case "/api/v4/projects/group/project/merge_requests/1/notes":
+					// newest notes go first, system notes are skipped
+					fmt.Fprint(w, `[
+						{"id":4,"body":"looks good","author":{"username":"bob"}},
+						{"id":3,"body":"added 1 commit","system":true,"author":{"username":"bob"}},
+						{"id":2,"body":"first","author":{"username":"alice"}}
+					]`)
+				default:
+					http.NotFound(w, r)
+				}
+			}))
+			defer server.Close()
+
+			gitlabClient, err := gl.NewClient("test", gl.WithBaseURL(server.URL))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ts, b := newTelegramServer(t)
+
+			c := &Cron{
+				Cron: robfigcron.New(),
+				JobsContainer: JobsContainer{
+					jobs: map[string]robfigcron.EntryID{},
+				},
+			}
+
+			AddJob(Job{
+				Cron:               c,
+				Bot:                b,
+				Gitlab:             gitlabClient,
+				Key:                "MergeRequest/1/group/project/1",
+				ToID:               1,
+				Project:            "group/project",
+				MergeRequestIID:    1,
+				Status:             "opened",
+				Notes:              1,
+				HeadPipelineID:     5,
+				HeadPipelineStatus: "running",
+			})
+
+			j := c.GetJob("MergeRequest/1/group/project/1")
+
+			// every event is reported once, the second update sees the same merge request
+			for i := 0; i < 2; i++ {
+				if err := ProcessMergeRequestUpdate(j); err != nil {
+					t.Fatalf("ProcessMergeRequestUpdate() error = %v", err)
+				}
+			}
+
+			messages := ts.messages()
+
+			switch {
+			case tt.want == "" && len(messages) != 0:
+				t.Errorf("ProcessMergeRequestUpdate() sent %q, want nothing", messages)
+			case tt.want != "" && len(messages) != 1:
+				t.Errorf("ProcessMergeRequestUpdate() sent %q, want one message", messages)
+			case tt.want != "" && !strings.HasPrefix(messages[0], "**merge request updated**\n"+tt.want):
+				t.Errorf("ProcessMergeRequestUpdate() message = %q, want events %q", messages[0], tt.want)
+			}
+
+			if removed := c.GetJob(j.Key) == nil; removed != tt.wantRemoved {
+				t.Errorf("ProcessMergeRequestUpdate() removed = %v, want %v", removed, tt.wantRemoved)
+			}
+		})
+	}
+}
@@ -0,0 +1,233 @@
+package cron
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ad/gitlab-pipelines-notifier/recovery"
+
+	gl "github.com/xanzy/go-gitlab"
+)
+
+// DefaultPollerConcurrency is count of projects polled at the same time
+const DefaultPollerConcurrency = 4
+
+// maxListedPipelines is page size of pipelines list, if it is full, pipelines are requested one by one
+const maxListedPipelines = 100
+
+// statsLogEvery is count of flushes between stats log lines, about an hour with 10s interval
+const statsLogEvery = 360
+
+// Poller polls watched pipelines grouped by project, one pipelines list request per project shows
+// which pipelines were updated, only they are requested again and fanned out to all their watches
+type Poller struct {
+	mu          sync.Mutex
+	pending     map[string]*Job
+	concurrency int
+
+	flushes  atomic.Int64
+	polls    atomic.Int64
+	requests atomic.Int64
+}
+
+// PollerStats shows how many pipeline polls were served and how many gitlab requests they took,
+// without batching every poll is at least one request
+type PollerStats struct {
+	Polls    int64
+	Requests int64
+}
+
+// Saved returns count of requests saved by batching
+func (s PollerStats) Saved() int64 {
+	if s.Polls < s.Requests {
+		return 0
+	}
+
+	return s.Polls - s.Requests
+}
+
+func NewPoller(concurrency int) *Poller {
+	if concurrency <= 0 {
+		concurrency = DefaultPollerConcurrency
+	}
+
+	return &Poller{
+		pending:     make(map[string]*Job),
+		concurrency: concurrency,
+	}
+}
+
+// Request schedules job for the next flush
+func (p *Poller) Request(j *Job) {
+	p.mu.Lock()
+	p.pending[j.Key] = j
+	p.mu.Unlock()
+}
+
+// Stats returns polls and requests counters
+func (p *Poller) Stats() PollerStats {
+	return PollerStats{
+		Polls:    p.polls.Load(),
+		Requests: p.requests.Load(),
+	}
+}
+
+// Flush polls all requested jobs, projects are polled concurrently with bounded concurrency
+func (p *Poller) Flush() {
+	p.mu.Lock()
+	pending := p.pending
+	p.pending = make(map[string]*Job)
+	p.mu.Unlock()
+
+	byProject := make(map[string][]*Job)
+	for _, j := range pending {
+		byProject[j.Project] = append(byProject[j.Project], j)
+	}
+
+	semaphore := make(chan struct{}, p.concurrency)
+
+	var wg sync.WaitGroup
+
+	for _, jobs := range byProject {
+		wg.Add(1)
+		semaphore <- struct{}{}
+
+		go func(jobs []*Job) {
+			defer func() {
+				<-semaphore
+				wg.Done()
+			}()
+			defer recovery.Recovery()
+
+			p.pollProject(jobs)
+		}(jobs)
+	}
+
+	wg.Wait()
+
+	if p.flushes.Add(1)%statsLogEvery == 0 {
+		stats := p.Stats()
+		log.Printf("poller: %d pipeline polls took %d requests, %d saved", stats.Polls, stats.Requests, stats.Saved())
+	}
+}
+
+func (p *Poller) pollProject(jobs []*Job) {
+	now := time.Now()
+
+	p.polls.Add(int64(len(jobs)))
+
+	// state of jobs is changed by webhook and cron ticks, it is copied under their locks
+	states := make([]pipelineState, len(jobs))
+	for i, j := range jobs {
+		states[i] = j.pipelineState()
+	}
+
+	updatedAfter, ok := oldestUpdate(states)
+	if !ok || len(jobs) == 1 {
+		p.pollEach(jobs, now)
+
+		return
+	}
+
+	orderBy, sort := "updated_at", "desc"
+
+	updatedAfter = updatedAfter.Add(-cursorOverlap)
+
+	p.requests.Add(1)
+
+	pipelines, _, err := jobs[0].Gitlab.Pipelines.ListProjectPipelines(jobs[0].Project, &gl.ListProjectPipelinesOptions{
+		ListOptions:  gl.ListOptions{PerPage: maxListedPipelines},
+		UpdatedAfter: &updatedAfter,
+		OrderBy:      &orderBy,
+		Sort:         &sort,
+	})
+	if err != nil {
+		for _, j := range jobs {
+			j.afterPoll(err, now)
+		}
+
+		return
+	}
+
+	// some updates could be on the next page
+	if len(pipelines) >= maxListedPipelines {
+		p.pollEach(jobs, now)
+
+		return
+	}
+
+	updated := make(map[int]*gl.PipelineInfo, len(pipelines))
+	for _, pipeline := range pipelines {
+		updated[pipeline.ID] = pipeline
+	}
+
+	fetched := make(map[int]*gl.Pipeline)
+
+	for i, j := range jobs {
+		info, ok := updated[j.PipelineID]
+		if !ok || (info.Status == states[i].status && info.UpdatedAt != nil && info.UpdatedAt.Equal(states[i].updatedAt)) {
+			j.afterPoll(nil, now)
+
+			continue
+		}
+
+		// the same pipeline can be watched from several chats
+		pipeline, ok := fetched[j.PipelineID]
+		if !ok {
+			p.requests.Add(1)
+
+			pipeline, _, err = j.Gitlab.Pipelines.GetPipeline(j.Project, j.PipelineID)
+			if err != nil {
+				j.afterPoll(err, now)
+
+				continue
+			}
+
+			fetched[j.PipelineID] = pipeline
+		}
+
+		j.afterPoll(j.updatePipeline(pipeline), now)
+	}
+}
+
+// pollEach polls jobs one by one, it is used when there is nothing to batch
+func (p *Poller) pollEach(jobs []*Job, now time.Time) {
+	for _, j := range jobs {
+		p.requests.Add(1)
+
+		j.afterPoll(ProcessPipelineUpdate(j), now)
+	}
+}
+
+// pipelineState is status and update time of watched pipeline known to job
+type pipelineState struct {
+	status    string
+	updatedAt time.Time
+}
+
+func (j *Job) pipelineState() pipelineState {
+	unlock := j.Cron.lockJob(j.Key)
+	defer unlock()
+
+	return pipelineState{status: j.Status, updatedAt: j.PipelineUpdatedAt}
+}
+
+// oldestUpdate returns the oldest known update time of watched pipelines,
+// it is not found if some pipeline was not polled yet
+func oldestUpdate(states []pipelineState) (time.Time, bool) {
+	var oldest time.Time
+
+	for _, state := range states {
+		if state.updatedAt.IsZero() {
+			return time.Time{}, false
+		}
+
+		if oldest.IsZero() || state.updatedAt.Before(oldest) {
+			oldest = state.updatedAt
+		}
+	}
+
+	return oldest, true
+}
@@ -0,0 +1,105 @@
+package dedup
+
+import (
+	"container/list"
+	"strconv"
+	"sync"
+)
+
+// DefaultSize is enough for a few dozen busy projects, pipelines older than that are not updated anyway
+const DefaultSize = 1000
+
+// Cache remembers last notified status of pipelines per scope (tracking job),
+// least recently used pipelines are evicted when cache is full
+type Cache struct {
+	mu    sync.Mutex
+	size  int
+	items map[string]*list.Element
+	order *list.List
+}
+
+type entry struct {
+	key    string
+	status string
+}
+
+func New(size int) *Cache {
+	if size <= 0 {
+		size = DefaultSize
+	}
+
+	return &Cache{
+		size:  size,
+		items: make(map[string]*list.Element),
+		order: list.New(),
+	}
+}
+
+func cacheKey(scope string, pipelineID int) string {
+	return scope + "/" + strconv.Itoa(pipelineID)
+}
+
+// Changed remembers status of pipeline and reports whether it differs from previous one,
+// nil cache reports every status as changed
+func (c *Cache) Changed(scope string, pipelineID int, status string) bool {
+	if c == nil {
+		return true
+	}
+
+	key := cacheKey(scope, pipelineID)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.items[key]; ok {
+		c.order.MoveToFront(element)
+
+		e := element.Value.(*entry)
+		if e.status == status {
+			return false
+		}
+
+		e.status = status
+
+		return true
+	}
+
+	c.items[key] = c.order.PushFront(&entry{key: key, status: status})
+
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.items, oldest.Value.(*entry).key)
+	}
+
+	return true
+}
+
+// Status returns remembered status of pipeline
+func (c *Cache) Status(scope string, pipelineID int) (string, bool) {
+	if c == nil {
+		return "", false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.items[cacheKey(scope, pipelineID)]
+	if !ok {
+		return "", false
+	}
+
+	return element.Value.(*entry).status, true
+}
+
+// Len returns count of remembered pipelines
+func (c *Cache) Len() int {
+	if c == nil {
+		return 0
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.order.Len()
+}
@@ -0,0 +1,58 @@
+package dedup
+
+import (
+	"testing"
+)
+
+func TestCache_Changed(t *testing.T) {
+	c := New(2)
+
+	steps := []struct {
+		name       string
+		scope      string
+		pipelineID int
+		status     string
+		want       bool
+	}{
+		{name: "new pipeline", scope: "a", pipelineID: 1, status: "running", want: true},
+		{name: "same status", scope: "a", pipelineID: 1, status: "running", want: false},
+		{name: "status changed", scope: "a", pipelineID: 1, status: "success", want: true},
+		{name: "other scope", scope: "b", pipelineID: 1, status: "success", want: true},
+		{name: "evicts oldest", scope: "a", pipelineID: 2, status: "running", want: true},
+		{name: "evicted pipeline is new again", scope: "a", pipelineID: 1, status: "success", want: true},
+		{name: "recently used is kept", scope: "a", pipelineID: 2, status: "running", want: false},
+	}
+	for _, step := range steps {
+		if got := c.Changed(step.scope, step.pipelineID, step.status); got != step.want {
+			t.Fatalf("%s: Changed() = %v, want %v", step.name, got, step.want)
+		}
+	}
+
+	if got := c.Len(); got != 2 {
+		t.Errorf("Len() = %d, want 2", got)
+	}
+
+	if status, ok := c.Status("a", 2); !ok || status != "running" {
+		t.Errorf("Status() = %s, %v, want running, true", status, ok)
+	}
+
+	if _, ok := c.Status("b", 1); ok {
+		t.Errorf("Status() of evicted pipeline found")
+	}
+}
+
+func TestCache_Nil(t *testing.T) {
+	var c *Cache
+
+	if !c.Changed("a", 1, "running") {
+		t.Errorf("Changed() = false, want true")
+	}
+
+	if _, ok := c.Status("a", 1); ok {
+		t.Errorf("Status() found in nil cache")
+	}
+
+	if c.Len() != 0 {
+		t.Errorf("Len() = %d, want 0", c.Len())
+	}
+}
@@ -0,0 +1,186 @@
+package filter
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Sources are pipeline sources supported by gitlab
+var Sources = []string{
+	"push",
+	"web",
+	"trigger",
+	"schedule",
+	"api",
+	"external",
+	"pipeline",
+	"chat",
+	"webide",
+	"merge_request_event",
+	"external_pull_request_event",
+	"parent_pipeline",
+	"ondemand_dast_scan",
+	"ondemand_dast_validation",
+	"security_orchestration_policy",
+}
+
+// Filter selects pipelines of tracked project by ref and source.
+// Ref patterns are globs like release/* or regexps in slashes like /^feature-\d+$/,
+// pattern with ! prefix excludes matching refs, ex. !renovate/*.
+// Pipeline matches if its ref matches any include pattern (or there are none), no exclude pattern
+// and its source is one of Sources (or there are none)
+type Filter struct {
+	Refs    []string `json:"refs,omitempty"`
+	Sources []string `json:"sources,omitempty"`
+}
+
+// Split parses comma separated list, empty items are skipped
+func Split(s string) []string {
+	var items []string
+
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
+
+// Validate reports all wrong ref patterns and unknown sources
+func (f Filter) Validate() error {
+	var problems []string
+
+	for _, pattern := range f.Refs {
+		if _, err := compile(strings.TrimPrefix(pattern, "!")); err != nil {
+			problems = append(problems, fmt.Sprintf("wrong ref pattern %s: %s", pattern, err))
+		}
+	}
+
+	for _, source := range f.Sources {
+		if !isKnownSource(source) {
+			problems = append(problems, "unknown pipeline source "+source)
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("%s", strings.Join(problems, ", "))
+	}
+
+	return nil
+}
+
+// IsEmpty reports whether filter matches every pipeline
+func (f Filter) IsEmpty() bool {
+	return len(f.Refs) == 0 && len(f.Sources) == 0
+}
+
+// Match reports whether pipeline with ref and source passes filter
+func (f Filter) Match(ref, source string) bool {
+	if len(f.Sources) > 0 && !contains(f.Sources, source) {
+		return false
+	}
+
+	included, hasIncludes := false, false
+
+	for _, pattern := range f.Refs {
+		if exclude := strings.TrimPrefix(pattern, "!"); exclude != pattern {
+			if matchRef(exclude, ref) {
+				return false
+			}
+
+			continue
+		}
+
+		hasIncludes = true
+
+		if !included && matchRef(pattern, ref) {
+			included = true
+		}
+	}
+
+	return included || !hasIncludes
+}
+
+// Ref returns ref which can be passed to gitlab api, it is set only if filter
+// has single include pattern without wildcards and no exclude patterns
+func (f Filter) Ref() string {
+	if len(f.Refs) != 1 {
+		return ""
+	}
+
+	if ref := f.Refs[0]; !strings.HasPrefix(ref, "!") && !isRegexp(ref) && !strings.ContainsAny(ref, `*?[\`) {
+		return ref
+	}
+
+	return ""
+}
+
+// Source returns source which can be passed to gitlab api, it is set only if filter has single source
+func (f Filter) Source() string {
+	if len(f.Sources) != 1 {
+		return ""
+	}
+
+	return f.Sources[0]
+}
+
+func isKnownSource(source string) bool {
+	return contains(Sources, source)
+}
+
+func contains(items []string, item string) bool {
+	for _, i := range items {
+		if i == item {
+			return true
+		}
+	}
+
+	return false
+}
+
+func isRegexp(pattern string) bool {
+	return len(pattern) > 2 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/")
+}
+
+// compiled keeps regexps of patterns, filters are matched on every poll
+var compiled sync.Map
+
+func compile(pattern string) (*regexp.Regexp, error) {
+	if !isRegexp(pattern) {
+		_, err := path.Match(pattern, "")
+
+		return nil, err
+	}
+
+	if re, ok := compiled.Load(pattern); ok {
+		return re.(*regexp.Regexp), nil
+	}
+
+	re, err := regexp.Compile(pattern[1 : len(pattern)-1])
+	if err != nil {
+		return nil, err
+	}
+
+	compiled.Store(pattern, re)
+
+	return re, nil
+}
+
+func matchRef(pattern, ref string) bool {
+	if !isRegexp(pattern) {
+		matched, err := path.Match(pattern, ref)
+
+		return err == nil && matched
+	}
+
+	re, err := compile(pattern)
+	if err != nil {
+		return false
+	}
+
+	return re.MatchString(ref)
+}
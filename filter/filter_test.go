@@ -0,0 +1,160 @@
+package filter
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestSplit(t *testing.T) {
+	if diff := cmp.Diff([]string{"main", "release/*"}, Split(" main, ,release/* ")); diff != "" {
+		t.Error(diff)
+	}
+
+	if got := Split(""); got != nil {
+		t.Errorf("Split() = %v, want nil", got)
+	}
+}
+
+func TestFilter_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		filter  Filter
+		wantErr string
+	}{
+		{
+			name:   "empty",
+			filter: Filter{},
+		},
+		{
+			name:   "good",
+			filter: Filter{Refs: []string{"main", "release/*", "!renovate/*", `/^feature-\d+$/`}, Sources: []string{"push", "schedule"}},
+		},
+		{
+			name:    "all problems",
+			filter:  Filter{Refs: []string{"[", "/(/"}, Sources: []string{"push", "test"}},
+			wantErr: "wrong ref pattern [: syntax error in pattern, wrong ref pattern /(/: error parsing regexp: missing closing ): `(`, unknown pipeline source test",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.filter.Validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("Validate() error = %v", err)
+				}
+
+				return
+			}
+
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("Validate() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestFilter_Match(t *testing.T) {
+	tests := []struct {
+		name   string
+		filter Filter
+		ref    string
+		source string
+		want   bool
+	}{
+		{
+			name: "empty filter",
+			ref:  "main",
+			want: true,
+		},
+		{
+			name:   "exact ref",
+			filter: Filter{Refs: []string{"main"}},
+			ref:    "main",
+			want:   true,
+		},
+		{
+			name:   "other ref",
+			filter: Filter{Refs: []string{"main"}},
+			ref:    "develop",
+		},
+		{
+			name:   "glob",
+			filter: Filter{Refs: []string{"main", "release/*"}},
+			ref:    "release/1.0",
+			want:   true,
+		},
+		{
+			name:   "glob doesn't match nested path",
+			filter: Filter{Refs: []string{"release/*"}},
+			ref:    "release/1.0/hotfix",
+		},
+		{
+			name:   "only exclude",
+			filter: Filter{Refs: []string{"!renovate/*"}},
+			ref:    "main",
+			want:   true,
+		},
+		{
+			name:   "excluded",
+			filter: Filter{Refs: []string{"*", "!renovate/*"}},
+			ref:    "renovate/go",
+		},
+		{
+			name:   "regexp",
+			filter: Filter{Refs: []string{`/^feature-\d+$/`}},
+			ref:    "feature-12",
+			want:   true,
+		},
+		{
+			name:   "source",
+			filter: Filter{Sources: []string{"push", "schedule"}},
+			ref:    "main",
+			source: "schedule",
+			want:   true,
+		},
+		{
+			name:   "other source",
+			filter: Filter{Sources: []string{"push"}},
+			ref:    "main",
+			source: "merge_request_event",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.filter.Match(tt.ref, tt.source); got != tt.want {
+				t.Errorf("Match() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFilter_Ref(t *testing.T) {
+	tests := []struct {
+		name   string
+		filter Filter
+		want   string
+	}{
+		{name: "empty"},
+		{name: "single ref", filter: Filter{Refs: []string{"main"}}, want: "main"},
+		{name: "glob", filter: Filter{Refs: []string{"release/*"}}},
+		{name: "regexp", filter: Filter{Refs: []string{"/main/"}}},
+		{name: "exclude", filter: Filter{Refs: []string{"!main"}}},
+		{name: "several refs", filter: Filter{Refs: []string{"main", "develop"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.filter.Ref(); got != tt.want {
+				t.Errorf("Ref() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if got := (Filter{Sources: []string{"push"}}).Source(); got != "push" {
+		t.Errorf("Source() = %v, want push", got)
+	}
+
+	if got := (Filter{Sources: []string{"push", "web"}}).Source(); got != "" {
+		t.Errorf("Source() = %v, want empty", got)
+	}
+}
@@ -3,10 +3,19 @@ package gitlab
 import (
 	"crypto/tls"
 	"fmt"
+	"io"
+	"log"
 	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
 	"time"
 
 	"github.com/ad/gitlab-pipelines-notifier/config"
+	"github.com/ad/gitlab-pipelines-notifier/metrics"
 
 	gl "github.com/xanzy/go-gitlab"
 )
@@ -24,20 +33,457 @@ func InitGitlabClient(config *config.Config) (*gl.Client, error) {
 		return nil, fmt.Errorf("gitlab url is empty")
 	}
 
+	return newClient(config.GitlabURL, config.GitlabToken, Limits)
+}
+
+// NewUserClient creates client acting as owner of personal access token, users have own rate limits,
+// so they don't pause polling
+func NewUserClient(gitlabURL, token string) (*gl.Client, error) {
+	if token == "" {
+		return nil, fmt.Errorf("gitlab token is empty")
+	}
+
+	return newClient(gitlabURL, token, &RateLimit{})
+}
+
+func newClient(gitlabURL, token string, limit *RateLimit) (*gl.Client, error) {
 	transportConfig := &http.Transport{
 		TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, // ignore expired SSL certificates
 	}
 
 	httpClient := &http.Client{
-		Transport: transportConfig,
+		Transport: &rateLimitTransport{base: transportConfig, limit: limit},
+	}
+
+	return gl.NewClient(token, gl.WithBaseURL(gitlabURL), gl.WithHTTPClient(httpClient))
+}
+
+// rateLimitReserve is count of requests left for user commands when polling is paused
+const rateLimitReserve = 20
+
+// defaultRetryAfter is used when gitlab responds with 429 without Retry-After and RateLimit-Reset headers
+const defaultRetryAfter = time.Minute
+
+// Limits keeps rate limit state of gitlab client created with InitGitlabClient
+var Limits = &RateLimit{}
+
+// RateLimit keeps time until which polling should wait, it is set from RateLimit-Remaining,
+// RateLimit-Reset and Retry-After headers of gitlab responses
+type RateLimit struct {
+	mu    sync.Mutex
+	until time.Time
+}
+
+// Wait returns how long polling should wait because of rate limit
+func (r *RateLimit) Wait() time.Duration {
+	if r == nil {
+		return 0
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if wait := time.Until(r.until); wait > 0 {
+		return wait
+	}
+
+	return 0
+}
+
+func (r *RateLimit) observe(header http.Header, statusCode int, now time.Time) {
+	var until time.Time
+
+	reset := parseUnixTime(header.Get("RateLimit-Reset"))
+
+	switch {
+	case statusCode == http.StatusTooManyRequests:
+		until = now.Add(defaultRetryAfter)
+
+		if retryAfter, ok := parseRetryAfter(header.Get("Retry-After"), now); ok {
+			until = retryAfter
+		} else if !reset.IsZero() {
+			until = reset
+		}
+	case header.Get("RateLimit-Remaining") != "":
+		remaining, err := strconv.Atoi(header.Get("RateLimit-Remaining"))
+		if err != nil || remaining >= rateLimitReserve || reset.IsZero() {
+			return
+		}
+
+		until = reset
+	default:
+		return
+	}
+
+	r.mu.Lock()
+	if until.After(r.until) {
+		r.until = until
+	}
+	r.mu.Unlock()
+}
+
+// parseRetryAfter parses Retry-After header in seconds or http date format
+func parseRetryAfter(value string, now time.Time) (time.Time, bool) {
+	if value == "" {
+		return time.Time{}, false
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return now.Add(time.Duration(seconds) * time.Second), true
+	}
+
+	if date, err := http.ParseTime(value); err == nil {
+		return date, true
+	}
+
+	return time.Time{}, false
+}
+
+func parseUnixTime(value string) time.Time {
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || seconds <= 0 {
+		return time.Time{}
+	}
+
+	return time.Unix(seconds, 0)
+}
+
+// rateLimitTransport passes every gitlab response to RateLimit and request metrics
+type rateLimitTransport struct {
+	base  http.RoundTripper
+	limit *RateLimit
+}
+
+func (t *rateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	started := time.Now()
+
+	resp, err := t.base.RoundTrip(req)
+
+	now := time.Now()
+	endpoint := Endpoint(req.Method, req.URL.EscapedPath())
+
+	metrics.GitlabRequests.Observe(endpoint, now.Sub(started).Seconds())
+
+	requestErr := err
+	if err == nil && resp != nil {
+		t.limit.observe(resp.Header, resp.StatusCode, now)
+
+		if resp.StatusCode >= http.StatusBadRequest {
+			requestErr = fmt.Errorf("gitlab responded with %d", resp.StatusCode)
+		}
 	}
 
-	gitlabClient, err := gl.NewClient(config.GitlabToken, gl.WithBaseURL(config.GitlabURL), gl.WithHTTPClient(httpClient))
+	if requestErr != nil {
+		metrics.GitlabErrors.Inc(endpoint)
+	}
+
+	// not found and other client errors are answers of working gitlab
+	metrics.Gitlab.Observe(serverError(err, resp), now)
+
+	return resp, err
+}
+
+func serverError(err error, resp *http.Response) error {
+	if err != nil {
+		return err
+	}
+
+	if resp != nil && (resp.StatusCode >= http.StatusInternalServerError || resp.StatusCode == http.StatusUnauthorized) {
+		return fmt.Errorf("gitlab responded with %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// idSegments are followed by id or path of object in api urls
+var idSegments = map[string]bool{
+	"projects": true,
+	"groups":   true,
+	"users":    true,
+}
+
+// Endpoint returns method and api path of request with ids and project paths replaced by :id,
+// so metrics have one series per endpoint, ex. GET /projects/:id/pipelines/:id
+func Endpoint(method, escapedPath string) string {
+	if index := strings.Index(escapedPath, "/api/v4/"); index >= 0 {
+		escapedPath = escapedPath[index+len("/api/v4"):]
+	}
+
+	segments := strings.Split(strings.Trim(escapedPath, "/"), "/")
+
+	for i, segment := range segments {
+		if _, err := strconv.Atoi(segment); err == nil ||
+			strings.Contains(segment, "%2F") ||
+			(i > 0 && idSegments[segments[i-1]]) {
+			segments[i] = ":id"
+		}
+	}
+
+	return method + " /" + strings.Join(segments, "/")
+}
+
+// IsFinishedStatus reports whether pipeline will not change its status anymore, manual pipeline
+// is not finished, it waits for user to play jobs or approve deployments
+func IsFinishedStatus(status string) bool {
+	switch status {
+	case "success", "failed", "canceled", "skipped":
+		return true
+	}
+
+	return false
+}
+
+// StatusEmoji returns emoji for pipeline or job status, unknown statuses are returned as is
+func StatusEmoji(status string) string {
+	switch status {
+	case "running":
+		return "🏃"
+	case "success":
+		return "✅"
+	case "failed":
+		return "❌"
+	case "canceled":
+		return "🚫"
+	case "manual":
+		return "✋"
+	}
+
+	// unknown emoji
+	return "❓ " + status
+}
+
+// GetPipelineJobs returns all jobs of pipeline sorted by id, retried jobs are skipped
+func GetPipelineJobs(gitlabClient *gl.Client, project string, pipelineID int) ([]*gl.Job, error) {
+	options := &gl.ListJobsOptions{
+		ListOptions: gl.ListOptions{
+			PerPage: 100,
+			Page:    1,
+		},
+	}
+
+	var jobs []*gl.Job
+
+	for {
+		pageJobs, response, err := gitlabClient.Jobs.ListPipelineJobs(project, pipelineID, options)
+		if err != nil {
+			return nil, err
+		}
+
+		jobs = append(jobs, pageJobs...)
+
+		if response == nil || response.NextPage == 0 {
+			break
+		}
+
+		options.Page = response.NextPage
+	}
+
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].ID < jobs[j].ID
+	})
+
+	return jobs, nil
+}
+
+// ManualAction is manual job of pipeline, DeploymentID is set if job deploys to protected environment
+// and deployment waits for approval, such job can't be played before approval
+type ManualAction struct {
+	JobID        int
+	Name         string
+	Stage        string
+	DeploymentID int
+	Environment  string
+}
+
+// GetManualActions returns manual jobs of pipeline with deployments waiting for approval,
+// deployments can't be listed without premium, then only jobs are returned
+func GetManualActions(gitlabClient *gl.Client, project string, pipelineID int) ([]ManualAction, error) {
+	jobs, err := GetPipelineJobs(gitlabClient, project, pipelineID)
 	if err != nil {
 		return nil, err
 	}
 
-	return gitlabClient, nil
+	var actions []ManualAction
+
+	for _, job := range jobs {
+		if job.Status == "manual" {
+			actions = append(actions, ManualAction{JobID: job.ID, Name: job.Name, Stage: job.Stage})
+		}
+	}
+
+	if len(actions) == 0 {
+		return nil, nil
+	}
+
+	status := "blocked"
+
+	deployments, _, err := gitlabClient.Deployments.ListProjectDeployments(project, &gl.ListProjectDeploymentsOptions{
+		ListOptions: gl.ListOptions{PerPage: 100},
+		Status:      &status,
+	})
+	if err != nil {
+		log.Printf("error getting blocked deployments of %s: %s", project, err)
+
+		return actions, nil
+	}
+
+	for _, deployment := range deployments {
+		for i := range actions {
+			if deployment.Deployable.ID != actions[i].JobID {
+				continue
+			}
+
+			actions[i].DeploymentID = deployment.ID
+
+			if deployment.Environment != nil {
+				actions[i].Environment = deployment.Environment.Name
+			}
+		}
+	}
+
+	return actions, nil
+}
+
+// FormatManualActions lists manual jobs, jobs waiting for deployment approval are marked
+func FormatManualActions(actions []ManualAction) string {
+	lines := make([]string, 0, len(actions))
+
+	for _, action := range actions {
+		line := fmt.Sprintf("%s %s, stage %s", StatusEmoji("manual"), action.Name, action.Stage)
+		if action.DeploymentID != 0 {
+			line = line + ", deployment to " + action.Environment + " waits for approval"
+		}
+
+		lines = append(lines, line)
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+var (
+	ansiEscapeRe    = regexp.MustCompile(`\x1b\[[0-9;]*[A-Za-z]`)
+	sectionMarkerRe = regexp.MustCompile(`section_(start|end):\d+:[^\r\n]*\r`)
+)
+
+// CleanTrace removes ansi colour codes and collapsed section markers from job trace
+func CleanTrace(trace string) string {
+	trace = sectionMarkerRe.ReplaceAllString(trace, "")
+	trace = ansiEscapeRe.ReplaceAllString(trace, "")
+
+	lines := strings.Split(strings.ReplaceAll(trace, "\r\n", "\n"), "\n")
+	for i, line := range lines {
+		// progress output rewrites line with carriage return, only the last state is visible
+		if idx := strings.LastIndex(line, "\r"); idx >= 0 {
+			lines[i] = line[idx+1:]
+		}
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// TailLines returns last n lines of s, trailing empty lines are ignored
+func TailLines(s string, n int) string {
+	lines := strings.Split(strings.TrimRight(s, "\n "), "\n")
+	if n > 0 && len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// GetJobTraceTail returns last lines of cleaned job trace
+func GetJobTraceTail(gitlabClient *gl.Client, project string, jobID, lines int) (string, error) {
+	trace, _, err := gitlabClient.Jobs.GetTraceFile(project, jobID)
+	if err != nil {
+		return "", err
+	}
+
+	data, err := io.ReadAll(trace)
+	if err != nil {
+		return "", err
+	}
+
+	return TailLines(CleanTrace(string(data)), lines), nil
+}
+
+// FormatPipelineProgress formats count of finished jobs as progress bar
+func FormatPipelineProgress(jobs []*gl.Job) string {
+	if len(jobs) == 0 {
+		return ""
+	}
+
+	finished := 0
+
+	for _, job := range jobs {
+		switch job.Status {
+		case "success", "failed", "canceled", "skipped":
+			finished++
+		}
+	}
+
+	const barSize = 10
+
+	filled := finished * barSize / len(jobs)
+
+	return fmt.Sprintf(
+		"progress: %s%s %d/%d jobs",
+		strings.Repeat("▰", filled),
+		strings.Repeat("▱", barSize-filled),
+		finished,
+		len(jobs),
+	)
+}
+
+/*
+*	FormatPipelineJobs formats pipeline jobs grouped by stage
+*	returns name, status, duration and url of each job, failed jobs are highlighted
+*	@param jobs []*gl.Job
+*	@return string
+ */
+func FormatPipelineJobs(jobs []*gl.Job) string {
+	if len(jobs) == 0 {
+		return "no jobs"
+	}
+
+	var stages []string
+
+	stageJobs := make(map[string][]*gl.Job)
+
+	for _, job := range jobs {
+		if _, ok := stageJobs[job.Stage]; !ok {
+			stages = append(stages, job.Stage)
+		}
+
+		stageJobs[job.Stage] = append(stageJobs[job.Stage], job)
+	}
+
+	lines := make([]string, 0, len(jobs)+len(stages))
+
+	for _, stage := range stages {
+		lines = append(lines, "stage: "+stage)
+
+		for _, job := range stageJobs[stage] {
+			name := job.Name
+			if job.Status == "failed" {
+				name = "**" + name + "**"
+
+				if job.AllowFailure {
+					name = name + " (allowed to fail)"
+				}
+			}
+
+			lines = append(lines, fmt.Sprintf(
+				"%s %s: %s, %s, %s",
+				StatusEmoji(job.Status),
+				name,
+				job.Status,
+				time.Duration(job.Duration*float64(time.Second)).Round(time.Second),
+				job.WebURL,
+			))
+		}
+	}
+
+	return strings.Join(lines, "\n")
 }
 
 /*
@@ -47,17 +493,7 @@ func InitGitlabClient(config *config.Config) (*gl.Client, error) {
 *	@return string
  */
 func FormatPipelineInfo(pipeline *gl.Pipeline) string {
-	// unknown emoji
-	emojiStatus := "❓ " + pipeline.Status
-	if pipeline.Status == "running" {
-		emojiStatus = "🏃"
-	} else if pipeline.Status == "success" {
-		emojiStatus = "✅"
-	} else if pipeline.Status == "failed" {
-		emojiStatus = "❌"
-	} else if pipeline.Status == "canceled" {
-		emojiStatus = "🚫"
-	}
+	emojiStatus := StatusEmoji(pipeline.Status)
 
 	finishedTime := "not finished"
 
@@ -83,6 +519,32 @@ func FormatPipelineInfo(pipeline *gl.Pipeline) string {
 	)
 }
 
+// FormatPipelineTemplate renders pipeline with text/template from project config,
+// pipeline fields are available as is, Project and Emoji are added
+func FormatPipelineTemplate(text, project string, pipeline *gl.Pipeline) (string, error) {
+	tmpl, err := template.New(project).Parse(text)
+	if err != nil {
+		return "", err
+	}
+
+	data := struct {
+		*gl.Pipeline
+		Project string
+		Emoji   string
+	}{
+		Pipeline: pipeline,
+		Project:  project,
+		Emoji:    StatusEmoji(pipeline.Status),
+	}
+
+	var b strings.Builder
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", err
+	}
+
+	return b.String(), nil
+}
+
 func FormatIssueInfo(issue *gl.Issue) string {
 	stateEmoji := "❓ " + issue.State
 	if issue.State == "opened" {
@@ -112,3 +574,81 @@ func FormatIssueInfo(issue *gl.Issue) string {
 		issue.Description,
 	)
 }
+
+// FormatMergeRequestInfo formats merge request with approvals, merge status, conflicts and head pipeline status,
+// approvals can be nil if approvals api is not available
+func FormatMergeRequestInfo(mr *gl.MergeRequest, approvals *gl.MergeRequestApprovals) string {
+	stateEmoji := "❓ " + mr.State
+	if mr.State == "opened" {
+		stateEmoji = "🔓"
+	} else if mr.State == "merged" {
+		stateEmoji = "🔀"
+	} else if mr.State == "closed" {
+		stateEmoji = "🚫"
+	}
+
+	title := mr.Title
+	if mr.Draft {
+		title = "[draft] " + title
+	}
+
+	author := "unknown author"
+	if mr.Author != nil && mr.Author.Username != "" {
+		author = mr.Author.Username
+	}
+
+	approvalsInfo := "unknown"
+	if approvals != nil {
+		approvalsInfo = fmt.Sprintf("%d/%d", len(approvals.ApprovedBy), len(approvals.ApprovedBy)+approvals.ApprovalsLeft)
+
+		if approvedBy := ApprovedBy(approvals); len(approvedBy) > 0 {
+			approvalsInfo = approvalsInfo + " (" + strings.Join(approvedBy, ", ") + ")"
+		}
+	}
+
+	mergeStatus := mr.DetailedMergeStatus
+	if mergeStatus == "" {
+		mergeStatus = mr.MergeStatus
+	}
+
+	conflicts := "no"
+	if mr.HasConflicts {
+		conflicts = "yes"
+	}
+
+	pipeline := "no pipeline"
+	if mr.HeadPipeline != nil {
+		pipeline = StatusEmoji(mr.HeadPipeline.Status) + " " + mr.HeadPipeline.WebURL
+	}
+
+	return fmt.Sprintf(
+		"%s %s\n%s\n%s → %s\nAuthor: %s\nApprovals: %s\nMerge status: %s\nConflicts: %s\nPipeline: %s",
+		stateEmoji,
+		mr.WebURL,
+		title,
+		mr.SourceBranch,
+		mr.TargetBranch,
+		author,
+		approvalsInfo,
+		mergeStatus,
+		conflicts,
+		pipeline,
+	)
+}
+
+// ApprovedBy returns usernames of merge request approvers
+func ApprovedBy(approvals *gl.MergeRequestApprovals) []string {
+	if approvals == nil {
+		return nil
+	}
+
+	usernames := make([]string, 0, len(approvals.ApprovedBy))
+
+	for _, approver := range approvals.ApprovedBy {
+		if approver != nil && approver.User != nil {
+			usernames = append(usernames, approver.User.Username)
+		}
+	}
+
+	return usernames
+}
@@ -1,10 +1,15 @@
 package gitlab
 
 import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
 	"testing"
 	"time"
 
 	"github.com/ad/gitlab-pipelines-notifier/config"
+
+	"github.com/google/go-cmp/cmp"
 	gl "github.com/xanzy/go-gitlab"
 )
 
@@ -124,6 +129,46 @@ duration: 0s`,
 	}
 }
 
+func TestFormatPipelineTemplate(t *testing.T) {
+	tests := []struct {
+		name     string
+		text     string
+		pipeline *gl.Pipeline
+		want     string
+		wantErr  bool
+	}{
+		{
+			name:     "fields",
+			text:     "{{.Emoji}} {{.Project}} {{.Ref}} {{.Status}} {{.WebURL}}",
+			pipeline: &gl.Pipeline{Ref: "main", Status: "failed", WebURL: "https://git.mydomain.com/group/project/-/pipelines/1"},
+			want:     "❌ group/project main failed https://git.mydomain.com/group/project/-/pipelines/1",
+		},
+		{
+			name:     "wrong template",
+			text:     "{{.Ref",
+			pipeline: &gl.Pipeline{},
+			wantErr:  true,
+		},
+		{
+			name:     "unknown field",
+			text:     "{{.Test}}",
+			pipeline: &gl.Pipeline{},
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := FormatPipelineTemplate(tt.text, "group/project", tt.pipeline)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("FormatPipelineTemplate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("FormatPipelineTemplate() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
 func TestFormatIssueInfo(t *testing.T) {
 	type args struct {
 		issue *gl.Issue
@@ -222,6 +267,71 @@ test`,
 	}
 }
 
+func TestRateLimit_observe(t *testing.T) {
+	now := time.Now()
+	reset := strconv.FormatInt(now.Add(time.Hour).Unix(), 10)
+
+	tests := []struct {
+		name       string
+		header     map[string]string
+		statusCode int
+		wantWait   time.Duration
+	}{
+		{
+			name:       "enough requests left",
+			header:     map[string]string{"RateLimit-Remaining": "100", "RateLimit-Reset": reset},
+			statusCode: http.StatusOK,
+		},
+		{
+			name:       "few requests left",
+			header:     map[string]string{"RateLimit-Remaining": "5", "RateLimit-Reset": reset},
+			statusCode: http.StatusOK,
+			wantWait:   time.Hour,
+		},
+		{
+			name:       "too many requests with Retry-After",
+			header:     map[string]string{"Retry-After": "30", "RateLimit-Reset": reset},
+			statusCode: http.StatusTooManyRequests,
+			wantWait:   30 * time.Second,
+		},
+		{
+			name:       "too many requests without headers",
+			statusCode: http.StatusTooManyRequests,
+			wantWait:   defaultRetryAfter,
+		},
+		{
+			name:       "server error",
+			statusCode: http.StatusBadGateway,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			for key, value := range tt.header {
+				header.Set(key, value)
+			}
+
+			r := &RateLimit{}
+			r.observe(header, tt.statusCode, now)
+
+			wait := r.Wait()
+			if tt.wantWait == 0 && wait != 0 {
+				t.Errorf("Wait() = %s, want 0", wait)
+			}
+
+			// Wait counts from real time, so it is a bit less than expected
+			if tt.wantWait != 0 && (wait > tt.wantWait || wait < tt.wantWait-5*time.Second) {
+				t.Errorf("Wait() = %s, want about %s", wait, tt.wantWait)
+			}
+		})
+	}
+
+	var r *RateLimit
+	if r.Wait() != 0 {
+		t.Error("Wait() of nil RateLimit is not 0")
+	}
+}
+
 func TestInitGitlabClient(t *testing.T) {
 	type args struct {
 		config *config.Config
@@ -278,3 +388,329 @@ func TestInitGitlabClient(t *testing.T) {
 		})
 	}
 }
+
+func TestEndpoint(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		want   string
+	}{
+		{"pipeline", "GET", "/api/v4/projects/group%2Fproject/pipelines/123", "GET /projects/:id/pipelines/:id"},
+		{"nested group", "GET", "/api/v4/projects/group%2Fsub%2Fproject/pipelines", "GET /projects/:id/pipelines"},
+		{"project id", "POST", "/api/v4/projects/42/pipelines/1/retry", "POST /projects/:id/pipelines/:id/retry"},
+		{"relative path", "GET", "/gitlab/api/v4/projects/42/jobs/7/trace", "GET /projects/:id/jobs/:id/trace"},
+		{"user", "GET", "/api/v4/user", "GET /user"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Endpoint(tt.method, tt.path); got != tt.want {
+				t.Errorf("Endpoint() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsFinishedStatus(t *testing.T) {
+	tests := []struct {
+		status string
+		want   bool
+	}{
+		{status: "created"},
+		{status: "pending"},
+		{status: "running"},
+		{status: "success", want: true},
+		{status: "failed", want: true},
+		{status: "canceled", want: true},
+		{status: "skipped", want: true},
+		{status: "manual"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.status, func(t *testing.T) {
+			if got := IsFinishedStatus(tt.status); got != tt.want {
+				t.Errorf("IsFinishedStatus() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetManualActions(t *testing.T) {
+	deploymentsStatus := http.StatusOK
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v4/projects/group/project/pipelines/1/jobs":
+			_, _ = w.Write([]byte(`[
+				{"id": 3, "name": "deploy", "stage": "deploy", "status": "manual"},
+				{"id": 2, "name": "migrate", "stage": "deploy", "status": "manual"},
+				{"id": 1, "name": "build", "stage": "build", "status": "success"}
+			]`))
+		case "/api/v4/projects/group/project/deployments":
+			if r.URL.Query().Get("status") != "blocked" {
+				t.Errorf("deployments status = %s, want blocked", r.URL.Query().Get("status"))
+			}
+
+			w.WriteHeader(deploymentsStatus)
+			_, _ = w.Write([]byte(`[{"id": 10, "deployable": {"id": 3}, "environment": {"name": "production"}}]`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	client, err := gl.NewClient("token", gl.WithBaseURL(server.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []ManualAction{
+		{JobID: 2, Name: "migrate", Stage: "deploy"},
+		{JobID: 3, Name: "deploy", Stage: "deploy", DeploymentID: 10, Environment: "production"},
+	}
+
+	got, err := GetManualActions(client, "group/project", 1)
+	if err != nil {
+		t.Fatalf("GetManualActions() error = %v", err)
+	}
+
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("GetManualActions() mismatch (-want +got):\n%s", diff)
+	}
+
+	// deployments api needs premium, jobs are still returned
+	deploymentsStatus = http.StatusForbidden
+
+	got, err = GetManualActions(client, "group/project", 1)
+	if err != nil {
+		t.Fatalf("GetManualActions() error = %v", err)
+	}
+
+	if diff := cmp.Diff([]ManualAction{{JobID: 2, Name: "migrate", Stage: "deploy"}, {JobID: 3, Name: "deploy", Stage: "deploy"}}, got); diff != "" {
+		t.Errorf("GetManualActions() without deployments mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestFormatManualActions(t *testing.T) {
+	actions := []ManualAction{
+		{JobID: 2, Name: "migrate", Stage: "deploy"},
+		{JobID: 3, Name: "deploy", Stage: "deploy", DeploymentID: 10, Environment: "production"},
+	}
+
+	want := "✋ migrate, stage deploy\n✋ deploy, stage deploy, deployment to production waits for approval"
+
+	if got := FormatManualActions(actions); got != want {
+		t.Errorf("FormatManualActions() = %v, want %v", got, want)
+	}
+}
+
+func TestFormatPipelineJobs(t *testing.T) {
+	type args struct {
+		jobs []*gl.Job
+	}
+	tests := []struct {
+		name string
+		args args
+		want string
+	}{
+		{
+			name: "no jobs",
+			want: "no jobs",
+		},
+		{
+			name: "grouped by stage",
+			args: args{
+				jobs: []*gl.Job{
+					{ID: 1, Name: "compile", Stage: "build", Status: "success", Duration: 62.4, WebURL: "test/1"},
+					{ID: 2, Name: "unit", Stage: "test", Status: "failed", Duration: 30, WebURL: "test/2"},
+					{ID: 3, Name: "lint", Stage: "test", Status: "failed", AllowFailure: true, Duration: 5, WebURL: "test/3"},
+					{ID: 4, Name: "deploy", Stage: "deploy", Status: "skipped", WebURL: "test/4"},
+				},
+			},
+			want: `stage: build
+✅ compile: success, 1m2s, test/1
+stage: test
+❌ **unit**: failed, 30s, test/2
+❌ **lint** (allowed to fail): failed, 5s, test/3
+stage: deploy
+❓ skipped deploy: skipped, 0s, test/4`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := FormatPipelineJobs(tt.args.jobs); got != tt.want {
+				t.Errorf("FormatPipelineJobs() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCleanTrace(t *testing.T) {
+	tests := []struct {
+		name  string
+		trace string
+		want  string
+	}{
+		{
+			name:  "plain",
+			trace: "line 1\nline 2",
+			want:  "line 1\nline 2",
+		},
+		{
+			name:  "ansi colours",
+			trace: "\x1b[32;1mJob succeeded\x1b[0;m",
+			want:  "Job succeeded",
+		},
+		{
+			name:  "section markers",
+			trace: "section_start:1700000000:step_script\r\x1b[0K\x1b[0K\x1b[36;1mExecuting \"step_script\"\x1b[0;m\nsection_end:1700000001:step_script\r\x1b[0K",
+			want:  "Executing \"step_script\"\n",
+		},
+		{
+			name:  "carriage return progress",
+			trace: "progress 10%\rprogress 100%\r\nnext",
+			want:  "progress 100%\nnext",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := CleanTrace(tt.trace); got != tt.want {
+				t.Errorf("CleanTrace() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTailLines(t *testing.T) {
+	tests := []struct {
+		name string
+		s    string
+		n    int
+		want string
+	}{
+		{
+			name: "less lines",
+			s:    "1\n2",
+			n:    3,
+			want: "1\n2",
+		},
+		{
+			name: "more lines",
+			s:    "1\n2\n3\n4\n\n",
+			n:    2,
+			want: "3\n4",
+		},
+		{
+			name: "no limit",
+			s:    "1\n2\n3",
+			want: "1\n2\n3",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := TailLines(tt.s, tt.n); got != tt.want {
+				t.Errorf("TailLines() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormatPipelineProgress(t *testing.T) {
+	tests := []struct {
+		name string
+		jobs []*gl.Job
+		want string
+	}{
+		{
+			name: "no jobs",
+		},
+		{
+			name: "half finished",
+			jobs: []*gl.Job{
+				{Status: "success"},
+				{Status: "failed"},
+				{Status: "running"},
+				{Status: "created"},
+			},
+			want: "progress: ▰▰▰▰▰▱▱▱▱▱ 2/4 jobs",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := FormatPipelineProgress(tt.jobs); got != tt.want {
+				t.Errorf("FormatPipelineProgress() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormatMergeRequestInfo(t *testing.T) {
+	type args struct {
+		mr        *gl.MergeRequest
+		approvals *gl.MergeRequestApprovals
+	}
+	tests := []struct {
+		name string
+		args args
+		want string
+	}{
+		{
+			name: "without approvals and pipeline",
+			args: args{
+				mr: &gl.MergeRequest{
+					State:        "opened",
+					WebURL:       "test",
+					Title:        "title",
+					Draft:        true,
+					SourceBranch: "feature",
+					TargetBranch: "main",
+					MergeStatus:  "can_be_merged",
+				},
+			},
+			want: `🔓 test
+[draft] title
+feature → main
+Author: unknown author
+Approvals: unknown
+Merge status: can_be_merged
+Conflicts: no
+Pipeline: no pipeline`,
+		},
+		{
+			name: "merged with approvals and pipeline",
+			args: args{
+				mr: &gl.MergeRequest{
+					State:               "merged",
+					WebURL:              "test",
+					Title:               "title",
+					SourceBranch:        "feature",
+					TargetBranch:        "main",
+					Author:              &gl.BasicUser{Username: "author"},
+					DetailedMergeStatus: "mergeable",
+					HasConflicts:        true,
+					HeadPipeline:        &gl.Pipeline{Status: "success", WebURL: "pipeline"},
+				},
+				approvals: &gl.MergeRequestApprovals{
+					ApprovalsLeft: 1,
+					ApprovedBy: []*gl.MergeRequestApproverUser{
+						{User: &gl.BasicUser{Username: "reviewer"}},
+					},
+				},
+			},
+			want: `🔀 test
+title
+feature → main
+Author: author
+Approvals: 1/2 (reviewer)
+Merge status: mergeable
+Conflicts: yes
+Pipeline: ✅ pipeline`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := FormatMergeRequestInfo(tt.args.mr, tt.args.approvals); got != tt.want {
+				t.Errorf("FormatMergeRequestInfo() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
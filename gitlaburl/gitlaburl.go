@@ -0,0 +1,161 @@
+package gitlaburl
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Kind is type of gitlab object the url points to
+type Kind string
+
+const (
+	KindProject      Kind = "project"
+	KindPipeline     Kind = "pipeline"
+	KindJob          Kind = "job"
+	KindMergeRequest Kind = "merge_request"
+	KindIssue        Kind = "issue"
+	KindCommit       Kind = "commit"
+	KindBranch       Kind = "branch"
+)
+
+// Reference is parsed gitlab web url
+type Reference struct {
+	Kind    Kind
+	Project string // path with namespace, ex. group/subgroup/project
+	ID      int    // pipeline or job id, merge request or issue iid
+	Ref     string // commit sha or branch name
+}
+
+// Parser parses web urls of configured gitlab instance
+type Parser struct {
+	host     string
+	basePath string
+}
+
+// NewParser returns parser for gitlab url from config, ex. https://git.mydomain.com/api/v4,
+// gitlab installed under relative path like https://mydomain.com/gitlab/api/v4 is supported,
+// empty url disables host check
+func NewParser(gitlabURL string) (*Parser, error) {
+	p := &Parser{}
+
+	if gitlabURL == "" {
+		return p, nil
+	}
+
+	u, err := url.Parse(gitlabURL)
+	if err != nil {
+		return nil, fmt.Errorf("wrong gitlab url %s: %s", gitlabURL, err)
+	}
+
+	p.host = strings.ToLower(u.Host)
+	p.basePath = strings.Trim(strings.TrimSuffix(strings.TrimRight(u.Path, "/"), "/api/v4"), "/")
+
+	return p, nil
+}
+
+// Parse resolves gitlab web url into reference, query string and anchor are ignored
+func (p *Parser) Parse(rawURL string) (*Reference, error) {
+	u, err := url.Parse(strings.TrimSpace(rawURL))
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("wrong url %s", rawURL)
+	}
+
+	if p.host != "" && strings.ToLower(u.Host) != p.host {
+		return nil, fmt.Errorf("url %s is not from gitlab %s", rawURL, p.host)
+	}
+
+	path := strings.Trim(u.Path, "/")
+
+	if p.basePath != "" {
+		if path != p.basePath && !strings.HasPrefix(path, p.basePath+"/") {
+			return nil, fmt.Errorf("url %s is not from gitlab %s/%s", rawURL, p.host, p.basePath)
+		}
+
+		path = strings.Trim(strings.TrimPrefix(path, p.basePath), "/")
+	}
+
+	segments := strings.Split(path, "/")
+
+	projectSegments, objectSegments := splitProject(segments)
+
+	if len(projectSegments) < 2 {
+		return nil, fmt.Errorf("can't find project in url %s", rawURL)
+	}
+
+	ref := &Reference{
+		Kind:    KindProject,
+		Project: strings.Join(projectSegments, "/"),
+	}
+
+	if len(objectSegments) == 0 {
+		return ref, nil
+	}
+
+	if len(objectSegments) < 2 || objectSegments[1] == "" {
+		return nil, fmt.Errorf("can't find %s in url %s", objectSegments[0], rawURL)
+	}
+
+	switch objectSegments[0] {
+	case "pipelines":
+		ref.Kind = KindPipeline
+	case "jobs", "builds":
+		ref.Kind = KindJob
+	case "merge_requests":
+		ref.Kind = KindMergeRequest
+	case "issues":
+		ref.Kind = KindIssue
+	case "commit":
+		ref.Kind = KindCommit
+		ref.Ref = objectSegments[1]
+
+		return ref, nil
+	case "tree", "commits":
+		ref.Kind = KindBranch
+		ref.Ref = strings.Join(objectSegments[1:], "/")
+
+		return ref, nil
+	default:
+		return nil, fmt.Errorf("unsupported url %s", rawURL)
+	}
+
+	id, errID := strconv.Atoi(objectSegments[1])
+	if errID != nil || id <= 0 {
+		return nil, fmt.Errorf("wrong %s number in url %s", ref.Kind, rawURL)
+	}
+
+	ref.ID = id
+
+	return ref, nil
+}
+
+var objectKeywords = map[string]bool{
+	"pipelines":      true,
+	"jobs":           true,
+	"builds":         true,
+	"merge_requests": true,
+	"issues":         true,
+	"commit":         true,
+	"commits":        true,
+	"tree":           true,
+}
+
+// splitProject splits path segments into project path and object part,
+// modern urls separate them with "-", legacy ones are split on the first known keyword
+func splitProject(segments []string) ([]string, []string) {
+	for i, segment := range segments {
+		if segment == "-" {
+			return segments[:i], segments[i+1:]
+		}
+	}
+
+	// project path has at least namespace and name
+	for i := 2; i < len(segments); i++ {
+		if objectKeywords[segments[i]] {
+			return segments[:i], segments[i:]
+		}
+	}
+
+	return segments, nil
+}
@@ -0,0 +1,153 @@
+package gitlaburl
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestNewParser(t *testing.T) {
+	tests := []struct {
+		name      string
+		gitlabURL string
+		want      *Parser
+		wantErr   bool
+	}{
+		{
+			name: "empty url",
+			want: &Parser{},
+		},
+		{
+			name:      "api url",
+			gitlabURL: "https://Git.MyDomain.com/api/v4",
+			want:      &Parser{host: "git.mydomain.com"},
+		},
+		{
+			name:      "relative path",
+			gitlabURL: "https://mydomain.com/gitlab/api/v4/",
+			want:      &Parser{host: "mydomain.com", basePath: "gitlab"},
+		},
+		{
+			name:      "bad url",
+			gitlabURL: "://test",
+			wantErr:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NewParser(tt.gitlabURL)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewParser() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if diff := cmp.Diff(tt.want, got, cmp.AllowUnexported(Parser{})); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func TestParser_Parse(t *testing.T) {
+	tests := []struct {
+		name      string
+		gitlabURL string
+		rawURL    string
+		want      *Reference
+		wantErr   bool
+	}{
+		{
+			name:      "pipeline",
+			gitlabURL: "https://yourgitlab.com/api/v4",
+			rawURL:    "https://yourgitlab.com/yourgroup/yourproject/-/pipelines/12345",
+			want:      &Reference{Kind: KindPipeline, Project: "yourgroup/yourproject", ID: 12345},
+		},
+		{
+			name:   "pipeline in nested group with trailing slash, query and anchor",
+			rawURL: "https://yourgitlab.com/group/sub/project/-/pipelines/12345/?tab=builds#jobs",
+			want:   &Reference{Kind: KindPipeline, Project: "group/sub/project", ID: 12345},
+		},
+		{
+			name:      "job under relative path",
+			gitlabURL: "https://mydomain.com/gitlab/api/v4",
+			rawURL:    "https://mydomain.com/gitlab/group/project/-/jobs/7",
+			want:      &Reference{Kind: KindJob, Project: "group/project", ID: 7},
+		},
+		{
+			name:   "merge request diffs",
+			rawURL: "https://yourgitlab.com/group/project/-/merge_requests/3/diffs",
+			want:   &Reference{Kind: KindMergeRequest, Project: "group/project", ID: 3},
+		},
+		{
+			name:   "legacy issue url",
+			rawURL: "https://yourgitlab.com/group/project/issues/4",
+			want:   &Reference{Kind: KindIssue, Project: "group/project", ID: 4},
+		},
+		{
+			name:   "commit",
+			rawURL: "https://yourgitlab.com/group/project/-/commit/abcdef",
+			want:   &Reference{Kind: KindCommit, Project: "group/project", Ref: "abcdef"},
+		},
+		{
+			name:   "branch with slash",
+			rawURL: "https://yourgitlab.com/group/project/-/tree/release/1.0",
+			want:   &Reference{Kind: KindBranch, Project: "group/project", Ref: "release/1.0"},
+		},
+		{
+			name:   "project",
+			rawURL: "https://yourgitlab.com/group/sub/project/",
+			want:   &Reference{Kind: KindProject, Project: "group/sub/project"},
+		},
+		{
+			name:      "other host",
+			gitlabURL: "https://yourgitlab.com/api/v4",
+			rawURL:    "https://microsoft.com/group/project/-/pipelines/1",
+			wantErr:   true,
+		},
+		{
+			name:      "outside of relative path",
+			gitlabURL: "https://mydomain.com/gitlab/api/v4",
+			rawURL:    "https://mydomain.com/group/project/-/pipelines/1",
+			wantErr:   true,
+		},
+		{
+			name:    "not url",
+			rawURL:  "test",
+			wantErr: true,
+		},
+		{
+			name:    "without project",
+			rawURL:  "https://microsoft.com",
+			wantErr: true,
+		},
+		{
+			name:    "without number",
+			rawURL:  "https://yourgitlab.com/group/project/-/pipelines/test",
+			wantErr: true,
+		},
+		{
+			name:    "without id",
+			rawURL:  "https://yourgitlab.com/group/project/-/pipelines",
+			wantErr: true,
+		},
+		{
+			name:    "unsupported",
+			rawURL:  "https://yourgitlab.com/group/project/-/settings/ci_cd",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := NewParser(tt.gitlabURL)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := p.Parse(tt.rawURL)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Parse() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,237 @@
+package identity
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+
+	"github.com/ad/gitlab-pipelines-notifier/store"
+
+	gl "github.com/xanzy/go-gitlab"
+)
+
+const FileName = "data/identities.json"
+
+// Identity links telegram user to gitlab user, Token is personal access token encrypted with Cipher
+type Identity struct {
+	UserID   int64  `json:"user_id"`
+	GitlabID int    `json:"gitlab_id"`
+	Username string `json:"username"`
+	Token    string `json:"token"`
+}
+
+// Cipher encrypts tokens with AES-GCM, key is sha256 of secret so any secret length works
+type Cipher struct {
+	aead cipher.AEAD
+}
+
+func NewCipher(secret string) (*Cipher, error) {
+	if secret == "" {
+		return nil, fmt.Errorf("%s", "empty secret")
+	}
+
+	key := sha256.Sum256([]byte(secret))
+
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Cipher{aead: aead}, nil
+}
+
+// Encrypt returns base64 of random nonce followed by sealed text
+func (c *Cipher) Encrypt(text string) (string, error) {
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(c.aead.Seal(nonce, nonce, []byte(text), nil)), nil
+}
+
+func (c *Cipher) Decrypt(encrypted string) (string, error) {
+	data, err := base64.StdEncoding.DecodeString(encrypted)
+	if err != nil {
+		return "", err
+	}
+
+	if len(data) < c.aead.NonceSize() {
+		return "", fmt.Errorf("%s", "encrypted text is too short")
+	}
+
+	text, err := c.aead.Open(nil, data[:c.aead.NonceSize()], data[c.aead.NonceSize():], nil)
+	if err != nil {
+		return "", fmt.Errorf("%s", "can't decrypt, secret was changed or data is corrupted")
+	}
+
+	return string(text), nil
+}
+
+// ClientFunc creates gitlab client acting as owner of token
+type ClientFunc func(token string) (*gl.Client, error)
+
+// Identities keeps linked gitlab accounts of telegram users, clients of users are created once and cached
+type Identities struct {
+	mu         sync.Mutex
+	store      store.Store
+	cipher     *Cipher
+	newClient  ClientFunc
+	identities map[int64]Identity
+	clients    map[int64]*gl.Client
+}
+
+// New loads identities from store, tokens stay encrypted until client of user is needed
+func New(s store.Store, secret string, newClient ClientFunc) (*Identities, error) {
+	c, err := NewCipher(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	records, err := s.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	identities := &Identities{
+		store:      s,
+		cipher:     c,
+		newClient:  newClient,
+		identities: make(map[int64]Identity, len(records)),
+		clients:    map[int64]*gl.Client{},
+	}
+
+	for key, record := range records {
+		var identity Identity
+		if err := json.Unmarshal(record, &identity); err != nil {
+			return nil, fmt.Errorf("error on unmarshal identity %s: %s", key, err)
+		}
+
+		identities.identities[identity.UserID] = identity
+	}
+
+	return identities, nil
+}
+
+// Login checks token in gitlab and links its owner to telegram user, previous account of user is replaced
+func (i *Identities) Login(userID int64, token string) (Identity, error) {
+	client, err := i.newClient(token)
+	if err != nil {
+		return Identity{}, err
+	}
+
+	user, _, err := client.Users.CurrentUser()
+	if err != nil {
+		return Identity{}, fmt.Errorf("token is not accepted by gitlab: %s", err)
+	}
+
+	encrypted, err := i.cipher.Encrypt(token)
+	if err != nil {
+		return Identity{}, err
+	}
+
+	identity := Identity{UserID: userID, GitlabID: user.ID, Username: user.Username, Token: encrypted}
+
+	record, err := json.Marshal(identity)
+	if err != nil {
+		return Identity{}, err
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if err := i.store.Save(key(userID), record); err != nil {
+		return Identity{}, err
+	}
+
+	i.identities[userID] = identity
+	i.clients[userID] = client
+
+	return identity, nil
+}
+
+// Logout unlinks gitlab account of user, token is removed from store
+func (i *Identities) Logout(userID int64) bool {
+	if i == nil {
+		return false
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if _, ok := i.identities[userID]; !ok {
+		return false
+	}
+
+	if err := i.store.Delete(key(userID)); err != nil {
+		return false
+	}
+
+	delete(i.identities, userID)
+	delete(i.clients, userID)
+
+	return true
+}
+
+// Get returns linked gitlab account of user
+func (i *Identities) Get(userID int64) (Identity, bool) {
+	if i == nil {
+		return Identity{}, false
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	identity, ok := i.identities[userID]
+
+	return identity, ok
+}
+
+// Client returns gitlab client acting as user, nil is returned if user is not linked
+func (i *Identities) Client(userID int64) (*gl.Client, error) {
+	if i == nil {
+		return nil, nil
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if client, ok := i.clients[userID]; ok {
+		return client, nil
+	}
+
+	identity, ok := i.identities[userID]
+	if !ok {
+		return nil, nil
+	}
+
+	token, err := i.cipher.Decrypt(identity.Token)
+	if err != nil {
+		return nil, fmt.Errorf("gitlab token of %s: %s", identity.Username, err)
+	}
+
+	client, err := i.newClient(token)
+	if err != nil {
+		return nil, err
+	}
+
+	i.clients[userID] = client
+
+	return client, nil
+}
+
+func key(userID int64) string {
+	return strconv.FormatInt(userID, 10)
+}
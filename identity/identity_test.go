@@ -0,0 +1,115 @@
+package identity
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ad/gitlab-pipelines-notifier/store"
+
+	gl "github.com/xanzy/go-gitlab"
+)
+
+func TestCipher(t *testing.T) {
+	c, err := NewCipher("secret")
+	if err != nil {
+		t.Fatalf("NewCipher() error = %v", err)
+	}
+
+	encrypted, err := c.Encrypt("glpat-token")
+	if err != nil {
+		t.Fatalf("Encrypt() error = %v", err)
+	}
+
+	if strings.Contains(encrypted, "glpat-token") {
+		t.Fatalf("Encrypt() = %s, token is not encrypted", encrypted)
+	}
+
+	if got, err := c.Decrypt(encrypted); err != nil || got != "glpat-token" {
+		t.Fatalf("Decrypt() = %s, %v, want glpat-token", got, err)
+	}
+
+	other, _ := NewCipher("other secret")
+	if _, err := other.Decrypt(encrypted); err == nil {
+		t.Error("Decrypt() with other secret error = nil, want error")
+	}
+
+	if _, err := NewCipher(""); err == nil {
+		t.Error("NewCipher() with empty secret error = nil, want error")
+	}
+}
+
+func TestIdentities(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("PRIVATE-TOKEN") != "good" {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte(`{"message":"401 Unauthorized"}`))
+
+			return
+		}
+
+		_, _ = w.Write([]byte(`{"id":7,"username":"user"}`))
+	}))
+	defer server.Close()
+
+	newClient := func(token string) (*gl.Client, error) {
+		return gl.NewClient(token, gl.WithBaseURL(server.URL))
+	}
+
+	s := store.NewMemoryStore()
+
+	identities, err := New(s, "secret", newClient)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	if _, err := identities.Login(1, "bad"); err == nil {
+		t.Fatal("Login() with bad token error = nil, want error")
+	}
+
+	identity, err := identities.Login(1, "good")
+	if err != nil {
+		t.Fatalf("Login() error = %v", err)
+	}
+
+	if identity.Username != "user" || identity.GitlabID != 7 || identity.Token == "good" {
+		t.Fatalf("Login() = %#v", identity)
+	}
+
+	// identities are restored from store with the same secret
+	restored, err := New(s, "secret", newClient)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	if got, ok := restored.Get(1); !ok || got.Username != "user" {
+		t.Fatalf("Get() = %#v, %v", got, ok)
+	}
+
+	if client, err := restored.Client(1); err != nil || client == nil {
+		t.Fatalf("Client() = %v, %v, want client", client, err)
+	}
+
+	if client, err := restored.Client(2); err != nil || client != nil {
+		t.Fatalf("Client() of unknown user = %v, %v, want nil", client, err)
+	}
+
+	changed, _ := New(s, "changed", newClient)
+	if _, err := changed.Client(1); err == nil {
+		t.Error("Client() with changed secret error = nil, want error")
+	}
+
+	if !restored.Logout(1) || restored.Logout(1) {
+		t.Fatal("Logout() should unlink user once")
+	}
+
+	if records, _ := s.Load(); len(records) != 0 {
+		t.Errorf("Load() = %v, want empty after logout", records)
+	}
+
+	var nilIdentities *Identities
+	if client, err := nilIdentities.Client(1); err != nil || client != nil {
+		t.Errorf("Client() of nil identities = %v, %v, want nil", client, err)
+	}
+}
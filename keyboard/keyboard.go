@@ -0,0 +1,173 @@
+package keyboard
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/ad/gitlab-pipelines-notifier/gitlab"
+
+	"github.com/go-telegram/bot/models"
+	gl "github.com/xanzy/go-gitlab"
+)
+
+// callback actions, telegram limits callback data to 64 bytes, so only ids are sent
+const (
+	ActionRetry   = "retry"
+	ActionCancel  = "cancel"
+	ActionUnwatch = "unwatch"
+	ActionExtend  = "extend"
+	ActionRun     = "run"
+	ActionDismiss = "dismiss"
+	ActionPlay    = "play"
+	ActionApprove = "approve"
+	ActionReject  = "reject"
+)
+
+// Callback is parsed callback data of inline button. ID depends on action, it is id of pending run request
+// for run and dismiss actions, pipeline doesn't exist before confirmation, job id for play action,
+// deployment id for approve and reject actions and pipeline id for other actions
+type Callback struct {
+	Action    string
+	ProjectID int
+	ID        int
+}
+
+func CallbackData(action string, projectID, id int) string {
+	return fmt.Sprintf("%s:%d:%d", action, projectID, id)
+}
+
+func ParseCallbackData(data string) (*Callback, error) {
+	parts := strings.Split(data, ":")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("wrong callback data %q", data)
+	}
+
+	projectID, errProjectID := strconv.Atoi(parts[1])
+	if errProjectID != nil {
+		return nil, fmt.Errorf("wrong project id in callback data %q", data)
+	}
+
+	id, errID := strconv.Atoi(parts[2])
+	if errID != nil {
+		return nil, fmt.Errorf("wrong id in callback data %q", data)
+	}
+
+	return &Callback{
+		Action:    parts[0],
+		ProjectID: projectID,
+		ID:        id,
+	}, nil
+}
+
+// Pipeline returns inline keyboard for pipeline message, buttons depend on pipeline status
+// and whether the pipeline is watched by the chat
+func Pipeline(pipeline *gl.Pipeline, watching bool) models.ReplyMarkup {
+	if pipeline == nil {
+		return nil
+	}
+
+	row := pipelineRow(pipeline, watching)
+	if len(row) == 0 {
+		return nil
+	}
+
+	return &models.InlineKeyboardMarkup{
+		InlineKeyboard: [][]models.InlineKeyboardButton{row},
+	}
+}
+
+// maxManualActions limits buttons of manual jobs, pipeline can have a lot of them
+const maxManualActions = 5
+
+// Manual returns inline keyboard for pipeline waiting for manual action, every manual job has own row
+// with play button or approve and reject buttons if its deployment waits for approval
+func Manual(pipeline *gl.Pipeline, actions []gitlab.ManualAction, watching bool) models.ReplyMarkup {
+	if pipeline == nil {
+		return nil
+	}
+
+	var rows [][]models.InlineKeyboardButton
+
+	for i, action := range actions {
+		if i == maxManualActions {
+			break
+		}
+
+		if action.DeploymentID != 0 {
+			rows = append(rows, []models.InlineKeyboardButton{
+				{Text: "👍 Approve " + action.Name, CallbackData: CallbackData(ActionApprove, pipeline.ProjectID, action.DeploymentID)},
+				{Text: "👎 Reject " + action.Name, CallbackData: CallbackData(ActionReject, pipeline.ProjectID, action.DeploymentID)},
+			})
+
+			continue
+		}
+
+		rows = append(rows, []models.InlineKeyboardButton{
+			{Text: "▶️ Play " + action.Name, CallbackData: CallbackData(ActionPlay, pipeline.ProjectID, action.JobID)},
+		})
+	}
+
+	if row := pipelineRow(pipeline, watching); len(row) > 0 {
+		rows = append(rows, row)
+	}
+
+	if len(rows) == 0 {
+		return nil
+	}
+
+	return &models.InlineKeyboardMarkup{InlineKeyboard: rows}
+}
+
+func pipelineRow(pipeline *gl.Pipeline, watching bool) []models.InlineKeyboardButton {
+	var row []models.InlineKeyboardButton
+
+	switch pipeline.Status {
+	case "failed", "canceled":
+		row = append(row, models.InlineKeyboardButton{
+			Text:         "🔁 Retry",
+			CallbackData: CallbackData(ActionRetry, pipeline.ProjectID, pipeline.ID),
+		})
+	case "created", "waiting_for_resource", "preparing", "pending", "running", "scheduled":
+		row = append(row, models.InlineKeyboardButton{
+			Text:         "🚫 Cancel",
+			CallbackData: CallbackData(ActionCancel, pipeline.ProjectID, pipeline.ID),
+		})
+	}
+
+	if watching {
+		row = append(row, models.InlineKeyboardButton{
+			Text:         "🔕 Stop watching",
+			CallbackData: CallbackData(ActionUnwatch, pipeline.ProjectID, pipeline.ID),
+		})
+	}
+
+	if pipeline.WebURL != "" {
+		row = append(row, models.InlineKeyboardButton{
+			Text: "🔗 Open",
+			URL:  pipeline.WebURL,
+		})
+	}
+
+	return row
+}
+
+// Extend returns inline keyboard for watch timeout warning, project id is not needed to extend watch
+func Extend(pipelineID int) models.ReplyMarkup {
+	return &models.InlineKeyboardMarkup{
+		InlineKeyboard: [][]models.InlineKeyboardButton{{
+			{Text: "⏰ Extend", CallbackData: CallbackData(ActionExtend, 0, pipelineID)},
+			{Text: "🔕 Stop watching", CallbackData: CallbackData(ActionUnwatch, 0, pipelineID)},
+		}},
+	}
+}
+
+// Run returns inline keyboard to confirm pipeline run request
+func Run(projectID, requestID int) models.ReplyMarkup {
+	return &models.InlineKeyboardMarkup{
+		InlineKeyboard: [][]models.InlineKeyboardButton{{
+			{Text: "▶️ Run", CallbackData: CallbackData(ActionRun, projectID, requestID)},
+			{Text: "✖️ Dismiss", CallbackData: CallbackData(ActionDismiss, projectID, requestID)},
+		}},
+	}
+}
@@ -0,0 +1,166 @@
+package keyboard
+
+import (
+	"testing"
+
+	"github.com/ad/gitlab-pipelines-notifier/gitlab"
+
+	"github.com/go-telegram/bot/models"
+	"github.com/google/go-cmp/cmp"
+	gl "github.com/xanzy/go-gitlab"
+)
+
+func TestParseCallbackData(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		want    *Callback
+		wantErr bool
+	}{
+		{
+			name: "good",
+			data: CallbackData(ActionRetry, 1, 2),
+			want: &Callback{
+				Action:    ActionRetry,
+				ProjectID: 1,
+				ID:        2,
+			},
+		},
+		{
+			name:    "wrong parts count",
+			data:    "retry:1",
+			wantErr: true,
+		},
+		{
+			name:    "wrong project id",
+			data:    "retry:test:2",
+			wantErr: true,
+		},
+		{
+			name:    "wrong pipeline id",
+			data:    "retry:1:test",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseCallbackData(tt.data)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseCallbackData() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func TestPipeline(t *testing.T) {
+	type args struct {
+		pipeline *gl.Pipeline
+		watching bool
+	}
+	tests := []struct {
+		name string
+		args args
+		want models.ReplyMarkup
+	}{
+		{
+			name: "nil pipeline",
+		},
+		{
+			name: "failed",
+			args: args{
+				pipeline: &gl.Pipeline{ID: 2, ProjectID: 1, Status: "failed", WebURL: "test"},
+			},
+			want: &models.InlineKeyboardMarkup{
+				InlineKeyboard: [][]models.InlineKeyboardButton{{
+					{Text: "🔁 Retry", CallbackData: "retry:1:2"},
+					{Text: "🔗 Open", URL: "test"},
+				}},
+			},
+		},
+		{
+			name: "running and watched",
+			args: args{
+				pipeline: &gl.Pipeline{ID: 2, ProjectID: 1, Status: "running"},
+				watching: true,
+			},
+			want: &models.InlineKeyboardMarkup{
+				InlineKeyboard: [][]models.InlineKeyboardButton{{
+					{Text: "🚫 Cancel", CallbackData: "cancel:1:2"},
+					{Text: "🔕 Stop watching", CallbackData: "unwatch:1:2"},
+				}},
+			},
+		},
+		{
+			name: "success without url",
+			args: args{
+				pipeline: &gl.Pipeline{ID: 2, ProjectID: 1, Status: "success"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if diff := cmp.Diff(tt.want, Pipeline(tt.args.pipeline, tt.args.watching)); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func TestExtend(t *testing.T) {
+	want := &models.InlineKeyboardMarkup{
+		InlineKeyboard: [][]models.InlineKeyboardButton{{
+			{Text: "⏰ Extend", CallbackData: "extend:0:2"},
+			{Text: "🔕 Stop watching", CallbackData: "unwatch:0:2"},
+		}},
+	}
+
+	if diff := cmp.Diff(want, Extend(2)); diff != "" {
+		t.Error(diff)
+	}
+}
+
+func TestRun(t *testing.T) {
+	want := &models.InlineKeyboardMarkup{
+		InlineKeyboard: [][]models.InlineKeyboardButton{{
+			{Text: "▶️ Run", CallbackData: "run:1:2"},
+			{Text: "✖️ Dismiss", CallbackData: "dismiss:1:2"},
+		}},
+	}
+
+	if diff := cmp.Diff(want, Run(1, 2)); diff != "" {
+		t.Error(diff)
+	}
+}
+
+func TestManual(t *testing.T) {
+	pipeline := &gl.Pipeline{ID: 2, ProjectID: 1, Status: "manual", WebURL: "https://gitlab/2"}
+	actions := []gitlab.ManualAction{
+		{JobID: 3, Name: "migrate"},
+		{JobID: 4, Name: "deploy", DeploymentID: 5},
+	}
+
+	want := &models.InlineKeyboardMarkup{
+		InlineKeyboard: [][]models.InlineKeyboardButton{
+			{{Text: "▶️ Play migrate", CallbackData: "play:1:3"}},
+			{
+				{Text: "👍 Approve deploy", CallbackData: "approve:1:5"},
+				{Text: "👎 Reject deploy", CallbackData: "reject:1:5"},
+			},
+			{
+				{Text: "🔕 Stop watching", CallbackData: "unwatch:1:2"},
+				{Text: "🔗 Open", URL: "https://gitlab/2"},
+			},
+		},
+	}
+
+	if diff := cmp.Diff(want, Manual(pipeline, actions, true)); diff != "" {
+		t.Error(diff)
+	}
+
+	if got := Manual(nil, actions, true); got != nil {
+		t.Errorf("Manual() = %v, want nil", got)
+	}
+}
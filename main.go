@@ -9,8 +9,13 @@ import (
 	"github.com/ad/gitlab-pipelines-notifier/config"
 	"github.com/ad/gitlab-pipelines-notifier/cron"
 	"github.com/ad/gitlab-pipelines-notifier/gitlab"
+	"github.com/ad/gitlab-pipelines-notifier/identity"
+	"github.com/ad/gitlab-pipelines-notifier/metrics"
+	"github.com/ad/gitlab-pipelines-notifier/reload"
+	"github.com/ad/gitlab-pipelines-notifier/store"
 	"github.com/ad/gitlab-pipelines-notifier/telegram"
 	"github.com/ad/gitlab-pipelines-notifier/track"
+	"github.com/ad/gitlab-pipelines-notifier/webhook"
 
 	"github.com/go-telegram/bot"
 
@@ -31,6 +36,10 @@ func main() {
 		log.Fatal(errInitConfig)
 	}
 
+	if conf.FilePath != "" {
+		log.Println("config loaded from", "/"+conf.FilePath)
+	}
+
 	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
 	defer cancel()
 
@@ -41,26 +50,128 @@ func main() {
 
 	gitlabClient = gl
 
-	tr := track.InitTrack(gitlabClient, conf, nil)
+	// reloaded config is published here, values used only on start can't be changed without restart
+	shared := config.NewShared(conf)
 
-	th := telegram.InitTelegramHandler(gitlabClient, conf, tr)
+	tr := track.InitTrack(gitlabClient, shared, nil)
+
+	th := telegram.InitTelegramHandler(gitlabClient, shared, tr)
 
 	opts := []bot.Option{
 		bot.WithDefaultHandler(th.Handler),
+		bot.WithCallbackQueryDataHandler("", bot.MatchTypePrefix, th.CallbackHandler),
 	}
 
 	b, _ = bot.New(conf.TelegramToken, opts...)
 
-	C = cron.InitCron(b, conf)
+	// commands in groups are addressed as /p@botname
+	if me, errGetMe := b.GetMe(ctx); errGetMe != nil {
+		log.Println("can't get bot username, commands addressed to other bots are not ignored:", errGetMe)
+	} else {
+		th.BotUsername = me.Username
+	}
+
+	th.Identities = initIdentities(conf)
+
+	C = cron.InitCron(b, shared)
 	defer C.Cron.Stop()
 
 	tr.SetCron(C)
 
+	var jobsStore store.Store = store.NewMemoryStore()
+
+	fileStore, errInitStore := store.NewFileStore("/" + store.FileName)
+	if errInitStore != nil {
+		log.Println("can't use jobs store, jobs will not survive restart:", errInitStore)
+	} else {
+		jobsStore = fileStore
+	}
+
+	C.SetStore(jobsStore)
+
+	C.RestoreJobs(gitlabClient)
+
 	C.TrackPipelines(gitlabClient)
 
+	// reload uses the same file as initial config, file set with -config or CONFIG_PATH is found again
+	watcher := reload.InitWatcher(os.Args, os.DirFS("/"), conf.FilePath, func(next *config.Config) {
+		C.Reload(next, gitlabClient)
+
+		log.Println("config reloaded, allowed ids:", shared.Load().AllowedIDsList)
+	})
+
+	go watcher.Start(ctx)
+
+	wh := webhook.InitWebhook(shared, C)
+
+	go func() {
+		if err := wh.Start(ctx); err != nil {
+			log.Println(err)
+		}
+	}()
+
+	registerMetrics(C)
+
+	metrics.SetReady(true)
+
 	log.Println("bot started")
 
-	log.Println("allowed ids:", conf.AllowedIDsList)
+	log.Println("allowed ids:", shared.Load().AllowedIDsList)
 
 	b.Start(ctx)
 }
+
+// initIdentities loads gitlab accounts linked with /login, nil disables /login
+func initIdentities(conf *config.Config) *identity.Identities {
+	if conf.IdentitySecret == "" {
+		log.Println("IDENTITY_SECRET not set, /login is disabled")
+
+		return nil
+	}
+
+	identitiesStore, errInitStore := store.NewFileStore("/" + identity.FileName)
+	if errInitStore != nil {
+		log.Println("can't use identities store, /login is disabled:", errInitStore)
+
+		return nil
+	}
+
+	identities, errIdentities := identity.New(identitiesStore, conf.IdentitySecret, func(token string) (*gl.Client, error) {
+		return gitlab.NewUserClient(conf.GitlabURL, token)
+	})
+	if errIdentities != nil {
+		log.Println("can't load identities, /login is disabled:", errIdentities)
+
+		return nil
+	}
+
+	return identities
+}
+
+// registerMetrics adds metrics which are read from cron on every scrape
+func registerMetrics(c *cron.Cron) {
+	metrics.NewGaugeFunc(
+		"gitlab_notifier_jobs",
+		"Active watches and tracked projects by kind, paused jobs are counted separately.",
+		"kind",
+		c.JobCounts,
+	)
+
+	metrics.NewCounterFunc(
+		"gitlab_notifier_poller_polls_total",
+		"Pipeline polls served by poller.",
+		"",
+		func() map[string]float64 {
+			return map[string]float64{"": float64(c.Poller.Stats().Polls)}
+		},
+	)
+
+	metrics.NewCounterFunc(
+		"gitlab_notifier_poller_requests_total",
+		"Gitlab requests made by poller.",
+		"",
+		func() map[string]float64 {
+			return map[string]float64{"": float64(c.Poller.Stats().Requests)}
+		},
+	)
+}
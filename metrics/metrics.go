@@ -0,0 +1,457 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metrics are written in prometheus text format without client library, there are only few of them
+const contentType = "text/plain; version=0.0.4; charset=utf-8"
+
+const (
+	HealthPath  = "/healthz"
+	ReadyPath   = "/readyz"
+	MetricsPath = "/metrics"
+)
+
+// FailingAfter is how long gitlab or telegram can fail without a single success before bot is not ready
+const FailingAfter = 5 * time.Minute
+
+// DefaultBuckets of request durations in seconds
+var DefaultBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+var (
+	GitlabRequests = NewHistogram(
+		"gitlab_notifier_gitlab_request_duration_seconds",
+		"Duration of gitlab api requests by endpoint.",
+		"endpoint",
+		DefaultBuckets,
+	)
+	GitlabErrors = NewCounter(
+		"gitlab_notifier_gitlab_errors_total",
+		"Failed gitlab api requests by endpoint, network errors and error statuses are counted.",
+		"endpoint",
+	)
+	TelegramFallbacks = NewCounter(
+		"gitlab_notifier_telegram_markdown_fallbacks_total",
+		"Telegram messages which failed with markdown and were sent again as plain text.",
+		"method",
+	)
+	TelegramFailures = NewCounter(
+		"gitlab_notifier_telegram_send_failures_total",
+		"Telegram messages which were not sent, plain text fallback included.",
+		"method",
+	)
+	Notifications = NewCounter(
+		"gitlab_notifier_notifications_total",
+		"Notifications sent to telegram and notifiers by type.",
+		"type",
+	)
+	NotifierFailures = NewCounter(
+		"gitlab_notifier_notifier_failures_total",
+		"Notifications which were not sent to notifiers by notifier name.",
+		"notifier",
+	)
+	Panics = NewCounter(
+		"gitlab_notifier_panics_recovered_total",
+		"Panics recovered by recovery.Recovery.",
+		"",
+	)
+)
+
+// Gitlab and Telegram are failing when all their requests fail for FailingAfter
+var (
+	Gitlab   = &Streak{}
+	Telegram = &Streak{}
+)
+
+var registry = struct {
+	mu      sync.Mutex
+	metrics []metric
+	ready   bool
+}{}
+
+type metric interface {
+	name() string
+	write(w io.Writer)
+}
+
+func register(m metric) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+
+	// registering the same name again replaces metric, funcs are registered again with new sources
+	for i, item := range registry.metrics {
+		if item.name() == m.name() {
+			registry.metrics[i] = m
+
+			return
+		}
+	}
+
+	registry.metrics = append(registry.metrics, m)
+}
+
+// SetReady marks bot as started, /readyz fails before it
+func SetReady(ready bool) {
+	registry.mu.Lock()
+	registry.ready = ready
+	registry.mu.Unlock()
+}
+
+// Counter is counter with one optional label
+type Counter struct {
+	metricName string
+	help       string
+	label      string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func NewCounter(name, help, label string) *Counter {
+	c := &Counter{
+		metricName: name,
+		help:       help,
+		label:      label,
+		values:     map[string]float64{},
+	}
+
+	register(c)
+
+	return c
+}
+
+// Inc adds one to counter with label value, label value is ignored if counter has no label
+func (c *Counter) Inc(value string) {
+	c.Add(value, 1)
+}
+
+func (c *Counter) Add(value string, delta float64) {
+	if c.label == "" {
+		value = ""
+	}
+
+	c.mu.Lock()
+	c.values[value] += delta
+	c.mu.Unlock()
+}
+
+// Value returns current value of counter with label value
+func (c *Counter) Value(value string) float64 {
+	if c.label == "" {
+		value = ""
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.values[value]
+}
+
+func (c *Counter) name() string {
+	return c.metricName
+}
+
+func (c *Counter) write(w io.Writer) {
+	c.mu.Lock()
+	values := make(map[string]float64, len(c.values))
+	for value, count := range c.values {
+		values[value] = count
+	}
+	c.mu.Unlock()
+
+	writeHeader(w, c.metricName, c.help, "counter")
+	writeValues(w, c.metricName, c.label, values)
+}
+
+// Histogram is histogram with one label
+type Histogram struct {
+	metricName string
+	help       string
+	label      string
+	buckets    []float64
+
+	mu     sync.Mutex
+	series map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func NewHistogram(name, help, label string, buckets []float64) *Histogram {
+	h := &Histogram{
+		metricName: name,
+		help:       help,
+		label:      label,
+		buckets:    buckets,
+		series:     map[string]*histogramSeries{},
+	}
+
+	register(h)
+
+	return h
+}
+
+// Observe adds value to histogram with label value
+func (h *Histogram) Observe(value string, v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s, ok := h.series[value]
+	if !ok {
+		s = &histogramSeries{counts: make([]uint64, len(h.buckets))}
+		h.series[value] = s
+	}
+
+	for i, bucket := range h.buckets {
+		if v <= bucket {
+			s.counts[i]++
+		}
+	}
+
+	s.count++
+	s.sum += v
+}
+
+// Count returns count of observed values with label value
+func (h *Histogram) Count(value string) uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if s, ok := h.series[value]; ok {
+		return s.count
+	}
+
+	return 0
+}
+
+func (h *Histogram) name() string {
+	return h.metricName
+}
+
+func (h *Histogram) write(w io.Writer) {
+	writeHeader(w, h.metricName, h.help, "histogram")
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, value := range sortedKeys(h.series) {
+		s := h.series[value]
+		labels := formatLabel(h.label, value)
+
+		for i, bucket := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket{%s} %d\n", h.metricName, joinLabels(labels, formatLabel("le", formatFloat(bucket))), s.counts[i])
+		}
+
+		fmt.Fprintf(w, "%s_bucket{%s} %d\n", h.metricName, joinLabels(labels, formatLabel("le", "+Inf")), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.metricName, braces(labels), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.metricName, braces(labels), s.count)
+	}
+}
+
+// Func is gauge or counter which value is read from fn on every scrape,
+// fn returns values by label value, single value has empty label value
+type Func struct {
+	metricName string
+	help       string
+	kind       string
+	label      string
+	fn         func() map[string]float64
+}
+
+// NewGaugeFunc registers gauge, gauge with the same name is replaced
+func NewGaugeFunc(name, help, label string, fn func() map[string]float64) *Func {
+	f := &Func{metricName: name, help: help, kind: "gauge", label: label, fn: fn}
+
+	register(f)
+
+	return f
+}
+
+// NewCounterFunc registers counter, counter with the same name is replaced
+func NewCounterFunc(name, help, label string, fn func() map[string]float64) *Func {
+	f := &Func{metricName: name, help: help, kind: "counter", label: label, fn: fn}
+
+	register(f)
+
+	return f
+}
+
+func (f *Func) name() string {
+	return f.metricName
+}
+
+func (f *Func) write(w io.Writer) {
+	writeHeader(w, f.metricName, f.help, f.kind)
+	writeValues(w, f.metricName, f.label, f.fn())
+}
+
+// Streak keeps start of failures in a row, any success resets it
+type Streak struct {
+	mu    sync.Mutex
+	since time.Time
+}
+
+// Observe records result of request
+func (s *Streak) Observe(err error, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err == nil {
+		s.since = time.Time{}
+
+		return
+	}
+
+	if s.since.IsZero() {
+		s.since = now
+	}
+}
+
+// Failing reports whether all requests failed for at least d
+func (s *Streak) Failing(now time.Time, d time.Duration) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return !s.since.IsZero() && now.Sub(s.since) >= d
+}
+
+// Register adds health, readiness and metrics handlers to mux
+func Register(mux *http.ServeMux) {
+	mux.HandleFunc(HealthPath, HealthHandler)
+	mux.HandleFunc(ReadyPath, ReadyHandler)
+	mux.HandleFunc(MetricsPath, Handler)
+}
+
+// HealthHandler responds ok while process is alive
+func HealthHandler(w http.ResponseWriter, r *http.Request) {
+	_, _ = io.WriteString(w, "ok\n")
+}
+
+// ReadyHandler responds ok when bot is started and gitlab and telegram are not failing
+func ReadyHandler(w http.ResponseWriter, r *http.Request) {
+	problems := notReady(time.Now())
+	if len(problems) > 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = io.WriteString(w, strings.Join(problems, "\n")+"\n")
+
+		return
+	}
+
+	_, _ = io.WriteString(w, "ok\n")
+}
+
+func notReady(now time.Time) []string {
+	problems := []string{}
+
+	registry.mu.Lock()
+	ready := registry.ready
+	registry.mu.Unlock()
+
+	if !ready {
+		problems = append(problems, "bot is not started")
+	}
+
+	if Gitlab.Failing(now, FailingAfter) {
+		problems = append(problems, "gitlab requests are failing")
+	}
+
+	if Telegram.Failing(now, FailingAfter) {
+		problems = append(problems, "telegram messages are failing")
+	}
+
+	return problems
+}
+
+// Handler writes all metrics in prometheus text format
+func Handler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", contentType)
+
+	Write(w)
+}
+
+// Write writes all metrics in prometheus text format
+func Write(w io.Writer) {
+	registry.mu.Lock()
+	metrics := append([]metric{}, registry.metrics...)
+	registry.mu.Unlock()
+
+	for _, m := range metrics {
+		m.write(w)
+	}
+}
+
+func writeHeader(w io.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func writeValues(w io.Writer, name, label string, values map[string]float64) {
+	if label == "" {
+		fmt.Fprintf(w, "%s %s\n", name, formatFloat(values[""]))
+
+		return
+	}
+
+	for _, value := range sortedKeys(values) {
+		fmt.Fprintf(w, "%s{%s} %s\n", name, formatLabel(label, value), formatFloat(values[value]))
+	}
+}
+
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabel(label, value string) string {
+	if label == "" {
+		return ""
+	}
+
+	return label + `="` + labelEscaper.Replace(value) + `"`
+}
+
+func joinLabels(labels ...string) string {
+	nonEmpty := []string{}
+	for _, label := range labels {
+		if label != "" {
+			nonEmpty = append(nonEmpty, label)
+		}
+	}
+
+	return strings.Join(nonEmpty, ",")
+}
+
+func braces(labels string) string {
+	if labels == "" {
+		return ""
+	}
+
+	return "{" + labels + "}"
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,123 @@
+package metrics
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWrite(t *testing.T) {
+	counter := NewCounter("test_events_total", "Test events.", "type")
+	counter.Inc("b")
+	counter.Inc("a")
+	counter.Add("a", 2)
+
+	single := NewCounter("test_single_total", "Test single.", "")
+	single.Inc("ignored")
+
+	histogram := NewHistogram("test_duration_seconds", "Test duration.", "endpoint", []float64{0.1, 1})
+	histogram.Observe(`GET /"x"`, 0.5)
+
+	NewGaugeFunc("test_jobs", "Test jobs.", "kind", func() map[string]float64 {
+		return map[string]float64{"pipeline": 2}
+	})
+
+	// registering again replaces previous func
+	NewGaugeFunc("test_jobs", "Test jobs.", "kind", func() map[string]float64 {
+		return map[string]float64{"pipeline": 3}
+	})
+
+	out := &strings.Builder{}
+	Write(out)
+
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"counter type", "# TYPE test_events_total counter\n"},
+		{"counter sorted", "test_events_total{type=\"a\"} 3\ntest_events_total{type=\"b\"} 1\n"},
+		{"counter without label", "test_single_total 1\n"},
+		{"histogram bucket", "test_duration_seconds_bucket{endpoint=\"GET /\\\"x\\\"\",le=\"0.1\"} 0\n"},
+		{"histogram upper bucket", "test_duration_seconds_bucket{endpoint=\"GET /\\\"x\\\"\",le=\"1\"} 1\n"},
+		{"histogram inf bucket", "test_duration_seconds_bucket{endpoint=\"GET /\\\"x\\\"\",le=\"+Inf\"} 1\n"},
+		{"histogram sum", "test_duration_seconds_sum{endpoint=\"GET /\\\"x\\\"\"} 0.5\n"},
+		{"histogram count", "test_duration_seconds_count{endpoint=\"GET /\\\"x\\\"\"} 1\n"},
+		{"gauge func", "# TYPE test_jobs gauge\ntest_jobs{kind=\"pipeline\"} 3\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if !strings.Contains(out.String(), tt.want) {
+				t.Errorf("Write() = %s, want to contain %s", out.String(), tt.want)
+			}
+		})
+	}
+
+	if got := strings.Count(out.String(), "# TYPE test_jobs "); got != 1 {
+		t.Errorf("Write() has %d test_jobs metrics, want 1", got)
+	}
+}
+
+func TestStreak_Failing(t *testing.T) {
+	now := time.Now()
+	errFailed := errors.New("failed")
+
+	tests := []struct {
+		name    string
+		results []error
+		after   time.Duration
+		want    bool
+	}{
+		{"no requests", nil, time.Hour, false},
+		{"success", []error{nil}, time.Hour, false},
+		{"short failure", []error{errFailed, errFailed}, time.Minute, false},
+		{"long failure", []error{errFailed, errFailed}, FailingAfter, true},
+		{"recovered", []error{errFailed, nil}, FailingAfter, false},
+		{"failed again", []error{errFailed, nil, errFailed}, time.Minute, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Streak{}
+			for _, err := range tt.results {
+				s.Observe(err, now)
+			}
+
+			if got := s.Failing(now.Add(tt.after), FailingAfter); got != tt.want {
+				t.Errorf("Streak.Failing() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadyHandler(t *testing.T) {
+	tests := []struct {
+		name     string
+		ready    bool
+		gitlab   error
+		wantCode int
+		wantBody string
+	}{
+		{"not started", false, nil, http.StatusServiceUnavailable, "bot is not started\n"},
+		{"ready", true, nil, http.StatusOK, "ok\n"},
+		{"gitlab failing", true, errors.New("failed"), http.StatusServiceUnavailable, "gitlab requests are failing\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			SetReady(tt.ready)
+			defer SetReady(false)
+
+			Gitlab.Observe(nil, time.Now())
+			Gitlab.Observe(tt.gitlab, time.Now().Add(-FailingAfter))
+			defer Gitlab.Observe(nil, time.Now())
+
+			w := httptest.NewRecorder()
+			ReadyHandler(w, httptest.NewRequest(http.MethodGet, ReadyPath, nil))
+
+			if w.Code != tt.wantCode || w.Body.String() != tt.wantBody {
+				t.Errorf("ReadyHandler() = %d %q, want %d %q", w.Code, w.Body.String(), tt.wantCode, tt.wantBody)
+			}
+		})
+	}
+}
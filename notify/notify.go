@@ -0,0 +1,286 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/ad/gitlab-pipelines-notifier/config"
+	"github.com/ad/gitlab-pipelines-notifier/metrics"
+
+	"github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+	gl "github.com/xanzy/go-gitlab"
+)
+
+// Message is notification, Text is written in markdown of telegram messages and converted for other services
+type Message struct {
+	Type     string       `json:"type"`
+	Project  string       `json:"project,omitempty"`
+	Text     string       `json:"text"`
+	Pipeline *gl.Pipeline `json:"pipeline,omitempty"`
+}
+
+// Notifier sends notifications to chat or service
+type Notifier interface {
+	Notify(ctx context.Context, message Message) error
+}
+
+// requestTimeout limits webhook requests, slow service should not block polling
+const requestTimeout = 10 * time.Second
+
+// discord rejects messages longer than 2000 characters
+const maxDiscordMessageSize = 2000
+
+var httpClient = &http.Client{Timeout: requestTimeout}
+
+// New creates notifier from config, b is used by telegram notifiers
+func New(conf config.Notifier, b *bot.Bot) (Notifier, error) {
+	switch conf.Type {
+	case "telegram":
+		return NewTelegram(b, conf.Chat).InThread(conf.Thread), nil
+	case "slack":
+		return &Slack{URL: conf.URL}, nil
+	case "mattermost":
+		return &Mattermost{URL: conf.URL}, nil
+	case "teams":
+		return &Teams{URL: conf.URL}, nil
+	case "discord":
+		return &Discord{URL: conf.URL}, nil
+	case "webhook":
+		return &Webhook{URL: conf.URL}, nil
+	}
+
+	return nil, fmt.Errorf("unknown notifier type %s", conf.Type)
+}
+
+// Telegram sends messages to telegram chat, markdown messages which telegram can't parse are sent as plain text.
+// ThreadID is forum topic of chat, zero is general topic or chat without topics
+type Telegram struct {
+	Bot      *bot.Bot
+	ChatID   int64
+	ThreadID int
+}
+
+func NewTelegram(b *bot.Bot, chatID int64) *Telegram {
+	return &Telegram{Bot: b, ChatID: chatID}
+}
+
+// InThread sends messages to forum topic of chat
+func (t *Telegram) InThread(threadID int) *Telegram {
+	t.ThreadID = threadID
+
+	return t
+}
+
+func (t *Telegram) Notify(ctx context.Context, message Message) error {
+	_, err := t.Send(ctx, message.Text, nil)
+
+	return err
+}
+
+// Send sends message with keyboard, sent message is returned so it can be edited later
+func (t *Telegram) Send(ctx context.Context, message string, replyMarkup models.ReplyMarkup) (*models.Message, error) {
+	if t.Bot == nil {
+		return nil, fmt.Errorf("%s", "bot not set")
+	}
+
+	if t.ChatID == 0 {
+		return nil, fmt.Errorf("%s", "empty user id")
+	}
+
+	if message == "" {
+		return nil, fmt.Errorf("%s", "empty message")
+	}
+
+	sentMessage, errSendMarkdownMessage := t.Bot.SendMessage(ctx, &bot.SendMessageParams{
+		ChatID:          t.ChatID,
+		MessageThreadID: t.ThreadID,
+		Text:            message,
+		ParseMode:       models.ParseModeMarkdown,
+		ReplyMarkup:     replyMarkup,
+	})
+
+	if errSendMarkdownMessage != nil {
+		metrics.TelegramFallbacks.Inc("send_message")
+
+		var errSendMessage error
+
+		sentMessage, errSendMessage = t.Bot.SendMessage(ctx, &bot.SendMessageParams{
+			ChatID:          t.ChatID,
+			MessageThreadID: t.ThreadID,
+			Text:            escapeMarkdown(message),
+			ReplyMarkup:     replyMarkup,
+		})
+
+		metrics.Telegram.Observe(errSendMessage, time.Now())
+
+		if errSendMessage != nil {
+			metrics.TelegramFailures.Inc("send_message")
+
+			return nil, errSendMessage
+		}
+	}
+
+	metrics.Telegram.Observe(nil, time.Now())
+
+	return sentMessage, nil
+}
+
+// Edit replaces text and keyboard of already sent message, markdown which telegram can't parse is sent as plain text
+func (t *Telegram) Edit(ctx context.Context, messageID int, message string, replyMarkup models.ReplyMarkup) error {
+	if t.Bot == nil {
+		return fmt.Errorf("%s", "bot not set")
+	}
+
+	if t.ChatID == 0 || messageID == 0 {
+		return fmt.Errorf("%s", "empty chat or message id")
+	}
+
+	if message == "" {
+		return fmt.Errorf("%s", "empty message")
+	}
+
+	_, errEditMarkdownMessage := t.Bot.EditMessageText(ctx, &bot.EditMessageTextParams{
+		ChatID:      t.ChatID,
+		MessageID:   messageID,
+		Text:        message,
+		ParseMode:   models.ParseModeMarkdown,
+		ReplyMarkup: replyMarkup,
+	})
+
+	if errEditMarkdownMessage != nil {
+		metrics.TelegramFallbacks.Inc("edit_message")
+
+		_, errEditMessage := t.Bot.EditMessageText(ctx, &bot.EditMessageTextParams{
+			ChatID:      t.ChatID,
+			MessageID:   messageID,
+			Text:        escapeMarkdown(message),
+			ReplyMarkup: replyMarkup,
+		})
+
+		if errEditMessage != nil {
+			metrics.TelegramFailures.Inc("edit_message")
+
+			return errEditMessage
+		}
+	}
+
+	return nil
+}
+
+const shouldBeEscaped = "[]()>#+-=|{}.!"
+
+func escapeMarkdown(s string) string {
+	var result []rune
+	for _, r := range s {
+		if strings.ContainsRune(shouldBeEscaped, r) {
+			result = append(result, '\\')
+		}
+		result = append(result, r)
+	}
+	return string(result)
+}
+
+// Slack sends messages to slack incoming webhook
+type Slack struct {
+	URL string
+}
+
+func (s *Slack) Notify(ctx context.Context, message Message) error {
+	return postJSON(ctx, s.URL, map[string]string{"text": slackText(message.Text)})
+}
+
+var (
+	boldPattern = regexp.MustCompile(`\*\*(.+?)\*\*`)
+	linkPattern = regexp.MustCompile(`\[([^\]]+)\]\(([^)\s]+)\)`)
+)
+
+// slackText converts markdown to slack mrkdwn, bold is *text* and links are <url|text>
+func slackText(text string) string {
+	text = linkPattern.ReplaceAllString(text, "<$2|$1>")
+
+	return boldPattern.ReplaceAllString(text, "*$1*")
+}
+
+// Mattermost sends messages to mattermost incoming webhook, mattermost understands markdown as is
+type Mattermost struct {
+	URL string
+}
+
+func (m *Mattermost) Notify(ctx context.Context, message Message) error {
+	return postJSON(ctx, m.URL, map[string]string{"text": message.Text})
+}
+
+// Teams sends messages to microsoft teams incoming webhook
+type Teams struct {
+	URL string
+}
+
+func (t *Teams) Notify(ctx context.Context, message Message) error {
+	// teams joins single line breaks, every line is a paragraph
+	return postJSON(ctx, t.URL, map[string]string{
+		"@type":    "MessageCard",
+		"@context": "https://schema.org/extensions",
+		"summary":  message.Type,
+		"text":     strings.ReplaceAll(message.Text, "\n", "\n\n"),
+	})
+}
+
+// Discord sends messages to discord webhook
+type Discord struct {
+	URL string
+}
+
+func (d *Discord) Notify(ctx context.Context, message Message) error {
+	text := message.Text
+	if runes := []rune(text); len(runes) > maxDiscordMessageSize {
+		text = string(runes[:maxDiscordMessageSize-1]) + "…"
+	}
+
+	return postJSON(ctx, d.URL, map[string]string{"content": text})
+}
+
+// Webhook posts Message as json to any url
+type Webhook struct {
+	URL string
+}
+
+func (w *Webhook) Notify(ctx context.Context, message Message) error {
+	return postJSON(ctx, w.URL, message)
+}
+
+func postJSON(ctx context.Context, url string, payload any) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("notifier responded with %d", resp.StatusCode)
+	}
+
+	return nil
+}
@@ -0,0 +1,198 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ad/gitlab-pipelines-notifier/config"
+
+	"github.com/go-telegram/bot"
+	"github.com/google/go-cmp/cmp"
+	gl "github.com/xanzy/go-gitlab"
+)
+
+func TestNew(t *testing.T) {
+	message := Message{
+		Type:     "project",
+		Project:  "group/project",
+		Text:     "**pipeline status changed**\n[#1](https://gitlab/1) failed",
+		Pipeline: &gl.Pipeline{ID: 1, Status: "failed"},
+	}
+
+	tests := []struct {
+		name    string
+		conf    config.Notifier
+		status  int
+		want    map[string]any
+		wantErr bool
+	}{
+		{
+			name:   "slack",
+			conf:   config.Notifier{Type: "slack"},
+			status: http.StatusOK,
+			want:   map[string]any{"text": "*pipeline status changed*\n<https://gitlab/1|#1> failed"},
+		},
+		{
+			name:   "mattermost",
+			conf:   config.Notifier{Type: "mattermost"},
+			status: http.StatusOK,
+			want:   map[string]any{"text": message.Text},
+		},
+		{
+			name:   "teams",
+			conf:   config.Notifier{Type: "teams"},
+			status: http.StatusOK,
+			want: map[string]any{
+				"@type":    "MessageCard",
+				"@context": "https://schema.org/extensions",
+				"summary":  "project",
+				"text":     "**pipeline status changed**\n\n[#1](https://gitlab/1) failed",
+			},
+		},
+		{
+			name:   "discord",
+			conf:   config.Notifier{Type: "discord"},
+			status: http.StatusNoContent,
+			want:   map[string]any{"content": message.Text},
+		},
+		{
+			name:   "webhook",
+			conf:   config.Notifier{Type: "webhook"},
+			status: http.StatusOK,
+			want: map[string]any{
+				"type":     "project",
+				"project":  "group/project",
+				"text":     message.Text,
+				"pipeline": 1.0,
+			},
+		},
+		{
+			name:    "error status",
+			conf:    config.Notifier{Type: "mattermost"},
+			status:  http.StatusBadRequest,
+			want:    map[string]any{"text": message.Text},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got map[string]any
+
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+				_ = json.Unmarshal(body, &got)
+
+				w.WriteHeader(tt.status)
+			}))
+			defer server.Close()
+
+			tt.conf.URL = server.URL
+
+			notifier, err := New(tt.conf, nil)
+			if err != nil {
+				t.Fatalf("New() error = %v", err)
+			}
+
+			if err := notifier.Notify(context.Background(), message); (err != nil) != tt.wantErr {
+				t.Errorf("Notify() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			// only id of pipeline is compared, other fields are marshaled by go-gitlab
+			if pipeline, ok := got["pipeline"].(map[string]any); ok {
+				got["pipeline"] = pipeline["id"]
+			}
+
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("Notify() payload mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestNew_unknown(t *testing.T) {
+	if _, err := New(config.Notifier{Type: "icq"}, nil); err == nil {
+		t.Error("New() error = nil, want error")
+	}
+}
+
+func TestTelegram_Send(t *testing.T) {
+	tests := []struct {
+		name    string
+		b       *bot.Bot
+		chatID  int64
+		message string
+	}{
+		{"bot not set", nil, 1, "test"},
+		{"empty chat", &bot.Bot{}, 0, "test"},
+		{"empty message", &bot.Bot{}, 1, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewTelegram(tt.b, tt.chatID).Send(context.Background(), tt.message, nil); err == nil {
+				t.Error("Telegram.Send() error = nil, want error")
+			}
+		})
+	}
+}
+
+func TestTelegram_Edit(t *testing.T) {
+	tests := []struct {
+		name      string
+		b         *bot.Bot
+		chatID    int64
+		messageID int
+		message   string
+	}{
+		{"bot not set", nil, 1, 1, "test"},
+		{"empty chat", &bot.Bot{}, 0, 1, "test"},
+		{"empty message id", &bot.Bot{}, 1, 0, "test"},
+		{"empty message", &bot.Bot{}, 1, 1, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := NewTelegram(tt.b, tt.chatID).Edit(context.Background(), tt.messageID, tt.message, nil); err == nil {
+				t.Error("Telegram.Edit() error = nil, want error")
+			}
+		})
+	}
+}
+
+func Test_escapeMarkdown(t *testing.T) {
+	tests := []struct {
+		name string
+		s    string
+		want string
+	}{
+		{"empty string", "", ""},
+		{"escaped string", "[]()>#+-=|{}.!", "\\[\\]\\(\\)\\>\\#\\+\\-\\=\\|\\{\\}\\.\\!"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := escapeMarkdown(tt.s); got != tt.want {
+				t.Errorf("escapeMarkdown() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_slackText(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"plain", "plain"},
+		{"**bold** and **more**", "*bold* and *more*"},
+		{"[link](https://gitlab/1)", "<https://gitlab/1|link>"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.text, func(t *testing.T) {
+			if got := slackText(tt.text); got != tt.want {
+				t.Errorf("slackText() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -3,10 +3,14 @@ package recovery
 import (
 	"fmt"
 	"runtime/debug"
+
+	"github.com/ad/gitlab-pipelines-notifier/metrics"
 )
 
 func Recovery() {
 	if r := recover(); r != nil {
+		metrics.Panics.Inc("")
+
 		fmt.Println("recovered from ", r)
 		debug.PrintStack()
 	}
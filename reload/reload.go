@@ -0,0 +1,115 @@
+package reload
+
+import (
+	"context"
+	"io/fs"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/ad/gitlab-pipelines-notifier/config"
+	"github.com/ad/gitlab-pipelines-notifier/recovery"
+)
+
+// DefaultInterval is how often config file is checked for changes
+const DefaultInterval = 5 * time.Second
+
+// Watcher reloads config when config file changes or SIGHUP is received
+type Watcher struct {
+	Args       []string
+	FileSystem fs.FS
+	Filename   string
+	Interval   time.Duration
+
+	// OnReload is called with successfully reloaded config, config with errors is ignored
+	OnReload func(conf *config.Config)
+
+	modTime time.Time
+}
+
+// InitWatcher returns watcher for config loaded with the same args, file system and filename
+func InitWatcher(args []string, fileSystem fs.FS, filename string, onReload func(conf *config.Config)) *Watcher {
+	w := &Watcher{
+		Args:       args,
+		FileSystem: fileSystem,
+		Filename:   filename,
+		Interval:   DefaultInterval,
+		OnReload:   onReload,
+	}
+
+	w.modTime, _ = w.fileModTime()
+
+	return w
+}
+
+// Start watches for changes until ctx is done
+func (w *Watcher) Start(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	ticker := time.NewTicker(w.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			log.Println("SIGHUP received, reloading config")
+
+			w.Reload()
+		case <-ticker.C:
+			if w.changed() {
+				log.Println("config file changed, reloading config")
+
+				w.Reload()
+			}
+		}
+	}
+}
+
+// Reload reads config again and passes it to OnReload, returns false if config has errors
+func (w *Watcher) Reload() bool {
+	defer recovery.Recovery()
+
+	conf, err := config.InitConfig(w.Args, w.FileSystem, w.Filename)
+	if err != nil {
+		log.Printf("error reloading config, previous config is kept: %s", err)
+
+		return false
+	}
+
+	if w.OnReload != nil {
+		w.OnReload(conf)
+	}
+
+	return true
+}
+
+// changed reports whether config file modification time differs from previous check
+func (w *Watcher) changed() bool {
+	modTime, err := w.fileModTime()
+	if err != nil || modTime.Equal(w.modTime) {
+		return false
+	}
+
+	w.modTime = modTime
+
+	return true
+}
+
+func (w *Watcher) fileModTime() (time.Time, error) {
+	if w.FileSystem == nil || w.Filename == "" {
+		return time.Time{}, fs.ErrNotExist
+	}
+
+	info, err := fs.Stat(w.FileSystem, w.Filename)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return info.ModTime(), nil
+}
@@ -0,0 +1,73 @@
+package reload
+
+import (
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/ad/gitlab-pipelines-notifier/config"
+)
+
+const testConfig = `{
+	"TELEGRAM_TOKEN": "test",
+	"ALLOWED_IDS": "12345",
+	"GITLAB_TOKEN": "bla_blabla",
+	"GITLAB_URL": "https://git.mydomain.com/api/v4"
+}`
+
+func TestWatcher(t *testing.T) {
+	m := fstest.MapFS{
+		"data/options.json": {
+			Data:    []byte(testConfig),
+			ModTime: time.Unix(1, 0),
+		},
+	}
+
+	var reloaded *config.Config
+
+	w := InitWatcher([]string{""}, m, "data/options.json", func(conf *config.Config) {
+		reloaded = conf
+	})
+
+	if w.changed() {
+		t.Error("changed() = true for the same file")
+	}
+
+	m["data/options.json"] = &fstest.MapFile{
+		Data:    []byte(`{"TELEGRAM_TOKEN": "test"}`),
+		ModTime: time.Unix(2, 0),
+	}
+
+	if !w.changed() {
+		t.Error("changed() = false for modified file")
+	}
+
+	if w.Reload() {
+		t.Error("Reload() = true for config with errors")
+	}
+
+	if reloaded != nil {
+		t.Error("Reload() called OnReload for config with errors")
+	}
+
+	m["data/options.json"] = &fstest.MapFile{
+		Data:    []byte(testConfig),
+		ModTime: time.Unix(3, 0),
+	}
+
+	if !w.Reload() {
+		t.Fatal("Reload() = false for good config")
+	}
+
+	if reloaded == nil || reloaded.TelegramToken != "test" {
+		t.Errorf("Reload() config = %#v", reloaded)
+	}
+}
+
+func TestWatcher_withoutFile(t *testing.T) {
+	w := InitWatcher([]string{""}, nil, "", nil)
+
+	if w.changed() {
+		t.Error("changed() = true without file")
+	}
+}
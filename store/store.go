@@ -0,0 +1,146 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const FileName = "data/jobs.json"
+
+// Store keeps serialized records by key, so jobs can survive restarts
+type Store interface {
+	Load() (map[string]json.RawMessage, error)
+	Save(key string, record json.RawMessage) error
+	Delete(key string) error
+}
+
+// MemoryStore keeps records in memory only
+type MemoryStore struct {
+	mu      sync.RWMutex
+	records map[string]json.RawMessage
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		records: make(map[string]json.RawMessage),
+	}
+}
+
+func (s *MemoryStore) Load() (map[string]json.RawMessage, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	records := make(map[string]json.RawMessage, len(s.records))
+	for key, record := range s.records {
+		records[key] = record
+	}
+
+	return records, nil
+}
+
+func (s *MemoryStore) Save(key string, record json.RawMessage) error {
+	s.mu.Lock()
+	s.records[key] = record
+	s.mu.Unlock()
+
+	return nil
+}
+
+func (s *MemoryStore) Delete(key string) error {
+	s.mu.Lock()
+	delete(s.records, key)
+	s.mu.Unlock()
+
+	return nil
+}
+
+// FileStore keeps records in a single json file, the file is rewritten on every change
+type FileStore struct {
+	mu      sync.Mutex
+	path    string
+	records map[string]json.RawMessage
+}
+
+func NewFileStore(path string) (*FileStore, error) {
+	if path == "" {
+		return nil, fmt.Errorf("%s", "empty store path")
+	}
+
+	s := &FileStore{
+		path:    path,
+		records: make(map[string]json.RawMessage),
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s, nil
+		}
+
+		return nil, fmt.Errorf("can't read store file, %s", err.Error())
+	}
+
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &s.records); err != nil {
+			return nil, fmt.Errorf("error on unmarshal store file %s", err.Error())
+		}
+	}
+
+	return s, nil
+}
+
+func (s *FileStore) Load() (map[string]json.RawMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	records := make(map[string]json.RawMessage, len(s.records))
+	for key, record := range s.records {
+		records[key] = record
+	}
+
+	return records, nil
+}
+
+func (s *FileStore) Save(key string, record json.RawMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.records[key] = record
+
+	return s.flush()
+}
+
+func (s *FileStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.records[key]; !ok {
+		return nil
+	}
+
+	delete(s.records, key)
+
+	return s.flush()
+}
+
+// flush writes records to a temp file and renames it, so a crash never leaves a half-written store
+func (s *FileStore) flush() error {
+	data, err := json.MarshalIndent(s.records, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o755); err != nil {
+		return err
+	}
+
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, s.path)
+}
@@ -0,0 +1,108 @@
+package store
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestMemoryStore(t *testing.T) {
+	s := NewMemoryStore()
+
+	if err := s.Save("test", json.RawMessage(`{"key":"test"}`)); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+
+	records, _ := s.Load()
+	if diff := cmp.Diff(map[string]json.RawMessage{"test": json.RawMessage(`{"key":"test"}`)}, records); diff != "" {
+		t.Fatal(diff)
+	}
+
+	if err := s.Delete("test"); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+
+	records, _ = s.Load()
+	if len(records) != 0 {
+		t.Fatalf("Load() = %v, want empty", records)
+	}
+}
+
+func TestNewFileStore(t *testing.T) {
+	dir := t.TempDir()
+
+	if err := os.WriteFile(filepath.Join(dir, "bad.json"), []byte(`test`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		path    string
+		wantErr bool
+	}{
+		{
+			name:    "empty path",
+			wantErr: true,
+		},
+		{
+			name: "file not exists",
+			path: filepath.Join(dir, "data", "jobs.json"),
+		},
+		{
+			name:    "bad file",
+			path:    filepath.Join(dir, "bad.json"),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewFileStore(tt.path); (err != nil) != tt.wantErr {
+				t.Errorf("NewFileStore() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestFileStore_SaveLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data", "jobs.json")
+
+	s, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Save("a", json.RawMessage(`{"count":1}`)); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+
+	if err := s.Save("b", json.RawMessage(`{"count":2}`)); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+
+	if err := s.Delete("a"); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+
+	reopened, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records, _ := reopened.Load()
+
+	got := map[string]map[string]int{}
+	for key, record := range records {
+		v := map[string]int{}
+		if err := json.Unmarshal(record, &v); err != nil {
+			t.Fatal(err)
+		}
+		got[key] = v
+	}
+
+	if diff := cmp.Diff(map[string]map[string]int{"b": {"count": 2}}, got); diff != "" {
+		t.Fatal(diff)
+	}
+}
@@ -2,14 +2,24 @@ package telegram
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"math/rand/v2"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/ad/gitlab-pipelines-notifier/access"
 	"github.com/ad/gitlab-pipelines-notifier/config"
+	"github.com/ad/gitlab-pipelines-notifier/cron"
 	"github.com/ad/gitlab-pipelines-notifier/gitlab"
+	"github.com/ad/gitlab-pipelines-notifier/gitlaburl"
+	"github.com/ad/gitlab-pipelines-notifier/identity"
+	"github.com/ad/gitlab-pipelines-notifier/keyboard"
+	"github.com/ad/gitlab-pipelines-notifier/notify"
 	"github.com/ad/gitlab-pipelines-notifier/recovery"
 	"github.com/ad/gitlab-pipelines-notifier/track"
 
@@ -21,11 +31,19 @@ import (
 
 type TelegramHandler struct {
 	GitlabClient *gl.Client
-	Conf         *config.Config
+	Conf         *config.Shared
 	Track        *track.Track
+
+	// BotUsername is used to parse commands addressed as /p@botname in group chats
+	BotUsername string
+
+	// Identities are gitlab accounts linked with /login, nil if IDENTITY_SECRET is not set
+	Identities *identity.Identities
+
+	runs runRequests
 }
 
-func InitTelegramHandler(gitlabClient *gl.Client, conf *config.Config, tr *track.Track) *TelegramHandler {
+func InitTelegramHandler(gitlabClient *gl.Client, conf *config.Shared, tr *track.Track) *TelegramHandler {
 	th := &TelegramHandler{
 		GitlabClient: gitlabClient,
 		Conf:         conf,
@@ -35,125 +53,411 @@ func InitTelegramHandler(gitlabClient *gl.Client, conf *config.Config, tr *track
 	return th
 }
 
-const shouldBeEscaped = "[]()>#+-=|{}.!"
-
-func escapeMarkdown(s string) string {
-	var result []rune
-	for _, r := range s {
-		if strings.ContainsRune(shouldBeEscaped, r) {
-			result = append(result, '\\')
-		}
-		result = append(result, r)
-	}
-	return string(result)
-}
-
 func (th *TelegramHandler) Handler(ctx context.Context, b *bot.Bot, update *models.Update) {
 	defer recovery.Recovery()
 
 	incomingMessage := ""
 	var toID int64 = 0
 
+	var msg *models.Message
+
 	if update.EditedMessage != nil && update.EditedMessage.Text != "" {
-		log.Printf("update %#v\n", update.EditedMessage.Text)
+		log.Printf("update %#v\n", redactToken(update.EditedMessage.Text))
 
-		incomingMessage = update.EditedMessage.Text
-		toID = update.EditedMessage.Chat.ID
+		msg = update.EditedMessage
 	}
 
 	if update.Message != nil {
-		incomingMessage = update.Message.Text
-		toID = update.Message.Chat.ID
+		msg = update.Message
+	}
+
+	if msg != nil {
+		incomingMessage = msg.Text
+		toID = msg.Chat.ID
 	}
 
 	if incomingMessage != "" && toID != 0 {
-		if !isAllowedID(th.Conf, toID) {
-			log.Printf("you are not allowed to use this bot, your id: %d", toID)
+		command, addressed := th.parseCommand(incomingMessage)
+		if !addressed {
+			return
+		}
 
-			_ = SendMessage(ctx, b, toID, fmt.Sprintf("you are not allowed to use this bot, your id: %d", toID))
+		private := isPrivate(msg.Chat, msg.From)
 
+		// in groups bot answers only commands, other messages are for people
+		if !private && !strings.HasPrefix(command, "/") {
 			return
 		}
 
+		incomingMessage = command
+
+		// replies go to forum topic the command was sent from
+		threadID := 0
+		if msg.IsTopicMessage {
+			threadID = msg.MessageThreadID
+		}
+
+		reply := func(message string) {
+			_, _ = SendThreadMessage(ctx, b, toID, threadID, message, nil)
+		}
+
+		var userID int64
+		if msg.From != nil {
+			userID = msg.From.ID
+		}
+
+		policy := th.Conf.Load().AccessPolicy()
+
+		commandName, _, _ := strings.Cut(incomingMessage, " ")
+
+		if !access.Check(commandName, toID, userID, "", policy.MaxRole(toID, userID, private), access.RoleViewer) {
+			reply(notAllowedMessage(toID, userID, private))
+
+			return
+		}
+
+		// allowed checks role of user in project, denials are audit logged and answered
+		allowed := func(project string, required access.Role) bool {
+			role := policy.Role(toID, userID, private, project)
+			if access.Check(commandName, toID, userID, project, role, required) {
+				return true
+			}
+
+			reply(deniedMessage(project, role, required))
+
+			return false
+		}
+
 		messageText := ""
 
-		if strings.HasPrefix(incomingMessage, "/pipeline") || strings.HasPrefix(incomingMessage, "/p") {
+		var replyMarkup models.ReplyMarkup
+
+		if strings.HasPrefix(incomingMessage, "/subscriptions") {
+			messageText = th.formatSubscriptions(toID)
+		} else if strings.HasPrefix(incomingMessage, "/subscribe") {
+			message := strings.Trim(regexp.MustCompile(`\s+`).ReplaceAllString(incomingMessage, " "), " ")
+			parts := strings.Fields(message)
+
+			if len(parts) < 2 {
+				reply("you must send command in format /subscribe yourgroup/yourproject [branch] [only-failures] [mine] [notify:name,name]")
+
+				return
+			}
+
+			project, errProject := th.resolveProject(parts[1])
+			if errProject != nil {
+				reply(errProject.Error())
+
+				return
+			}
+
+			if !allowed(project, access.RoleViewer) {
+				return
+			}
+
+			branch, username := "", ""
+			onlyFailures := false
+
+			var notifiers []string
+
+			for _, arg := range parts[2:] {
+				if arg == onlyFailuresArg {
+					onlyFailures = true
+				} else if arg == mineArg {
+					linked, ok := th.Identities.Get(userID)
+					if !ok {
+						reply("login with /login to subscribe only to your pipelines")
+
+						return
+					}
+
+					username = linked.Username
+				} else if strings.HasPrefix(arg, notifyArgPrefix) {
+					notifiers = append(notifiers, strings.Split(strings.TrimPrefix(arg, notifyArgPrefix), ",")...)
+				} else if branch == "" {
+					branch = arg
+				}
+			}
+
+			if unknown := th.unknownNotifiers(notifiers); len(unknown) > 0 {
+				reply("unknown notifier " + strings.Join(unknown, ", ") + ", notifiers are set in config")
+
+				return
+			}
+
+			log.Printf("subscribe %d to project: %s, branch: %s, only failures: %t, notifiers: %v, user: %s\n", toID, project, branch, onlyFailures, notifiers, username)
+
+			th.Track.Subscribe(toID, threadID, project, branch, onlyFailures, notifiers, username)
+
+			messageText = "subscribed to " + formatSubscription(project, branch, onlyFailures, notifiers, username)
+		} else if strings.HasPrefix(incomingMessage, "/unsubscribe") {
 			message := strings.Trim(regexp.MustCompile(`\s+`).ReplaceAllString(incomingMessage, " "), " ")
 			parts := strings.Fields(message)
 
 			if len(parts) < 2 {
-				_ = SendMessage(ctx, b, toID, "you must send command in format /p[ipeline] https://yourgitlab.com/yourgroup/yourproject/-/pipelines/12345")
+				reply("you must send command in format /unsubscribe yourgroup/yourproject [branch]")
+
+				return
+			}
 
+			project := parseProjectPath(parts[1], th.Conf.Load())
+
+			if !allowed(project, access.RoleViewer) {
 				return
 			}
 
-			pipelineParts := strings.Split(parts[1], "/")
+			branch := ""
+			if len(parts) > 2 {
+				branch = parts[2]
+			}
+
+			if removed := th.Track.Unsubscribe(toID, project, branch); removed > 0 {
+				messageText = fmt.Sprintf("removed %d subscription(s) to %s", removed, project)
+			} else {
+				messageText = "subscription not found\n\n" + th.formatSubscriptions(toID)
+			}
+		} else if strings.HasPrefix(incomingMessage, "/login") {
+			messageText = th.login(ctx, b, msg, userID, private)
+		} else if strings.HasPrefix(incomingMessage, "/logout") {
+			if th.Identities.Logout(userID) {
+				messageText = "logged out from gitlab, the token is removed"
+			} else {
+				messageText = "you are not logged in to gitlab"
+			}
+		} else if strings.HasPrefix(incomingMessage, "/run") {
+			message := strings.Trim(regexp.MustCompile(`\s+`).ReplaceAllString(incomingMessage, " "), " ")
+			parts := strings.Fields(message)
 
-			if len(pipelineParts) != 8 {
-				_ = SendMessage(ctx, b, toID, "you must send command in format /p[ipeline] https://yourgitlab.com/yourgroup/yourproject/-/pipelines/12345")
+			if len(parts) < 3 {
+				reply("you must send command in format /run yourgroup/yourproject ref [VAR=value ...]")
 
 				return
 			}
 
-			pipelineNumber, errPipelineNumber := strconv.Atoi(pipelineParts[len(pipelineParts)-1])
-			if errPipelineNumber != nil {
-				_ = SendMessage(ctx, b, toID, "wrong pipeline number")
+			projectInfo, errProject := th.findProject(parts[1])
+			if errProject != nil {
+				reply(errProject.Error())
 
 				return
 			}
 
-			log.Printf("ask pipeline %d, project: %s, from %d, len %d\n", pipelineNumber, pipelineParts[3:5], toID, len(pipelineParts))
+			if !allowed(projectInfo.PathWithNamespace, access.RoleOperator) {
+				return
+			}
+
+			variables, errVariables := parseVariables(parts[3:])
+			if errVariables != nil {
+				reply(errVariables.Error())
+
+				return
+			}
+
+			request := runRequest{
+				Project:   projectInfo.PathWithNamespace,
+				ProjectID: projectInfo.ID,
+				Ref:       parts[2],
+				Variables: variables,
+				UserID:    userID,
+			}
+
+			requestID := th.runs.add(request, time.Now())
 
-			project := strings.Join(pipelineParts[3:5], "/")
+			log.Printf("run request %d from %d in %d, project: %s, ref: %s\n", requestID, userID, toID, request.Project, request.Ref)
+
+			messageText = formatRunRequest(request) + fmt.Sprintf("\n\nconfirm within %d minutes", int(runConfirmTimeout.Minutes()))
+			replyMarkup = keyboard.Run(projectInfo.ID, requestID)
+		} else if strings.HasPrefix(incomingMessage, "/resume") {
+			// paused jobs were started by viewers, so they can be resumed with the same role
+			if !allowed("", access.RoleViewer) {
+				return
+			}
+
+			if resumed := th.Track.Resume(toID); resumed > 0 {
+				messageText = fmt.Sprintf("resumed %d paused job(s)", resumed)
+			} else {
+				messageText = "there are no paused jobs"
+			}
+		} else if strings.HasPrefix(incomingMessage, "/pipeline") || strings.HasPrefix(incomingMessage, "/p") {
+			message := strings.Trim(regexp.MustCompile(`\s+`).ReplaceAllString(incomingMessage, " "), " ")
+			parts := strings.Fields(message)
+
+			if len(parts) < 2 {
+				reply("you must send command in format /p[ipeline] https://yourgitlab.com/yourgroup/yourproject/-/pipelines/12345 [final|all] [4h]")
+
+				return
+			}
+
+			mode := cron.ModeFinal
+
+			var timeout time.Duration
+
+			for _, arg := range parts[2:] {
+				switch arg {
+				case cron.ModeFinal, cron.ModeTransitions:
+					mode = arg
+				default:
+					argTimeout, errTimeout := time.ParseDuration(arg)
+					if errTimeout != nil || argTimeout < time.Minute {
+						reply("unknown argument " + arg + ", use final to get only result or all to get every status change, and watch timeout like 90m or 4h")
+
+						return
+					}
+
+					timeout = argTimeout
+				}
+			}
+
+			project, pipelineNumber, errParse := th.resolvePipeline(parts[1])
+			if errParse != nil {
+				reply(errParse.Error())
+
+				return
+			}
+
+			if !allowed(project, access.RoleViewer) {
+				return
+			}
+
+			log.Printf("ask pipeline %d, project: %s, from %d\n", pipelineNumber, project, toID)
 
 			pipelineInfo, _, errPipelineInfo := th.GitlabClient.Pipelines.GetPipeline(project, pipelineNumber, nil)
 			if errPipelineInfo != nil {
 				log.Printf("errPipelineInfo %#v\n", errPipelineInfo)
 
-				messageText = errPipelineInfo.(*gl.ErrorResponse).Message
+				messageText = errorMessage(errPipelineInfo)
 			} else {
 				log.Printf("pipelineInfo %#v\n", pipelineInfo)
 
 				messageText = gitlab.FormatPipelineInfo(pipelineInfo)
+				replyMarkup = th.pipelineKeyboard(pipelineInfo, !gitlab.IsFinishedStatus(pipelineInfo.Status))
+
+				if !gitlab.IsFinishedStatus(pipelineInfo.Status) {
+					if mode == cron.ModeTransitions {
+						messageText = messageText + "\n\nadded to check queue, this message will be updated on every pipeline status change"
+					} else {
+						messageText = messageText + "\n\nadded to check queue, this message will be updated and you will be notified when pipeline will be finished"
+					}
+
+					// reply becomes live status message of the watch
+					sentMessage, _ := SendThreadMessage(ctx, b, toID, threadID, messageText, replyMarkup)
 
-				if pipelineInfo.Status != "success" && pipelineInfo.Status != "cancelled" && pipelineInfo.Status != "failed" {
-					messageText = messageText + "\n\nadded to check queue, you will be notified when pipeline status will be changed"
+					messageID := 0
+					if sentMessage != nil {
+						messageID = sentMessage.ID
+					}
 
-					th.Track.StartTrack(toID, pipelineNumber, fmt.Sprintf("%s/%d", project, pipelineNumber), project, pipelineInfo.Status)
+					th.Track.StartTrack(toID, threadID, pipelineNumber, track.PipelineKey(toID, project, pipelineNumber), project, pipelineInfo.Status, mode, messageID, timeout)
+
+					return
 				}
 			}
-		} else if strings.HasPrefix(incomingMessage, "/issue") || strings.HasPrefix(incomingMessage, "/i") {
+		} else if strings.HasPrefix(incomingMessage, "/jobs") || strings.HasPrefix(incomingMessage, "/j") {
+			message := strings.Trim(regexp.MustCompile(`\s+`).ReplaceAllString(incomingMessage, " "), " ")
+			parts := strings.Fields(message)
+
+			if len(parts) < 2 {
+				reply("you must send command in format /j[obs] https://yourgitlab.com/yourgroup/yourproject/-/pipelines/12345")
+
+				return
+			}
+
+			project, pipelineNumber, errParse := th.resolvePipeline(parts[1])
+			if errParse != nil {
+				reply(errParse.Error())
+
+				return
+			}
+
+			if !allowed(project, access.RoleViewer) {
+				return
+			}
+
+			log.Printf("ask jobs of pipeline %d, project: %s, from %d\n", pipelineNumber, project, toID)
+
+			pipelineInfo, _, errPipelineInfo := th.GitlabClient.Pipelines.GetPipeline(project, pipelineNumber, nil)
+			if errPipelineInfo != nil {
+				log.Printf("errPipelineInfo %#v\n", errPipelineInfo)
+
+				messageText = errorMessage(errPipelineInfo)
+			} else if jobs, errJobs := gitlab.GetPipelineJobs(th.GitlabClient, project, pipelineNumber); errJobs != nil {
+				log.Printf("errJobs %#v\n", errJobs)
+
+				messageText = errJobs.Error()
+			} else {
+				messageText = gitlab.FormatPipelineInfo(pipelineInfo) + "\n\n" + gitlab.FormatPipelineJobs(jobs)
+			}
+		} else if strings.HasPrefix(incomingMessage, "/mr") || strings.HasPrefix(incomingMessage, "/m") {
 			message := strings.Trim(regexp.MustCompile(`\s+`).ReplaceAllString(incomingMessage, " "), " ")
 			parts := strings.Fields(message)
 
 			if len(parts) < 2 {
-				_ = SendMessage(ctx, b, toID, "you must send command in format /i[issue] https://yourgitlab.com/yourgroup/yourproject/-/issues/12345")
+				reply("you must send command in format /m[r] https://yourgitlab.com/yourgroup/yourproject/-/merge_requests/12345")
 
 				return
 			}
 
-			issueParts := strings.Split(parts[1], "/")
+			ref, errParse := th.parseURL(parts[1], gitlaburl.KindMergeRequest)
+			if errParse != nil {
+				reply(errParse.Error())
 
-			if len(issueParts) != 8 {
-				_ = SendMessage(ctx, b, toID, "you must send command in format /i[issue] https://yourgitlab.com/yourgroup/yourproject/-/issues/12345")
+				return
+			}
 
+			if !allowed(ref.Project, access.RoleViewer) {
 				return
 			}
 
-			issueNumber, errIssueNumber := strconv.Atoi(issueParts[len(issueParts)-1])
-			if errIssueNumber != nil {
-				_ = SendMessage(ctx, b, toID, "wrong issue number")
+			log.Printf("ask merge request %d, project: %s, from %d\n", ref.ID, ref.Project, toID)
+
+			mergeRequestInfo, _, errMergeRequestInfo := th.GitlabClient.MergeRequests.GetMergeRequest(ref.Project, ref.ID, nil)
+			if errMergeRequestInfo != nil {
+				log.Printf("errMergeRequestInfo %#v\n", errMergeRequestInfo)
+
+				messageText = errMergeRequestInfo.Error()
+			} else {
+				approvals, _, errApprovals := th.GitlabClient.MergeRequestApprovals.GetConfiguration(ref.Project, ref.ID)
+				if errApprovals != nil {
+					log.Printf("errApprovals %#v\n", errApprovals)
+
+					approvals = nil
+				}
+
+				messageText = gitlab.FormatMergeRequestInfo(mergeRequestInfo, approvals)
+
+				if mergeRequestInfo.State == "opened" {
+					messageText = messageText + "\n\nadded to check queue, you will be notified on approvals, comments, pipeline result, merge or close"
+
+					th.Track.StartMergeRequestTrack(toID, threadID, ref.Project, mergeRequestInfo, approvals)
+				}
+			}
+		} else if strings.HasPrefix(incomingMessage, "/issue") || strings.HasPrefix(incomingMessage, "/i") {
+			message := strings.Trim(regexp.MustCompile(`\s+`).ReplaceAllString(incomingMessage, " "), " ")
+			parts := strings.Fields(message)
+
+			if len(parts) < 2 {
+				reply("you must send command in format /i[issue] https://yourgitlab.com/yourgroup/yourproject/-/issues/12345")
+
+				return
+			}
+
+			ref, errParse := th.parseURL(parts[1], gitlaburl.KindIssue)
+			if errParse != nil {
+				reply(errParse.Error())
 
 				return
 			}
 
-			log.Printf("ask issue %d, project: %s, from %d, len %d\n", issueNumber, issueParts[3:5], toID, len(issueParts))
+			if !allowed(ref.Project, access.RoleViewer) {
+				return
+			}
 
-			issueInfo, _, errIssueInfo := th.GitlabClient.Issues.GetIssue(strings.Join(issueParts[3:5], "/"), issueNumber, nil)
+			log.Printf("ask issue %d, project: %s, from %d\n", ref.ID, ref.Project, toID)
+
+			issueInfo, _, errIssueInfo := th.GitlabClient.Issues.GetIssue(ref.Project, ref.ID, nil)
 			if errIssueInfo != nil {
 				log.Printf("errIssueInfo %#v\n", errIssueInfo)
 
-				messageText = errIssueInfo.(*gl.ErrorResponse).Message
+				messageText = errorMessage(errIssueInfo)
 			} else {
 				log.Printf("issueInfo %#v\n", issueInfo)
 
@@ -163,7 +467,7 @@ func (th *TelegramHandler) Handler(ctx context.Context, b *bot.Bot, update *mode
 			messageText = "I don't understand you"
 		}
 
-		_ = SendMessage(ctx, b, toID, messageText)
+		_, _ = SendThreadMessage(ctx, b, toID, threadID, messageText, replyMarkup)
 
 		return
 	} else {
@@ -171,47 +475,711 @@ func (th *TelegramHandler) Handler(ctx context.Context, b *bot.Bot, update *mode
 	}
 }
 
-func isAllowedID(conf *config.Config, id int64) bool {
-	checkID := strconv.FormatInt(id, 10)
+// errorMessage returns message of gitlab error response, network and other errors have no response
+func errorMessage(err error) string {
+	var errResponse *gl.ErrorResponse
+	if errors.As(err, &errResponse) {
+		return errResponse.Message
+	}
+
+	return err.Error()
+}
+
+// parseURL parses gitlab web url and checks that it points to one of kinds
+func (th *TelegramHandler) parseURL(rawURL string, kinds ...gitlaburl.Kind) (*gitlaburl.Reference, error) {
+	gitlabURL := ""
+	if conf := th.Conf.Load(); conf != nil {
+		gitlabURL = conf.GitlabURL
+	}
+
+	parser, errParser := gitlaburl.NewParser(gitlabURL)
+	if errParser != nil {
+		return nil, errParser
+	}
 
-	for _, allowedID := range conf.AllowedIDsList {
-		if allowedID == checkID {
-			return true
+	ref, errParse := parser.Parse(rawURL)
+	if errParse != nil {
+		return nil, errParse
+	}
+
+	for _, kind := range kinds {
+		if ref.Kind == kind {
+			return ref, nil
 		}
 	}
 
-	return false
+	return nil, fmt.Errorf("url %s points to %s, not to %s", rawURL, ref.Kind, kinds[0])
 }
 
-func SendMessage(ctx context.Context, b *bot.Bot, toID int64, message string) error {
+// parseProjectPath returns project path from project url or path
+func parseProjectPath(project string, conf *config.Config) string {
+	if strings.HasPrefix(project, "http://") || strings.HasPrefix(project, "https://") {
+		gitlabURL := ""
+		if conf != nil {
+			gitlabURL = conf.GitlabURL
+		}
+
+		if parser, err := gitlaburl.NewParser(gitlabURL); err == nil {
+			if ref, err := parser.Parse(project); err == nil {
+				return ref.Project
+			}
+		}
+	}
+
+	return strings.Trim(project, "/")
+}
+
+// resolveProject checks that project exists in gitlab and returns its path with namespace
+func (th *TelegramHandler) resolveProject(project string) (string, error) {
+	projectInfo, errProject := th.findProject(project)
+	if errProject != nil {
+		return "", errProject
+	}
+
+	return projectInfo.PathWithNamespace, nil
+}
+
+// findProject returns project by url or path
+func (th *TelegramHandler) findProject(project string) (*gl.Project, error) {
+	project = parseProjectPath(project, th.Conf.Load())
+
+	if project == "" {
+		return nil, fmt.Errorf("%s", "empty project")
+	}
+
+	projectInfo, _, errProject := th.GitlabClient.Projects.GetProject(project, nil)
+	if errProject != nil {
+		return nil, fmt.Errorf("can't find project %s: %s", project, errProject)
+	}
+
+	return projectInfo, nil
+}
+
+const (
+	onlyFailuresArg = "only-failures"
+	mineArg         = "mine"
+	notifyArgPrefix = "notify:"
+)
+
+// unknownNotifiers returns names which are not found in config
+func (th *TelegramHandler) unknownNotifiers(names []string) []string {
+	var unknown []string
+
+	conf := th.Conf.Load()
+
+	for _, name := range names {
+		if conf.FindNotifier(name) == nil {
+			unknown = append(unknown, name)
+		}
+	}
+
+	return unknown
+}
+
+func formatSubscription(project, branch string, onlyFailures bool, notifiers []string, username string) string {
+	text := project
+
+	if branch != "" {
+		text = text + ", branch " + branch
+	} else {
+		text = text + ", all branches"
+	}
+
+	if onlyFailures {
+		text = text + ", only failures"
+	}
+
+	if username != "" {
+		text = text + ", only pipelines of " + username
+	}
+
+	if len(notifiers) > 0 {
+		text = text + ", notify " + strings.Join(notifiers, ", ")
+	}
+
+	return text
+}
+
+func (th *TelegramHandler) formatSubscriptions(toID int64) string {
+	subscriptions := th.Track.Subscriptions(toID)
+	if len(subscriptions) == 0 {
+		return "no subscriptions, use /subscribe yourgroup/yourproject [branch] [only-failures] [mine] [notify:name,name]"
+	}
+
+	lines := make([]string, 0, len(subscriptions)+1)
+	lines = append(lines, "subscriptions:")
+
+	for _, subscription := range subscriptions {
+		lines = append(lines, formatSubscription(subscription.Project, subscription.Branch, subscription.OnlyFailures, subscription.Notifiers, subscription.Username))
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// resolvePipeline returns project and pipeline number from pipeline, job or merge request url
+func (th *TelegramHandler) resolvePipeline(rawURL string) (string, int, error) {
+	ref, errParse := th.parseURL(rawURL, gitlaburl.KindPipeline, gitlaburl.KindJob, gitlaburl.KindMergeRequest)
+	if errParse != nil {
+		return "", 0, errParse
+	}
+
+	switch ref.Kind {
+	case gitlaburl.KindJob:
+		job, _, errJob := th.GitlabClient.Jobs.GetJob(ref.Project, ref.ID)
+		if errJob != nil {
+			return "", 0, errJob
+		}
+
+		return ref.Project, job.Pipeline.ID, nil
+	case gitlaburl.KindMergeRequest:
+		mergeRequest, _, errMergeRequest := th.GitlabClient.MergeRequests.GetMergeRequest(ref.Project, ref.ID, nil)
+		if errMergeRequest != nil {
+			return "", 0, errMergeRequest
+		}
+
+		if mergeRequest.HeadPipeline == nil {
+			return "", 0, fmt.Errorf("merge request %d has no pipeline", ref.ID)
+		}
+
+		return ref.Project, mergeRequest.HeadPipeline.ID, nil
+	}
+
+	return ref.Project, ref.ID, nil
+}
+
+// parseCommand removes bot username from command like /p@botname, false is returned
+// if command is addressed to another bot
+func (th *TelegramHandler) parseCommand(text string) (string, bool) {
+	if !strings.HasPrefix(text, "/") {
+		return text, true
+	}
+
+	command, rest, _ := strings.Cut(text, " ")
+
+	command, username, addressed := strings.Cut(command, "@")
+	if addressed && th.BotUsername != "" && !strings.EqualFold(username, th.BotUsername) {
+		return "", false
+	}
+
+	if rest == "" {
+		return command, true
+	}
+
+	return command + " " + rest, true
+}
+
+// isPrivate reports whether chat is private chat with user, chat without type is private if its id is user id
+func isPrivate(chat models.Chat, from *models.User) bool {
+	if chat.Type != "" {
+		return chat.Type == models.ChatTypePrivate
+	}
+
+	return from != nil && from.ID == chat.ID
+}
+
+func notAllowedMessage(chatID, userID int64, private bool) string {
+	if private || userID == 0 {
+		return fmt.Sprintf("you are not allowed to use this bot, your id: %d", chatID)
+	}
+
+	return fmt.Sprintf("you are not allowed to use this bot, chat id: %d, your id: %d", chatID, userID)
+}
+
+func deniedMessage(project string, role, required access.Role) string {
+	if project == "" {
+		return fmt.Sprintf("you need %s role for this, your role: %s", required, role)
+	}
+
+	return fmt.Sprintf("you need %s role in %s for this, your role: %s", required, project, role)
+}
+
+// requiredActionRole returns role required for button action, retry and cancel change pipeline
+func requiredActionRole(action string) access.Role {
+	switch action {
+	case keyboard.ActionRetry, keyboard.ActionCancel, keyboard.ActionRun,
+		keyboard.ActionPlay, keyboard.ActionApprove, keyboard.ActionReject:
+		return access.RoleOperator
+	}
+
+	return access.RoleViewer
+}
+
+// projectPath returns path of project by id, empty path is returned if project can't be found,
+// so project scoped roles don't apply
+func (th *TelegramHandler) projectPath(projectID int) string {
+	if th.GitlabClient == nil || projectID == 0 {
+		return ""
+	}
+
+	project, _, err := th.GitlabClient.Projects.GetProject(projectID, nil)
+	if err != nil {
+		log.Printf("error getting project %d: %s", projectID, err)
+
+		return ""
+	}
+
+	return project.PathWithNamespace
+}
+
+// login links gitlab account of user by personal access token, message with token is deleted,
+// tokens are accepted only in private chat
+func (th *TelegramHandler) login(ctx context.Context, b *bot.Bot, msg *models.Message, userID int64, private bool) string {
+	if th.Identities == nil {
+		return "login is disabled, IDENTITY_SECRET is not set"
+	}
+
+	_, token, _ := strings.Cut(strings.TrimSpace(msg.Text), " ")
+	token = strings.TrimSpace(token)
+
+	if token != "" {
+		deleteMessage(ctx, b, msg.Chat.ID, msg.ID)
+	}
+
+	if !private {
+		return "send /login to the bot in private chat, tokens should not be shared in groups"
+	}
+
+	if token == "" {
+		if linked, ok := th.Identities.Get(userID); ok {
+			return fmt.Sprintf("you are logged in to gitlab as %s, pipeline actions run as you, /logout to unlink", linked.Username)
+		}
+
+		return "send /login your-personal-access-token with api scope, the token is stored encrypted, pipeline actions will run as you"
+	}
+
+	linked, errLogin := th.Identities.Login(userID, token)
+	if errLogin != nil {
+		log.Printf("login of user %d failed: %s\n", userID, errLogin)
+
+		return "can't login: " + errLogin.Error()
+	}
+
+	log.Printf("user %d logged in to gitlab as %s\n", userID, linked.Username)
+
+	return fmt.Sprintf("logged in to gitlab as %s, pipeline actions run as you, your message with the token is deleted", linked.Username)
+}
+
+// userClient returns gitlab client of user linked with /login, shared client is used for other users
+func (th *TelegramHandler) userClient(userID int64) *gl.Client {
+	client, err := th.Identities.Client(userID)
+	if err != nil {
+		log.Printf("can't use gitlab account of user %d, shared token is used: %s\n", userID, err)
+	}
+
+	if client == nil {
+		return th.GitlabClient
+	}
+
+	return client
+}
+
+// redactToken hides token of /login command in logs
+func redactToken(text string) string {
+	if command, _, hasToken := strings.Cut(text, " "); hasToken && strings.HasPrefix(command, "/login") {
+		return command + " ***"
+	}
+
+	return text
+}
+
+func deleteMessage(ctx context.Context, b *bot.Bot, chatID int64, messageID int) {
 	if b == nil {
-		return fmt.Errorf("%s", "bot not set")
+		return
 	}
 
-	if toID == 0 {
-		return fmt.Errorf("%s", "empty user id")
+	if _, err := b.DeleteMessage(ctx, &bot.DeleteMessageParams{ChatID: chatID, MessageID: messageID}); err != nil {
+		log.Printf("error deleting message %d: %s\n", messageID, err)
 	}
+}
+
+// CallbackHandler handles inline keyboard buttons under pipeline messages
+func (th *TelegramHandler) CallbackHandler(ctx context.Context, b *bot.Bot, update *models.Update) {
+	defer recovery.Recovery()
 
-	if message == "" {
-		return fmt.Errorf("%s", "empty message")
+	if update.CallbackQuery == nil {
+		return
 	}
 
-	_, errSendMarkdownMessage := b.SendMessage(ctx, &bot.SendMessageParams{
-		ChatID:    toID,
-		Text:      message,
-		ParseMode: models.ParseModeMarkdown,
-	})
+	query := update.CallbackQuery
+
+	var chat models.Chat
+	var messageID, threadID int
+
+	if query.Message.Message != nil {
+		chat = query.Message.Message.Chat
+		messageID = query.Message.Message.ID
+
+		if query.Message.Message.IsTopicMessage {
+			threadID = query.Message.Message.MessageThreadID
+		}
+	} else if query.Message.InaccessibleMessage != nil {
+		chat = query.Message.InaccessibleMessage.Chat
+		messageID = query.Message.InaccessibleMessage.MessageID
+	}
+
+	chatID := chat.ID
 
-	if errSendMarkdownMessage != nil {
-		_, errSendMessage := b.SendMessage(ctx, &bot.SendMessageParams{
-			ChatID: toID,
-			Text:   escapeMarkdown(message),
+	if chatID == 0 {
+		answerCallbackQuery(ctx, b, query.ID, "message is too old")
+
+		return
+	}
+
+	private := isPrivate(chat, &query.From)
+
+	policy := th.Conf.Load().AccessPolicy()
+
+	if !access.Check("button", chatID, query.From.ID, "", policy.MaxRole(chatID, query.From.ID, private), access.RoleViewer) {
+		answerCallbackQuery(ctx, b, query.ID, notAllowedMessage(chatID, query.From.ID, private))
+
+		return
+	}
+
+	callback, errCallback := keyboard.ParseCallbackData(query.Data)
+	if errCallback != nil {
+		log.Println(errCallback)
+
+		answerCallbackQuery(ctx, b, query.ID, "unknown action")
+
+		return
+	}
+
+	log.Printf("callback %s for %d of project %d from %d in %d\n", callback.Action, callback.ID, callback.ProjectID, query.From.ID, chatID)
+
+	role, project := policy.MaxRole(chatID, query.From.ID, private), ""
+
+	required := requiredActionRole(callback.Action)
+	if required > access.RoleViewer && policy.HasProjectGrants() {
+		project = th.projectPath(callback.ProjectID)
+		role = policy.Role(chatID, query.From.ID, private, project)
+	}
+
+	if !access.Check(callback.Action, chatID, query.From.ID, project, role, required) {
+		answerCallbackQuery(ctx, b, query.ID, deniedMessage(project, role, required))
+
+		return
+	}
+
+	var (
+		pipelineInfo *gl.Pipeline
+		errAction    error
+		result       string
+	)
+
+	switch callback.Action {
+	case keyboard.ActionRetry:
+		pipelineInfo, _, errAction = th.userClient(query.From.ID).Pipelines.RetryPipelineBuild(callback.ProjectID, callback.ID)
+		result = "pipeline retried"
+
+		if errAction == nil {
+			th.watchPipeline(chatID, threadID, messageID, pipelineInfo)
+		}
+	case keyboard.ActionCancel:
+		pipelineInfo, _, errAction = th.userClient(query.From.ID).Pipelines.CancelPipelineBuild(callback.ProjectID, callback.ID)
+		result = "pipeline canceled"
+	case keyboard.ActionRun:
+		request, errRequest := th.runs.take(callback.ID, callback.ProjectID, query.From.ID, time.Now())
+		if errRequest != nil {
+			answerCallbackQuery(ctx, b, query.ID, errRequest.Error())
+
+			return
+		}
+
+		pipelineInfo, _, errAction = th.userClient(query.From.ID).Pipelines.CreatePipeline(request.ProjectID, &gl.CreatePipelineOptions{
+			Ref:       &request.Ref,
+			Variables: pipelineVariables(request.Variables),
 		})
+		result = "pipeline started"
+
+		if errAction == nil {
+			log.Printf("run request %d started pipeline %d of %s\n", callback.ID, pipelineInfo.ID, request.Project)
+
+			th.Track.StartTrack(chatID, threadID, pipelineInfo.ID, track.PipelineKey(chatID, request.Project, pipelineInfo.ID), request.Project, pipelineInfo.Status, cron.ModeFinal, messageID, 0)
+		}
+	case keyboard.ActionDismiss:
+		request, errRequest := th.runs.take(callback.ID, callback.ProjectID, query.From.ID, time.Now())
+		if errRequest != nil {
+			answerCallbackQuery(ctx, b, query.ID, errRequest.Error())
+
+			return
+		}
 
-		if errSendMessage != nil {
-			return errSendMessage
+		messageText := fmt.Sprintf("%s\n\ndismissed by %s", formatRunRequest(request), userName(query.From))
+		if err := EditMessage(ctx, b, chatID, messageID, messageText, nil); err != nil {
+			log.Printf("error editing message %d: %s\n", messageID, err)
 		}
+
+		answerCallbackQuery(ctx, b, query.ID, "dismissed")
+
+		return
+	case keyboard.ActionPlay:
+		var playedJob *gl.Job
+
+		playedJob, _, errAction = th.userClient(query.From.ID).Jobs.PlayJob(callback.ProjectID, callback.ID, nil)
+		if errAction == nil {
+			result = "job " + playedJob.Name + " started"
+			pipelineInfo, _, errAction = th.GitlabClient.Pipelines.GetPipeline(callback.ProjectID, playedJob.Pipeline.ID, nil)
+		}
+
+		if errAction == nil {
+			th.watchPipeline(chatID, threadID, messageID, pipelineInfo)
+		}
+	case keyboard.ActionApprove, keyboard.ActionReject:
+		pipelineInfo, result, errAction = th.approveDeployment(query.From.ID, callback)
+
+		if errAction == nil {
+			th.watchPipeline(chatID, threadID, messageID, pipelineInfo)
+		}
+	case keyboard.ActionExtend:
+		result = "pipeline is not watched anymore"
+		if th.Track.Extend(chatID, callback.ID) {
+			result = "watch extended"
+		}
+
+		answerCallbackQuery(ctx, b, query.ID, result)
+
+		return
+	case keyboard.ActionUnwatch:
+		th.Track.StopTrack(chatID, callback.ID)
+
+		// timeout warning doesn't know project, there is no pipeline message to update
+		if callback.ProjectID == 0 {
+			answerCallbackQuery(ctx, b, query.ID, "stopped watching")
+
+			return
+		}
+
+		pipelineInfo, _, errAction = th.GitlabClient.Pipelines.GetPipeline(callback.ProjectID, callback.ID, nil)
+		result = "stopped watching"
+	default:
+		answerCallbackQuery(ctx, b, query.ID, "unknown action")
+
+		return
 	}
 
-	return nil
+	if errAction != nil {
+		log.Printf("error on %s %d of project %d: %s\n", callback.Action, callback.ID, callback.ProjectID, errAction)
+
+		answerCallbackQuery(ctx, b, query.ID, errAction.Error())
+
+		return
+	}
+
+	messageText := fmt.Sprintf("%s\n\n%s by %s", gitlab.FormatPipelineInfo(pipelineInfo), result, userName(query.From))
+	replyMarkup := th.pipelineKeyboard(pipelineInfo, th.Track.IsTracked(chatID, pipelineInfo.ID))
+
+	if err := EditMessage(ctx, b, chatID, messageID, messageText, replyMarkup); err != nil {
+		log.Printf("error editing message %d: %s\n", messageID, err)
+	}
+
+	answerCallbackQuery(ctx, b, query.ID, result)
+}
+
+// watchPipeline starts watch of pipeline changed with button, so its result comes back to chat
+func (th *TelegramHandler) watchPipeline(chatID int64, threadID, messageID int, pipeline *gl.Pipeline) {
+	if th.Track.IsTracked(chatID, pipeline.ID) {
+		return
+	}
+
+	project := strconv.Itoa(pipeline.ProjectID)
+	th.Track.StartTrack(chatID, threadID, pipeline.ID, track.PipelineKey(chatID, project, pipeline.ID), project, pipeline.Status, cron.ModeFinal, messageID, 0)
+}
+
+// approveDeployment approves or rejects deployment waiting for approval, pipeline of deployment is returned
+func (th *TelegramHandler) approveDeployment(userID int64, callback *keyboard.Callback) (*gl.Pipeline, string, error) {
+	status, result := gl.DeploymentApprovalStatusApproved, "deployment approved"
+	if callback.Action == keyboard.ActionReject {
+		status, result = gl.DeploymentApprovalStatusRejected, "deployment rejected"
+	}
+
+	_, err := th.userClient(userID).Deployments.ApproveOrRejectProjectDeployment(callback.ProjectID, callback.ID, &gl.ApproveOrRejectProjectDeploymentOptions{
+		Status: &status,
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	deployment, _, err := th.GitlabClient.Deployments.GetProjectDeployment(callback.ProjectID, callback.ID)
+	if err != nil {
+		return nil, "", err
+	}
+
+	pipeline, _, err := th.GitlabClient.Pipelines.GetPipeline(callback.ProjectID, deployment.Deployable.Pipeline.ID, nil)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return pipeline, result, nil
+}
+
+// pipelineKeyboard returns keyboard of pipeline message, manual pipeline gets buttons of its manual jobs
+func (th *TelegramHandler) pipelineKeyboard(pipeline *gl.Pipeline, watching bool) models.ReplyMarkup {
+	if pipeline == nil || pipeline.Status != "manual" {
+		return keyboard.Pipeline(pipeline, watching)
+	}
+
+	actions, err := gitlab.GetManualActions(th.GitlabClient, strconv.Itoa(pipeline.ProjectID), pipeline.ID)
+	if err != nil {
+		log.Printf("error getting manual jobs for pipeline %d: %s\n", pipeline.ID, err)
+	}
+
+	return keyboard.Manual(pipeline, actions, watching)
+}
+
+// runConfirmTimeout is how long /run request waits for confirmation
+const runConfirmTimeout = 10 * time.Minute
+
+// runRequest is /run command waiting for confirmation
+type runRequest struct {
+	Project   string
+	ProjectID int
+	Ref       string
+	Variables []string
+	UserID    int64
+	Created   time.Time
+}
+
+// runRequests keeps pending /run requests in memory, callback data is too short for ref and variables,
+// requests are lost on restart and /run should be sent again, ids are random, so buttons sent
+// before restart don't match new requests
+type runRequests struct {
+	mu       sync.Mutex
+	requests map[int]runRequest
+}
+
+// maxRunRequestID keeps request id short in callback data
+const maxRunRequestID = 1 << 30
+
+// add saves request and returns its id, expired requests are removed
+func (r *runRequests) add(request runRequest, now time.Time) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.requests == nil {
+		r.requests = map[int]runRequest{}
+	}
+
+	for id, pending := range r.requests {
+		if now.Sub(pending.Created) > runConfirmTimeout {
+			delete(r.requests, id)
+		}
+	}
+
+	id := rand.IntN(maxRunRequestID) + 1
+	for _, ok := r.requests[id]; ok; _, ok = r.requests[id] {
+		id = rand.IntN(maxRunRequestID) + 1
+	}
+
+	request.Created = now
+	r.requests[id] = request
+
+	return id
+}
+
+// take removes request confirmed or dismissed by user who sent it, button must be sent for project of request
+func (r *runRequests) take(id, projectID int, userID int64, now time.Time) (runRequest, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// button of other project is left from message sent before restart, it can't take new request
+	request, ok := r.requests[id]
+	if !ok || request.ProjectID != projectID {
+		return runRequest{}, fmt.Errorf("%s", "run request expired, send /run again")
+	}
+
+	if now.Sub(request.Created) > runConfirmTimeout {
+		delete(r.requests, id)
+
+		return runRequest{}, fmt.Errorf("%s", "run request expired, send /run again")
+	}
+
+	if request.UserID != userID {
+		return runRequest{}, fmt.Errorf("%s", "only user who sent /run can confirm it")
+	}
+
+	delete(r.requests, id)
+
+	return request, nil
+}
+
+var variableKeyPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// parseVariables checks VAR=value arguments of /run
+func parseVariables(args []string) ([]string, error) {
+	variables := make([]string, 0, len(args))
+
+	for _, arg := range args {
+		key, _, ok := strings.Cut(arg, "=")
+		if !ok || !variableKeyPattern.MatchString(key) {
+			return nil, fmt.Errorf("wrong variable %s, it should be like VAR=value", arg)
+		}
+
+		variables = append(variables, arg)
+	}
+
+	return variables, nil
+}
+
+func pipelineVariables(variables []string) *[]*gl.PipelineVariableOptions {
+	if len(variables) == 0 {
+		return nil
+	}
+
+	options := make([]*gl.PipelineVariableOptions, 0, len(variables))
+
+	for _, variable := range variables {
+		key, value, _ := strings.Cut(variable, "=")
+		options = append(options, &gl.PipelineVariableOptions{Key: gl.Ptr(key), Value: gl.Ptr(value)})
+	}
+
+	return &options
+}
+
+func formatRunRequest(request runRequest) string {
+	text := fmt.Sprintf("run pipeline of %s on %s", request.Project, request.Ref)
+
+	if len(request.Variables) > 0 {
+		text = text + "\nvariables: " + strings.Join(request.Variables, ", ")
+	}
+
+	return text
+}
+
+func answerCallbackQuery(ctx context.Context, b *bot.Bot, queryID, text string) {
+	if b == nil {
+		return
+	}
+
+	_, _ = b.AnswerCallbackQuery(ctx, &bot.AnswerCallbackQueryParams{
+		CallbackQueryID: queryID,
+		Text:            text,
+	})
+}
+
+func userName(user models.User) string {
+	if user.Username != "" {
+		return "@" + user.Username
+	}
+
+	return strings.TrimSpace(user.FirstName + " " + user.LastName)
+}
+
+func SendMessage(ctx context.Context, b *bot.Bot, toID int64, message string) error {
+	_, err := SendMessageWithKeyboard(ctx, b, toID, message, nil)
+
+	return err
+}
+
+func SendMessageWithKeyboard(ctx context.Context, b *bot.Bot, toID int64, message string, replyMarkup models.ReplyMarkup) (*models.Message, error) {
+	return SendThreadMessage(ctx, b, toID, 0, message, replyMarkup)
+}
+
+// SendThreadMessage sends message to forum topic of chat, zero threadID is general topic or chat without topics
+func SendThreadMessage(ctx context.Context, b *bot.Bot, toID int64, threadID int, message string, replyMarkup models.ReplyMarkup) (*models.Message, error) {
+	return notify.NewTelegram(b, toID).InThread(threadID).Send(ctx, message, replyMarkup)
+}
+
+// EditMessage replaces text and keyboard of already sent message
+func EditMessage(ctx context.Context, b *bot.Bot, chatID int64, messageID int, message string, replyMarkup models.ReplyMarkup) error {
+	return notify.NewTelegram(b, chatID).Edit(ctx, messageID, message, replyMarkup)
 }
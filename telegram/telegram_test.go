@@ -2,10 +2,20 @@ package telegram
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"reflect"
 	"testing"
+	"time"
 
+	"github.com/ad/gitlab-pipelines-notifier/access"
 	"github.com/ad/gitlab-pipelines-notifier/config"
+	"github.com/ad/gitlab-pipelines-notifier/cron"
+	"github.com/ad/gitlab-pipelines-notifier/identity"
+	"github.com/ad/gitlab-pipelines-notifier/keyboard"
+	"github.com/ad/gitlab-pipelines-notifier/store"
 	"github.com/ad/gitlab-pipelines-notifier/track"
 
 	"github.com/go-telegram/bot"
@@ -13,74 +23,345 @@ import (
 	gl "github.com/xanzy/go-gitlab"
 )
 
-func Test_escapeMarkdown(t *testing.T) {
-	type args struct {
-		s string
+func TestTelegramHandler_parseCommand(t *testing.T) {
+	tests := []struct {
+		name      string
+		text      string
+		want      string
+		addressed bool
+	}{
+		{"text", "hello @botname", "hello @botname", true},
+		{"command", "/p https://gitlab/1", "/p https://gitlab/1", true},
+		{"command to bot", "/p@BotName https://gitlab/1 all", "/p https://gitlab/1 all", true},
+		{"command without args", "/resume@botname", "/resume", true},
+		{"command to other bot", "/p@otherbot https://gitlab/1", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			th := &TelegramHandler{BotUsername: "botname"}
+
+			got, addressed := th.parseCommand(tt.text)
+			if got != tt.want || addressed != tt.addressed {
+				t.Errorf("parseCommand() = %v, %v, want %v, %v", got, addressed, tt.want, tt.addressed)
+			}
+		})
 	}
+}
+
+func Test_isPrivate(t *testing.T) {
 	tests := []struct {
 		name string
-		args args
-		want string
+		chat models.Chat
+		from *models.User
+		want bool
 	}{
-		{
-			name: "empty string",
-			want: "",
-		},
-		{
-			name: "escaped string",
-			args: args{
-				s: "[]()>#+-=|{}.!",
-			},
-			want: "\\[\\]\\(\\)\\>\\#\\+\\-\\=\\|\\{\\}\\.\\!",
-		},
+		{"private", models.Chat{ID: 1, Type: models.ChatTypePrivate}, &models.User{ID: 1}, true},
+		{"group", models.Chat{ID: -100, Type: models.ChatTypeSupergroup}, &models.User{ID: 1}, false},
+		{"no type, same id", models.Chat{ID: 1}, &models.User{ID: 1}, true},
+		{"no type, no user", models.Chat{ID: 1}, nil, false},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if got := escapeMarkdown(tt.args.s); got != tt.want {
-				t.Errorf("escapeMarkdown() = %v, want %v", got, tt.want)
+			if got := isPrivate(tt.chat, tt.from); got != tt.want {
+				t.Errorf("isPrivate() = %v, want %v", got, tt.want)
 			}
 		})
 	}
 }
 
-func Test_isAllowedID(t *testing.T) {
-	type args struct {
-		conf *config.Config
-		id   int64
+func Test_requiredActionRole(t *testing.T) {
+	tests := []struct {
+		action string
+		want   access.Role
+	}{
+		{keyboard.ActionRetry, access.RoleOperator},
+		{keyboard.ActionCancel, access.RoleOperator},
+		{keyboard.ActionRun, access.RoleOperator},
+		{keyboard.ActionDismiss, access.RoleViewer},
+		{keyboard.ActionPlay, access.RoleOperator},
+		{keyboard.ActionApprove, access.RoleOperator},
+		{keyboard.ActionReject, access.RoleOperator},
+		{keyboard.ActionUnwatch, access.RoleViewer},
+	}
+	for _, tt := range tests {
+		t.Run(tt.action, func(t *testing.T) {
+			if got := requiredActionRole(tt.action); got != tt.want {
+				t.Errorf("requiredActionRole() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_legacyGroupRole(t *testing.T) {
+	policy := (&config.Config{AllowedIDsList: []string{"-100", "1"}}).AccessPolicy()
+
+	tests := []struct {
+		name   string
+		userID int64
+		action string
+		want   bool
+	}{
+		{"group member retry", 5, keyboard.ActionRetry, false},
+		{"group member cancel", 5, keyboard.ActionCancel, false},
+		{"group member unwatch", 5, keyboard.ActionUnwatch, true},
+		{"legacy user retry", 1, keyboard.ActionRetry, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			role := policy.Role(-100, tt.userID, false, "group/project")
+			if got := role >= requiredActionRole(tt.action); got != tt.want {
+				t.Errorf("role %s allowed %s = %v, want %v", role, tt.action, got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_deniedMessage(t *testing.T) {
+	tests := []struct {
+		name    string
+		project string
+		want    string
+	}{
+		{"without project", "", "you need admin role for this, your role: viewer"},
+		{"with project", "group/project", "you need admin role in group/project for this, your role: viewer"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := deniedMessage(tt.project, access.RoleViewer, access.RoleAdmin); got != tt.want {
+				t.Errorf("deniedMessage() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTelegramHandler_login(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("PRIVATE-TOKEN") != "good" {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte(`{"message":"401 Unauthorized"}`))
+
+			return
+		}
+
+		_, _ = w.Write([]byte(`{"id":7,"username":"user"}`))
+	}))
+	defer server.Close()
+
+	identities, err := identity.New(store.NewMemoryStore(), "secret", func(token string) (*gl.Client, error) {
+		return gl.NewClient(token, gl.WithBaseURL(server.URL))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		identities *identity.Identities
+		text       string
+		private    bool
+		want       string
+	}{
+		{"disabled", nil, "/login good", true, "login is disabled, IDENTITY_SECRET is not set"},
+		{"group", identities, "/login good", false, "send /login to the bot in private chat, tokens should not be shared in groups"},
+		{"usage", identities, "/login", true, "send /login your-personal-access-token with api scope, the token is stored encrypted, pipeline actions will run as you"},
+		{"bad token", identities, "/login bad", true, "can't login: token is not accepted by gitlab: GET " + server.URL + "/api/v4/user: 401 {message: 401 Unauthorized}"},
+		{"good token", identities, "/login good", true, "logged in to gitlab as user, pipeline actions run as you, your message with the token is deleted"},
+		{"logged in", identities, "/login", true, "you are logged in to gitlab as user, pipeline actions run as you, /logout to unlink"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			th := &TelegramHandler{Identities: tt.identities}
+			msg := &models.Message{Text: tt.text, Chat: models.Chat{ID: 1}}
+
+			if got := th.login(context.Background(), nil, msg, 1, tt.private); got != tt.want {
+				t.Errorf("login() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if client := (&TelegramHandler{Identities: identities}).userClient(1); client == nil {
+		t.Error("userClient() = nil, want client of linked user")
+	}
+}
+
+func Test_redactToken(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"/login glpat-token", "/login ***"},
+		{"/login@bot glpat-token", "/login@bot ***"},
+		{"/login", "/login"},
+		{"/p https://gitlab/1", "/p https://gitlab/1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.text, func(t *testing.T) {
+			if got := redactToken(tt.text); got != tt.want {
+				t.Errorf("redactToken() = %v, want %v", got, tt.want)
+			}
+		})
 	}
+}
+
+func Test_errorMessage(t *testing.T) {
 	tests := []struct {
 		name string
-		args args
-		want bool
+		err  error
+		want string
 	}{
-		{
-			name: "positive",
-			args: args{
-				conf: &config.Config{
-					AllowedIDsList: []string{
-						"123",
-					},
-				},
-				id: 123,
-			},
-			want: true,
-		},
-		{
-			name: "negative", args: args{
-				conf: &config.Config{
-					AllowedIDsList: []string{
-						"123",
-					},
-				},
-				id: 321,
-			},
-			want: false,
-		},
+		{"gitlab error", &gl.ErrorResponse{Message: "404 Not Found"}, "404 Not Found"},
+		{"wrapped gitlab error", fmt.Errorf("error getting pipeline: %w", &gl.ErrorResponse{Message: "403 Forbidden"}), "403 Forbidden"},
+		{"network error", fmt.Errorf("%s", "connection refused"), "connection refused"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := errorMessage(tt.err); got != tt.want {
+				t.Errorf("errorMessage() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTelegramHandler_approveDeployment(t *testing.T) {
+	approvalStatus := ""
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		switch r.URL.Path {
+		case "/api/v4/projects/1/deployments/5/approval":
+			body := map[string]string{}
+			_ = json.NewDecoder(r.Body).Decode(&body)
+			approvalStatus = body["status"]
+
+			_, _ = w.Write([]byte(`{}`))
+		case "/api/v4/projects/1/deployments/5":
+			_, _ = w.Write([]byte(`{"id":5,"deployable":{"id":3,"pipeline":{"id":2}}}`))
+		case "/api/v4/projects/1/pipelines/2":
+			_, _ = w.Write([]byte(`{"id":2,"project_id":1,"status":"manual"}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	gitlabClient, err := gl.NewClient("token", gl.WithBaseURL(server.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	th := &TelegramHandler{GitlabClient: gitlabClient}
+
+	tests := []struct {
+		action     string
+		wantStatus string
+		wantResult string
+	}{
+		{keyboard.ActionApprove, "approved", "deployment approved"},
+		{keyboard.ActionReject, "rejected", "deployment rejected"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.action, func(t *testing.T) {
+			pipeline, result, err := th.approveDeployment(1, &keyboard.Callback{Action: tt.action, ProjectID: 1, ID: 5})
+			if err != nil {
+				t.Fatalf("approveDeployment() error = %v", err)
+			}
+
+			if approvalStatus != tt.wantStatus || result != tt.wantResult || pipeline.ID != 2 {
+				t.Errorf("approveDeployment() = %d, %s, status %s, want 2, %s, status %s", pipeline.ID, result, approvalStatus, tt.wantResult, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func Test_runRequests(t *testing.T) {
+	var runs runRequests
+
+	now := time.Now()
+
+	first := runs.add(runRequest{Project: "group/project", ProjectID: 10, Ref: "main", UserID: 1}, now)
+	second := runs.add(runRequest{Project: "group/project", ProjectID: 10, Ref: "dev", UserID: 1}, now)
+
+	if first == second {
+		t.Fatalf("add() returned the same id %d twice", first)
+	}
+
+	if _, err := runs.take(first, 10, 2, now); err == nil {
+		t.Error("take() by other user error = nil, want error")
+	}
+
+	// button sent before restart has the same id, but other project
+	if _, err := runs.take(first, 20, 1, now); err == nil {
+		t.Error("take() by button of other project error = nil, want error")
+	}
+
+	if request, err := runs.take(first, 10, 1, now); err != nil || request.Ref != "main" {
+		t.Errorf("take() = %#v, %v, want main request", request, err)
+	}
+
+	if _, err := runs.take(first, 10, 1, now); err == nil {
+		t.Error("take() of taken request error = nil, want error")
+	}
+
+	if _, err := runs.take(second, 10, 1, now.Add(runConfirmTimeout+time.Second)); err == nil {
+		t.Error("take() of expired request error = nil, want error")
+	}
+
+	// ids don't restart after restart, so old buttons don't match new requests
+	var restarted runRequests
+
+	if id := restarted.add(runRequest{ProjectID: 10, UserID: 1}, now); id == first || id == second {
+		t.Errorf("add() after restart = %d, want new id", id)
+	}
+}
+
+func Test_parseVariables(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		want    []string
+		wantErr bool
+	}{
+		{"empty", nil, []string{}, false},
+		{"variables", []string{"DEPLOY=1", "TARGET=prod=eu", "EMPTY="}, []string{"DEPLOY=1", "TARGET=prod=eu", "EMPTY="}, false},
+		{"without value", []string{"DEPLOY"}, nil, true},
+		{"wrong key", []string{"1DEPLOY=1"}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseVariables(tt.args)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseVariables() error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseVariables() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if got := pipelineVariables([]string{"TARGET=prod=eu"}); len(*got) != 1 || *(*got)[0].Key != "TARGET" || *(*got)[0].Value != "prod=eu" {
+		t.Errorf("pipelineVariables() = %v", got)
+	}
+
+	if got := pipelineVariables(nil); got != nil {
+		t.Errorf("pipelineVariables() = %v, want nil", got)
+	}
+}
+
+func Test_formatRunRequest(t *testing.T) {
+	tests := []struct {
+		name    string
+		request runRequest
+		want    string
+	}{
+		{"without variables", runRequest{Project: "group/project", Ref: "main"}, "run pipeline of group/project on main"},
+		{"variables", runRequest{Project: "group/project", Ref: "main", Variables: []string{"A=1", "B=2"}}, "run pipeline of group/project on main\nvariables: A=1, B=2"},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if got := isAllowedID(tt.args.conf, tt.args.id); got != tt.want {
-				t.Errorf("isAllowedID() = %v, want %v", got, tt.want)
+			if got := formatRunRequest(tt.request); got != tt.want {
+				t.Errorf("formatRunRequest() = %v, want %v", got, tt.want)
 			}
 		})
 	}
@@ -89,7 +370,7 @@ func Test_isAllowedID(t *testing.T) {
 func TestInitTelegramHandler(t *testing.T) {
 	type args struct {
 		gitlabClient *gl.Client
-		conf         *config.Config
+		conf         *config.Shared
 		tr           *track.Track
 	}
 	tests := []struct {
@@ -277,6 +558,26 @@ func TestTelegramHandler_Handler(t *testing.T) {
 				},
 			},
 		},
+		{
+			name: "new message, allowed ID, /pipeline with unknown mode",
+			fields: fields{
+				Conf: &config.Config{
+					AllowedIDsList: []string{
+						"1",
+					},
+				},
+			},
+			args: args{
+				update: &models.Update{
+					Message: &models.Message{
+						Text: "/pipeline https://yourgitlab.com/yourgroup/yourproject/-/pipelines/12345 test",
+						Chat: models.Chat{
+							ID: 1,
+						},
+					},
+				},
+			},
+		},
 		{
 			name: "new message, allowed ID, without number /pipeline",
 			fields: fields{
@@ -337,6 +638,226 @@ func TestTelegramHandler_Handler(t *testing.T) {
 				},
 			},
 		},
+		{
+			name: "new message, allowed ID, good /jobs",
+			fields: fields{
+				Conf: &config.Config{
+					AllowedIDsList: []string{
+						"1",
+					},
+				},
+			},
+			args: args{
+				update: &models.Update{
+					Message: &models.Message{
+						Text: "/jobs https://yourgitlab.com/yourgroup/yourproject/-/pipelines/12345",
+						Chat: models.Chat{
+							ID: 1,
+						},
+					},
+				},
+			},
+		},
+		{
+			name: "new message, allowed ID, empty /jobs",
+			fields: fields{
+				Conf: &config.Config{
+					AllowedIDsList: []string{
+						"1",
+					},
+				},
+			},
+			args: args{
+				update: &models.Update{
+					Message: &models.Message{
+						Text: "/jobs",
+						Chat: models.Chat{
+							ID: 1,
+						},
+					},
+				},
+			},
+		},
+		{
+			name: "new message, allowed ID, good /mr",
+			fields: fields{
+				Conf: &config.Config{
+					AllowedIDsList: []string{
+						"1",
+					},
+				},
+			},
+			args: args{
+				update: &models.Update{
+					Message: &models.Message{
+						Text: "/mr https://yourgitlab.com/yourgroup/yourproject/-/merge_requests/12345",
+						Chat: models.Chat{
+							ID: 1,
+						},
+					},
+				},
+			},
+		},
+		{
+			name: "new message, allowed ID, /mr with issue url",
+			fields: fields{
+				Conf: &config.Config{
+					AllowedIDsList: []string{
+						"1",
+					},
+				},
+			},
+			args: args{
+				update: &models.Update{
+					Message: &models.Message{
+						Text: "/mr https://yourgitlab.com/yourgroup/yourproject/-/issues/12345",
+						Chat: models.Chat{
+							ID: 1,
+						},
+					},
+				},
+			},
+		},
+		{
+			name: "new message, allowed ID, /subscriptions",
+			fields: fields{
+				Conf: &config.Config{
+					AllowedIDsList: []string{
+						"1",
+					},
+				},
+			},
+			args: args{
+				update: &models.Update{
+					Message: &models.Message{
+						Text: "/subscriptions",
+						Chat: models.Chat{
+							ID: 1,
+						},
+					},
+				},
+			},
+		},
+		{
+			name: "new message, allowed ID, empty /subscribe",
+			fields: fields{
+				Conf: &config.Config{
+					AllowedIDsList: []string{
+						"1",
+					},
+				},
+			},
+			args: args{
+				update: &models.Update{
+					Message: &models.Message{
+						Text: "/subscribe",
+						Chat: models.Chat{
+							ID: 1,
+						},
+					},
+				},
+			},
+		},
+		{
+			name: "new message, allowed ID, good /subscribe",
+			fields: fields{
+				Conf: &config.Config{
+					AllowedIDsList: []string{
+						"1",
+					},
+				},
+			},
+			args: args{
+				update: &models.Update{
+					Message: &models.Message{
+						Text: "/subscribe yourgroup/yourproject main only-failures",
+						Chat: models.Chat{
+							ID: 1,
+						},
+					},
+				},
+			},
+		},
+		{
+			name: "new message, allowed ID, empty /unsubscribe",
+			fields: fields{
+				Conf: &config.Config{
+					AllowedIDsList: []string{
+						"1",
+					},
+				},
+			},
+			args: args{
+				update: &models.Update{
+					Message: &models.Message{
+						Text: "/unsubscribe",
+						Chat: models.Chat{
+							ID: 1,
+						},
+					},
+				},
+			},
+		},
+		{
+			name: "new message, allowed ID, good /unsubscribe",
+			fields: fields{
+				Conf: &config.Config{
+					AllowedIDsList: []string{
+						"1",
+					},
+				},
+			},
+			args: args{
+				update: &models.Update{
+					Message: &models.Message{
+						Text: "/unsubscribe yourgroup/yourproject main",
+						Chat: models.Chat{
+							ID: 1,
+						},
+					},
+				},
+			},
+		},
+		{
+			name: "new message, allowed ID, /resume",
+			fields: fields{
+				Conf: &config.Config{
+					AllowedIDsList: []string{
+						"1",
+					},
+				},
+			},
+			args: args{
+				update: &models.Update{
+					Message: &models.Message{
+						Text: "/resume",
+						Chat: models.Chat{
+							ID: 1,
+						},
+					},
+				},
+			},
+		},
+		{
+			name: "new message, allowed ID, /p with wrong timeout",
+			fields: fields{
+				Conf: &config.Config{
+					AllowedIDsList: []string{
+						"1",
+					},
+				},
+			},
+			args: args{
+				update: &models.Update{
+					Message: &models.Message{
+						Text: "/p https://yourgitlab.com/yourgroup/yourproject/-/pipelines/1 1s",
+						Chat: models.Chat{
+							ID: 1,
+						},
+					},
+				},
+			},
+		},
 		{
 			name: "new message, allowed ID, good /issue",
 			fields: fields{
@@ -422,10 +943,278 @@ func TestTelegramHandler_Handler(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			th := &TelegramHandler{
 				GitlabClient: tt.fields.GitlabClient,
-				Conf:         tt.fields.Conf,
+				Conf:         config.NewShared(tt.fields.Conf),
 				Track:        tt.fields.Track,
 			}
 			th.Handler(tt.args.ctx, tt.args.b, tt.args.update)
 		})
 	}
 }
+
+func TestTelegramHandler_Handler_resume(t *testing.T) {
+	conf := config.NewShared(&config.Config{AllowedUsers: "1:viewer"})
+
+	c := cron.InitCron(nil, conf)
+	defer c.Cron.Stop()
+
+	cron.AddJob(cron.Job{Cron: c, Key: "Pipeline/1/group/project/1", ToID: 1, Project: "group/project", PipelineID: 1, Status: "running", Paused: true})
+
+	th := &TelegramHandler{Conf: conf, Track: track.InitTrack(nil, conf, c)}
+
+	th.Handler(context.Background(), nil, &models.Update{
+		Message: &models.Message{
+			Text: "/resume",
+			Chat: models.Chat{ID: 1, Type: models.ChatTypePrivate},
+			From: &models.User{ID: 1},
+		},
+	})
+
+	if c.GetJob("Pipeline/1/group/project/1").Paused {
+		t.Error("Handler() /resume from viewer kept job paused")
+	}
+}
+
+func TestTelegramHandler_resolvePipeline(t *testing.T) {
+	tests := []struct {
+		name        string
+		conf        *config.Config
+		pipelineURL string
+		wantProject string
+		wantNumber  int
+		wantErr     bool
+	}{
+		{
+			name:        "good",
+			pipelineURL: "https://yourgitlab.com/yourgroup/yourproject/-/pipelines/12345",
+			wantProject: "yourgroup/yourproject",
+			wantNumber:  12345,
+		},
+		{
+			name:        "nested group",
+			conf:        &config.Config{GitlabURL: "https://yourgitlab.com/api/v4"},
+			pipelineURL: "https://yourgitlab.com/yourgroup/sub/yourproject/-/pipelines/12345/",
+			wantProject: "yourgroup/sub/yourproject",
+			wantNumber:  12345,
+		},
+		{
+			name:        "other host",
+			conf:        &config.Config{GitlabURL: "https://yourgitlab.com/api/v4"},
+			pipelineURL: "https://microsoft.com/yourgroup/yourproject/-/pipelines/12345",
+			wantErr:     true,
+		},
+		{
+			name:        "issue url",
+			pipelineURL: "https://yourgitlab.com/yourgroup/yourproject/-/issues/12345",
+			wantErr:     true,
+		},
+		{
+			name:        "without number",
+			pipelineURL: "https://yourgitlab.com/yourgroup/yourproject/-/pipelines/test",
+			wantErr:     true,
+		},
+		{
+			name:        "bad",
+			pipelineURL: "https://microsoft.com",
+			wantErr:     true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			th := &TelegramHandler{Conf: config.NewShared(tt.conf)}
+			project, number, err := th.resolvePipeline(tt.pipelineURL)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("resolvePipeline() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if project != tt.wantProject || number != tt.wantNumber {
+				t.Errorf("resolvePipeline() = %v, %v, want %v, %v", project, number, tt.wantProject, tt.wantNumber)
+			}
+		})
+	}
+}
+
+func TestTelegramHandler_CallbackHandler(t *testing.T) {
+	conf := &config.Config{
+		AllowedIDsList: []string{
+			"1",
+		},
+	}
+
+	tests := []struct {
+		name   string
+		update *models.Update
+	}{
+		{
+			name:   "no callback query",
+			update: &models.Update{},
+		},
+		{
+			name: "inaccessible message",
+			update: &models.Update{
+				CallbackQuery: &models.CallbackQuery{
+					Data: "retry:1:2",
+				},
+			},
+		},
+		{
+			name: "not allowed ID",
+			update: &models.Update{
+				CallbackQuery: &models.CallbackQuery{
+					Data: "retry:1:2",
+					Message: models.MaybeInaccessibleMessage{
+						Message: &models.Message{ID: 1, Chat: models.Chat{ID: 2}},
+					},
+				},
+			},
+		},
+		{
+			name: "bad data",
+			update: &models.Update{
+				CallbackQuery: &models.CallbackQuery{
+					Data: "test",
+					Message: models.MaybeInaccessibleMessage{
+						Message: &models.Message{ID: 1, Chat: models.Chat{ID: 1}},
+					},
+				},
+			},
+		},
+		{
+			name: "unknown action",
+			update: &models.Update{
+				CallbackQuery: &models.CallbackQuery{
+					Data: "test:1:2",
+					Message: models.MaybeInaccessibleMessage{
+						Message: &models.Message{ID: 1, Chat: models.Chat{ID: 1}},
+					},
+				},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			th := &TelegramHandler{
+				Conf: config.NewShared(conf),
+			}
+			th.CallbackHandler(context.Background(), nil, tt.update)
+		})
+	}
+}
+
+func TestEditMessage(t *testing.T) {
+	type args struct {
+		chatID    int64
+		messageID int
+		message   string
+		b         *bot.Bot
+	}
+	tests := []struct {
+		name    string
+		args    args
+		wantErr bool
+	}{
+		{
+			name:    "empty bot",
+			wantErr: true,
+		},
+		{
+			name:    "empty message id",
+			wantErr: true,
+			args: args{
+				chatID: 1,
+				b:      &bot.Bot{},
+			},
+		},
+		{
+			name:    "empty message",
+			wantErr: true,
+			args: args{
+				chatID:    1,
+				messageID: 1,
+				b:         &bot.Bot{},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := EditMessage(context.Background(), tt.args.b, tt.args.chatID, tt.args.messageID, tt.args.message, nil); (err != nil) != tt.wantErr {
+				t.Errorf("EditMessage() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_parseProjectPath(t *testing.T) {
+	tests := []struct {
+		name    string
+		project string
+		conf    *config.Config
+		want    string
+	}{
+		{
+			name:    "path",
+			project: "/yourgroup/yourproject/",
+			want:    "yourgroup/yourproject",
+		},
+		{
+			name:    "project url",
+			project: "https://yourgitlab.com/yourgroup/sub/yourproject",
+			conf:    &config.Config{GitlabURL: "https://yourgitlab.com/api/v4"},
+			want:    "yourgroup/sub/yourproject",
+		},
+		{
+			name:    "pipeline url",
+			project: "https://yourgitlab.com/yourgroup/yourproject/-/pipelines/1",
+			want:    "yourgroup/yourproject",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseProjectPath(tt.project, tt.conf); got != tt.want {
+				t.Errorf("parseProjectPath() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_formatSubscription(t *testing.T) {
+	tests := []struct {
+		name         string
+		project      string
+		branch       string
+		onlyFailures bool
+		notifiers    []string
+		username     string
+		want         string
+	}{
+		{
+			name:    "all branches",
+			project: "group/project",
+			want:    "group/project, all branches",
+		},
+		{
+			name:         "branch, only failures",
+			project:      "group/project",
+			branch:       "main",
+			onlyFailures: true,
+			want:         "group/project, branch main, only failures",
+		},
+		{
+			name:      "notifiers",
+			project:   "group/project",
+			notifiers: []string{"team", "ops"},
+			want:      "group/project, all branches, notify team, ops",
+		},
+		{
+			name:     "mine",
+			project:  "group/project",
+			username: "user",
+			want:     "group/project, all branches, only pipelines of user",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := formatSubscription(tt.project, tt.branch, tt.onlyFailures, tt.notifiers, tt.username); got != tt.want {
+				t.Errorf("formatSubscription() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,6 +1,9 @@
 package track
 
 import (
+	"fmt"
+	"time"
+
 	"github.com/ad/gitlab-pipelines-notifier/config"
 	"github.com/ad/gitlab-pipelines-notifier/cron"
 	"github.com/go-telegram/bot"
@@ -10,11 +13,11 @@ import (
 type Track struct {
 	Bot          *bot.Bot
 	GitlabClient *gl.Client
-	Conf         *config.Config
+	Conf         *config.Shared
 	Cron         *cron.Cron
 }
 
-func InitTrack(gitlabClient *gl.Client, conf *config.Config, cron *cron.Cron) *Track {
+func InitTrack(gitlabClient *gl.Client, conf *config.Shared, cron *cron.Cron) *Track {
 	tr := &Track{
 		GitlabClient: gitlabClient,
 		Conf:         conf,
@@ -29,21 +32,179 @@ func (tr *Track) SetCron(cron *cron.Cron) {
 
 }
 
-func (tr *Track) StartTrack(toID int64, pipelineNumber int, key, project, status string) {
+// PipelineKey is key of pipeline watch, it includes chat so the same pipeline can be watched from several chats
+func PipelineKey(toID int64, project string, pipelineID int) string {
+	return fmt.Sprintf("Pipeline/%d/%s/%d", toID, project, pipelineID)
+}
+
+func (tr *Track) StartTrack(toID int64, threadID int, pipelineNumber int, key, project, status, mode string, messageID int, timeout time.Duration) {
 	if tr.Cron == nil {
 		return
 	}
 
+	b := tr.Bot
+	if b == nil {
+		b = tr.Cron.Bot
+	}
+
 	job := cron.Job{
 		Cron:       tr.Cron,
-		Bot:        tr.Bot,
+		Bot:        b,
 		Gitlab:     tr.GitlabClient,
 		Key:        key,
 		ToID:       toID,
+		ThreadID:   threadID,
 		Project:    project,
 		PipelineID: pipelineNumber,
 		Status:     status,
+		Mode:       mode,
+		MessageID:  messageID,
+		Timeout:    timeout,
 	}
 
 	cron.AddJob(job)
 }
+
+// Extend restarts timeout of pipeline watch, returns false if pipeline is not watched
+func (tr *Track) Extend(toID int64, pipelineNumber int) bool {
+	if tr == nil || tr.Cron == nil {
+		return false
+	}
+
+	return tr.Cron.ExtendPipelineJobs(toID, pipelineNumber) > 0
+}
+
+// StopTrack removes watches of pipeline for user, returns false if nothing was watched
+func (tr *Track) StopTrack(toID int64, pipelineNumber int) bool {
+	if tr == nil || tr.Cron == nil {
+		return false
+	}
+
+	return tr.Cron.RemovePipelineJobs(toID, pipelineNumber) > 0
+}
+
+// IsTracked reports whether pipeline is watched by user
+func (tr *Track) IsTracked(toID int64, pipelineNumber int) bool {
+	if tr == nil || tr.Cron == nil {
+		return false
+	}
+
+	for _, job := range tr.Cron.Jobs() {
+		if job.PipelineID == pipelineNumber && job.ToID == toID {
+			return true
+		}
+	}
+
+	return false
+}
+
+// StartMergeRequestTrack watches merge request, current approvals, comments and pipeline are not notified
+func (tr *Track) StartMergeRequestTrack(toID int64, threadID int, project string, mergeRequest *gl.MergeRequest, approvals *gl.MergeRequestApprovals) {
+	if tr.Cron == nil || mergeRequest == nil {
+		return
+	}
+
+	b := tr.Bot
+	if b == nil {
+		b = tr.Cron.Bot
+	}
+
+	job := cron.Job{
+		Cron:            tr.Cron,
+		Bot:             b,
+		Gitlab:          tr.GitlabClient,
+		Key:             fmt.Sprintf("MergeRequest/%d/%s/%d", toID, project, mergeRequest.IID),
+		ToID:            toID,
+		ThreadID:        threadID,
+		Project:         project,
+		Status:          mergeRequest.State,
+		MergeRequestIID: mergeRequest.IID,
+		Notes:           mergeRequest.UserNotesCount,
+	}
+
+	if approvals != nil {
+		job.Approvals = len(approvals.ApprovedBy)
+	}
+
+	if mergeRequest.HeadPipeline != nil {
+		job.HeadPipelineID = mergeRequest.HeadPipeline.ID
+		job.HeadPipelineStatus = mergeRequest.HeadPipeline.Status
+	}
+
+	cron.AddJob(job)
+}
+
+func subscriptionKey(toID int64, project, branch string) string {
+	return fmt.Sprintf("Subscription/%d/%s/%s", toID, project, branch)
+}
+
+// Subscribe tracks pipelines of project for chat, empty branch means all branches,
+// notifications go to forum topic threadID of chat, it is replaced by later subscription from another topic,
+// notifications are also sent to notifiers from config, non empty username limits pipelines to this gitlab user
+func (tr *Track) Subscribe(toID int64, threadID int, project, branch string, onlyFailures bool, notifiers []string, username string) {
+	if tr.Cron == nil {
+		return
+	}
+
+	b := tr.Bot
+	if b == nil {
+		b = tr.Cron.Bot
+	}
+
+	job := cron.Job{
+		Cron:         tr.Cron,
+		Bot:          b,
+		Gitlab:       tr.GitlabClient,
+		Key:          subscriptionKey(toID, project, branch),
+		ToID:         toID,
+		ThreadID:     threadID,
+		Project:      project,
+		Subscription: true,
+		Branch:       branch,
+		OnlyFailures: onlyFailures,
+		Notifiers:    notifiers,
+		Username:     username,
+	}
+
+	cron.AddJob(job)
+}
+
+// Unsubscribe removes subscriptions of chat to project, empty branch removes subscriptions for all branches,
+// returns count of removed subscriptions
+func (tr *Track) Unsubscribe(toID int64, project, branch string) int {
+	if tr == nil || tr.Cron == nil {
+		return 0
+	}
+
+	removed := 0
+
+	for _, job := range tr.Cron.Subscriptions(toID) {
+		if job.Project != project || (branch != "" && job.Branch != branch) {
+			continue
+		}
+
+		cron.RemoveJob(job)
+
+		removed++
+	}
+
+	return removed
+}
+
+// Subscriptions returns subscriptions of chat
+func (tr *Track) Subscriptions(toID int64) []*cron.Job {
+	if tr == nil || tr.Cron == nil {
+		return nil
+	}
+
+	return tr.Cron.Subscriptions(toID)
+}
+
+// Resume resumes jobs of chat paused after polling errors, returns count of resumed jobs
+func (tr *Track) Resume(toID int64) int {
+	if tr == nil || tr.Cron == nil {
+		return 0
+	}
+
+	return tr.Cron.ResumeJobs(toID)
+}
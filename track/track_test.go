@@ -15,7 +15,7 @@ func TestTrack_StartTrack(t *testing.T) {
 	type fields struct {
 		Bot          *bot.Bot
 		GitlabClient *gl.Client
-		Conf         *config.Config
+		Conf         *config.Shared
 		Cron         *cron.Cron
 	}
 	type args struct {
@@ -24,6 +24,8 @@ func TestTrack_StartTrack(t *testing.T) {
 		key            string
 		project        string
 		status         string
+		mode           string
+		messageID      int
 	}
 
 	C := cron.InitCron(nil, nil)
@@ -51,7 +53,7 @@ func TestTrack_StartTrack(t *testing.T) {
 				Conf:         tt.fields.Conf,
 				Cron:         tt.fields.Cron,
 			}
-			tr.StartTrack(tt.args.toID, tt.args.pipelineNumber, tt.args.key, tt.args.project, tt.args.status)
+			tr.StartTrack(tt.args.toID, 0, tt.args.pipelineNumber, tt.args.key, tt.args.project, tt.args.status, tt.args.mode, tt.args.messageID, 0)
 		})
 	}
 }
@@ -59,7 +61,7 @@ func TestTrack_StartTrack(t *testing.T) {
 func TestInitTrack(t *testing.T) {
 	type args struct {
 		gitlabClient *gl.Client
-		conf         *config.Config
+		conf         *config.Shared
 		cron         *cron.Cron
 	}
 	tests := []struct {
@@ -85,7 +87,7 @@ func TestTrack_SetCron(t *testing.T) {
 	type fields struct {
 		Bot          *bot.Bot
 		GitlabClient *gl.Client
-		Conf         *config.Config
+		Conf         *config.Shared
 		Cron         *cron.Cron
 	}
 	type args struct {
@@ -112,3 +114,113 @@ func TestTrack_SetCron(t *testing.T) {
 		})
 	}
 }
+
+func TestTrack_IsTracked_StopTrack(t *testing.T) {
+	C := cron.InitCron(nil, nil)
+
+	tr := InitTrack(nil, nil, C)
+	tr.StartTrack(1, 0, 2, "group/project/2", "group/project", "running", cron.ModeFinal, 0, 0)
+
+	if !tr.IsTracked(1, 2) {
+		t.Fatal("IsTracked() = false, want true")
+	}
+
+	if tr.IsTracked(3, 2) {
+		t.Fatal("IsTracked() for other user = true, want false")
+	}
+
+	if !tr.StopTrack(1, 2) {
+		t.Fatal("StopTrack() = false, want true")
+	}
+
+	if tr.IsTracked(1, 2) {
+		t.Fatal("IsTracked() after StopTrack() = true, want false")
+	}
+
+	if tr.StopTrack(1, 2) {
+		t.Fatal("StopTrack() twice = true, want false")
+	}
+}
+
+func TestTrack_StartTrack_severalChats(t *testing.T) {
+	C := cron.InitCron(nil, nil)
+
+	tr := InitTrack(nil, nil, C)
+	tr.StartTrack(1, 0, 2, PipelineKey(1, "group/project", 2), "group/project", "running", cron.ModeFinal, 0, 0)
+	tr.StartTrack(3, 0, 2, PipelineKey(3, "group/project", 2), "group/project", "running", cron.ModeFinal, 0, 0)
+
+	if !tr.IsTracked(1, 2) || !tr.IsTracked(3, 2) {
+		t.Fatal("IsTracked() = false, want pipeline watched from both chats")
+	}
+
+	if !tr.StopTrack(1, 2) {
+		t.Fatal("StopTrack() = false, want true")
+	}
+
+	if tr.IsTracked(1, 2) || !tr.IsTracked(3, 2) {
+		t.Fatal("StopTrack() should stop watch of one chat only")
+	}
+}
+
+func TestTrack_StartMergeRequestTrack(t *testing.T) {
+	C := cron.InitCron(nil, nil)
+
+	tr := InitTrack(nil, nil, C)
+	tr.StartMergeRequestTrack(1, 0, "group/project", &gl.MergeRequest{
+		IID:            2,
+		State:          "opened",
+		UserNotesCount: 3,
+		HeadPipeline:   &gl.Pipeline{ID: 4, Status: "running"},
+	}, &gl.MergeRequestApprovals{
+		ApprovedBy: []*gl.MergeRequestApproverUser{{}},
+	})
+
+	job := C.GetJob("MergeRequest/1/group/project/2")
+	if job == nil {
+		t.Fatal("StartMergeRequestTrack() job not added")
+	}
+
+	if !job.IsMergeRequestWatch() || job.Notes != 3 || job.Approvals != 1 || job.HeadPipelineID != 4 || job.HeadPipelineStatus != "running" {
+		t.Errorf("StartMergeRequestTrack() job = %#v", job)
+	}
+}
+
+func TestTrack_Subscribe(t *testing.T) {
+	C := cron.InitCron(nil, nil)
+
+	tr := InitTrack(nil, nil, C)
+	tr.Subscribe(1, 0, "group/project", "main", true, []string{"team"}, "user")
+	tr.Subscribe(1, 0, "group/project", "", false, nil, "")
+	tr.Subscribe(1, 0, "group/other", "", false, nil, "")
+	tr.Subscribe(2, 0, "group/project", "", false, nil, "")
+
+	subscriptions := tr.Subscriptions(1)
+	if len(subscriptions) != 3 {
+		t.Fatalf("Subscriptions() = %d, want 3", len(subscriptions))
+	}
+
+	if !subscriptions[2].Subscription || subscriptions[2].Branch != "main" || !subscriptions[2].OnlyFailures ||
+		len(subscriptions[2].Notifiers) != 1 || subscriptions[2].Username != "user" {
+		t.Errorf("Subscriptions() job = %#v", subscriptions[2])
+	}
+
+	if removed := tr.Unsubscribe(1, "group/project", "main"); removed != 1 {
+		t.Errorf("Unsubscribe() = %d, want 1", removed)
+	}
+
+	if removed := tr.Unsubscribe(1, "group/other", ""); removed != 1 {
+		t.Errorf("Unsubscribe() = %d, want 1", removed)
+	}
+
+	if removed := tr.Unsubscribe(1, "group/unknown", ""); removed != 0 {
+		t.Errorf("Unsubscribe() = %d, want 0", removed)
+	}
+
+	if got := len(tr.Subscriptions(1)); got != 1 {
+		t.Errorf("Subscriptions() = %d, want 1", got)
+	}
+
+	if got := len(tr.Subscriptions(2)); got != 1 {
+		t.Errorf("Subscriptions() for other chat = %d, want 1", got)
+	}
+}
@@ -0,0 +1,164 @@
+package webhook
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/ad/gitlab-pipelines-notifier/config"
+	"github.com/ad/gitlab-pipelines-notifier/cron"
+	"github.com/ad/gitlab-pipelines-notifier/metrics"
+	"github.com/ad/gitlab-pipelines-notifier/recovery"
+
+	gl "github.com/xanzy/go-gitlab"
+)
+
+const (
+	DefaultListen = ":18000"
+	Path          = "/webhook"
+
+	maxPayloadSize = 5 << 20
+)
+
+type Webhook struct {
+	Conf *config.Shared
+	Cron *cron.Cron
+}
+
+func InitWebhook(conf *config.Shared, c *cron.Cron) *Webhook {
+	wh := &Webhook{
+		Conf: conf,
+		Cron: c,
+	}
+
+	return wh
+}
+
+// Start listens for gitlab webhooks, health checks and metrics requests until ctx is done,
+// webhook receiver is enabled only if secret is set
+func (wh *Webhook) Start(ctx context.Context) error {
+	conf := wh.Conf.Load()
+
+	listen := DefaultListen
+	if conf != nil && conf.WebhookListen != "" {
+		listen = conf.WebhookListen
+	}
+
+	mux := http.NewServeMux()
+	metrics.Register(mux)
+
+	if conf != nil && conf.WebhookSecret != "" {
+		mux.HandleFunc(Path, wh.Handler)
+
+		log.Println("webhook receiver listening on", listen+Path)
+	} else {
+		log.Println("webhook secret not set, webhook receiver disabled")
+	}
+
+	server := &http.Server{
+		Addr:              listen,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		_ = server.Shutdown(shutdownCtx)
+	}()
+
+	log.Println("health checks and metrics listening on", listen)
+
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	return nil
+}
+
+// Handler accepts Pipeline Hook, Job Hook and Merge Request Hook events from gitlab
+func (wh *Webhook) Handler(w http.ResponseWriter, r *http.Request) {
+	defer recovery.Recovery()
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+
+		return
+	}
+
+	if !wh.isValidToken(r.Header.Get("X-Gitlab-Token")) {
+		log.Printf("webhook with wrong token from %s", r.RemoteAddr)
+
+		http.Error(w, "wrong token", http.StatusUnauthorized)
+
+		return
+	}
+
+	payload, errRead := io.ReadAll(io.LimitReader(r.Body, maxPayloadSize))
+	if errRead != nil {
+		http.Error(w, "can't read body", http.StatusBadRequest)
+
+		return
+	}
+
+	eventType := gl.HookEventType(r)
+
+	event, errParse := gl.ParseWebhook(eventType, payload)
+	if errParse != nil {
+		log.Printf("error parsing webhook %s: %s", eventType, errParse)
+
+		http.Error(w, errParse.Error(), http.StatusBadRequest)
+
+		return
+	}
+
+	// gitlab waits for response only for a few seconds, so events are processed in background
+	go func() {
+		defer recovery.Recovery()
+
+		wh.process(event)
+	}()
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (wh *Webhook) process(event interface{}) {
+	if wh.Cron == nil {
+		return
+	}
+
+	switch e := event.(type) {
+	case *gl.PipelineEvent:
+		log.Printf("webhook pipeline %d in %s: %s", e.ObjectAttributes.ID, e.Project.PathWithNamespace, e.ObjectAttributes.Status)
+
+		wh.Cron.HandlePipelineEvent(e.Project.PathWithNamespace, e.Project.ID, e.ObjectAttributes.ID)
+	case *gl.JobEvent:
+		log.Printf("webhook job %d of pipeline %d: %s", e.BuildID, e.PipelineID, e.BuildStatus)
+
+		wh.Cron.HandleJobEvent(e.PipelineID)
+	case *gl.MergeEvent:
+		log.Printf("webhook merge request %d in %s: %s", e.ObjectAttributes.IID, e.Project.PathWithNamespace, e.ObjectAttributes.Action)
+
+		wh.Cron.HandleMergeRequestEvent(e.Project.PathWithNamespace, e.Project.ID, e.ObjectAttributes.IID)
+
+		if e.ObjectAttributes.HeadPipelineID != nil {
+			wh.Cron.HandleJobEvent(*e.ObjectAttributes.HeadPipelineID)
+		}
+	}
+}
+
+func (wh *Webhook) isValidToken(token string) bool {
+	conf := wh.Conf.Load()
+	if conf == nil || conf.WebhookSecret == "" || token == "" {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(token), []byte(conf.WebhookSecret)) == 1
+}
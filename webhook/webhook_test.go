@@ -0,0 +1,289 @@
+package webhook
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ad/gitlab-pipelines-notifier/config"
+	"github.com/ad/gitlab-pipelines-notifier/cron"
+
+	"github.com/google/go-cmp/cmp"
+	gl "github.com/xanzy/go-gitlab"
+)
+
+func TestWebhook_Handler(t *testing.T) {
+	wh := InitWebhook(config.NewShared(&config.Config{WebhookSecret: "secret"}), cron.InitCron(nil, nil))
+
+	tests := []struct {
+		name      string
+		method    string
+		token     string
+		eventType string
+		body      string
+		want      int
+	}{
+		{
+			name:   "wrong method",
+			method: http.MethodGet,
+			token:  "secret",
+			want:   http.StatusMethodNotAllowed,
+		},
+		{
+			name:      "no token",
+			method:    http.MethodPost,
+			eventType: "Pipeline Hook",
+			body:      `{"object_kind":"pipeline"}`,
+			want:      http.StatusUnauthorized,
+		},
+		{
+			name:      "wrong token",
+			method:    http.MethodPost,
+			token:     "test",
+			eventType: "Pipeline Hook",
+			body:      `{"object_kind":"pipeline"}`,
+			want:      http.StatusUnauthorized,
+		},
+		{
+			name:      "bad payload",
+			method:    http.MethodPost,
+			token:     "secret",
+			eventType: "Pipeline Hook",
+			body:      `test`,
+			want:      http.StatusBadRequest,
+		},
+		{
+			name:      "pipeline hook",
+			method:    http.MethodPost,
+			token:     "secret",
+			eventType: "Pipeline Hook",
+			body:      `{"object_kind":"pipeline","object_attributes":{"id":1,"status":"success"},"project":{"id":1,"path_with_namespace":"group/project"}}`,
+			want:      http.StatusOK,
+		},
+		{
+			name:      "job hook",
+			method:    http.MethodPost,
+			token:     "secret",
+			eventType: "Job Hook",
+			body:      `{"object_kind":"build","build_id":1,"pipeline_id":1,"build_status":"failed"}`,
+			want:      http.StatusOK,
+		},
+		{
+			name:      "merge request hook",
+			method:    http.MethodPost,
+			token:     "secret",
+			eventType: "Merge Request Hook",
+			body:      `{"object_kind":"merge_request","object_attributes":{"head_pipeline_id":1}}`,
+			want:      http.StatusOK,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, Path, strings.NewReader(tt.body))
+			r.Header.Set("X-Gitlab-Event", tt.eventType)
+			if tt.token != "" {
+				r.Header.Set("X-Gitlab-Token", tt.token)
+			}
+
+			w := httptest.NewRecorder()
+			wh.Handler(w, r)
+
+			if w.Code != tt.want {
+				t.Errorf("Handler() code = %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestWebhook_Handler_events(t *testing.T) {
+	watches := []cron.Job{
+		{Key: "Pipeline/1/group/project/1", ToID: 1, Project: "group/project", PipelineID: 1, Status: "running"},
+		{Key: "Pipeline/1/group/project/2", ToID: 1, Project: "group/project", PipelineID: 2, Status: "running"},
+		{Key: "MergeRequest/1/group/project/7", ToID: 1, Project: "group/project", MergeRequestIID: 7, Status: "opened"},
+	}
+
+	tests := []struct {
+		name          string
+		eventType     string
+		body          string
+		gitlab        map[string]string
+		wantRemoved   string
+		wantRequested []string
+	}{
+		{
+			name:      "pipeline hook finishes watched pipeline",
+			eventType: "Pipeline Hook",
+			body: `{
+				"object_kind": "pipeline",
+				"object_attributes": {"id": 1, "iid": 1, "ref": "main", "tag": false, "sha": "bcbb5ec3", "source": "push", "status": "success", "stages": ["test"]},
+				"user": {"id": 1, "name": "Alice", "username": "alice"},
+				"project": {"id": 10, "name": "project", "web_url": "https://gitlab.example.com/group/project", "path_with_namespace": "group/project"},
+				"builds": [{"id": 5, "stage": "test", "name": "test", "status": "success"}]
+			}`,
+			gitlab: map[string]string{
+				"/api/v4/projects/group/project/pipelines/1": `{"id":1,"project_id":10,"ref":"main","status":"success"}`,
+			},
+			wantRemoved:   "Pipeline/1/group/project/1",
+			wantRequested: []string{"/api/v4/projects/group/project/pipelines/1"},
+		},
+		{
+			name:      "job hook updates watched pipeline",
+			eventType: "Job Hook",
+			body: `{
+				"object_kind": "build",
+				"ref": "main",
+				"build_id": 6,
+				"build_name": "test",
+				"build_stage": "test",
+				"build_status": "failed",
+				"build_allow_failure": false,
+				"pipeline_id": 2,
+				"project_id": 10,
+				"project_name": "group / project",
+				"user": {"id": 1, "name": "Alice", "email": "alice@example.com"}
+			}`,
+			gitlab: map[string]string{
+				"/api/v4/projects/group/project/pipelines/2":      `{"id":2,"project_id":10,"ref":"main","status":"failed"}`,
+				"/api/v4/projects/group/project/pipelines/2/jobs": `[]`,
+			},
+			wantRemoved: "Pipeline/1/group/project/2",
+			wantRequested: []string{
+				"/api/v4/projects/group/project/pipelines/2",
+				"/api/v4/projects/group/project/pipelines/2/jobs",
+			},
+		},
+		{
+			name:      "merge request hook updates watched merge request",
+			eventType: "Merge Request Hook",
+			body: `{
+				"object_kind": "merge_request",
+				"event_type": "merge_request",
+				"user": {"id": 1, "name": "Alice", "username": "alice"},
+				"project": {"id": 10, "name": "project", "web_url": "https://gitlab.example.com/group/project", "path_with_namespace": "group/project"},
+				"object_attributes": {"id": 70, "iid": 7, "title": "feature", "state": "merged", "action": "merge", "source_branch": "feature", "target_branch": "main"}
+			}`,
+			gitlab: map[string]string{
+				"/api/v4/projects/group/project/merge_requests/7":           `{"id":70,"iid":7,"state":"merged","merged_by":{"username":"alice"}}`,
+				"/api/v4/projects/group/project/merge_requests/7/approvals": `{"approved_by":[]}`,
+			},
+			wantRemoved: "MergeRequest/1/group/project/7",
+			wantRequested: []string{
+				"/api/v4/projects/group/project/merge_requests/7",
+				"/api/v4/projects/group/project/merge_requests/7/approvals",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				mu        sync.Mutex
+				requested []string
+			)
+
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				requested = append(requested, r.URL.Path)
+				mu.Unlock()
+
+				response, ok := tt.gitlab[r.URL.Path]
+				if !ok {
+					http.NotFound(w, r)
+
+					return
+				}
+
+				w.Header().Set("Content-Type", "application/json")
+				fmt.Fprint(w, response)
+			}))
+			defer server.Close()
+
+			gitlabClient, err := gl.NewClient("test", gl.WithBaseURL(server.URL))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			conf := config.NewShared(&config.Config{WebhookSecret: "secret"})
+
+			c := cron.InitCron(nil, conf)
+			defer c.Cron.Stop()
+
+			for _, watch := range watches {
+				watch.Cron = c
+				watch.Gitlab = gitlabClient
+
+				cron.AddJob(watch)
+			}
+
+			r := httptest.NewRequest(http.MethodPost, Path, strings.NewReader(tt.body))
+			r.Header.Set("X-Gitlab-Event", tt.eventType)
+			r.Header.Set("X-Gitlab-Token", "secret")
+
+			w := httptest.NewRecorder()
+			InitWebhook(conf, c).Handler(w, r)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("Handler() code = %d, want %d", w.Code, http.StatusOK)
+			}
+
+			// events are processed in background, finished watch is removed at the end
+			for deadline := time.Now().Add(5 * time.Second); c.GetJob(tt.wantRemoved) != nil; time.Sleep(10 * time.Millisecond) {
+				if time.Now().After(deadline) {
+					t.Fatalf("Handler() kept watch %s", tt.wantRemoved)
+				}
+			}
+
+			for _, watch := range watches {
+				if watch.Key != tt.wantRemoved && c.GetJob(watch.Key) == nil {
+					t.Errorf("Handler() removed watch %s", watch.Key)
+				}
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			if diff := cmp.Diff(tt.wantRequested, requested); diff != "" {
+				t.Errorf("Handler() gitlab requests mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestWebhook_isValidToken(t *testing.T) {
+	tests := []struct {
+		name   string
+		secret string
+		token  string
+		want   bool
+	}{
+		{
+			name: "empty secret",
+		},
+		{
+			name:   "empty token",
+			secret: "secret",
+		},
+		{
+			name:   "wrong token",
+			secret: "secret",
+			token:  "test",
+		},
+		{
+			name:   "valid token",
+			secret: "secret",
+			token:  "secret",
+			want:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wh := &Webhook{Conf: config.NewShared(&config.Config{WebhookSecret: tt.secret})}
+			if got := wh.isValidToken(tt.token); got != tt.want {
+				t.Errorf("isValidToken() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}